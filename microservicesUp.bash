@@ -2,7 +2,7 @@
 
 go run src/kVService.go &
 go run src/taskService.go 127.0.0.1:3001 127.0.0.1:3000 &
-go run src/storageService.go 127.0.0.1:3002 127.0.0.1:3000 &
-go run src/masterService.go 127.0.0.1:3003 127.0.0.1:3000 &
-go run src/workerService.go 127.0.0.1:3000 100 &
+go run src/storageService.go src/names.go 127.0.0.1:3002 127.0.0.1:3000 &
+go run src/master*.go src/imageFormats.go src/imageLimits.go src/imageMetadata.go src/filterSchemas.go src/pixelExpression.go src/names.go 127.0.0.1:3003 127.0.0.1:3000 &
+go run $(ls src/worker*.go | grep -v _test.go) src/imageFormats.go src/imageLimits.go src/imageMetadata.go src/filterSchemas.go src/pixelExpression.go src/names.go 127.0.0.1:3000 100 &
 go run src/frontendService.go 127.0.0.1:3000 &
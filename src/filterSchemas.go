@@ -0,0 +1,442 @@
+package main
+
+// Shared between masterService (which lists the filters at /filters and checks the parameters of
+// new tasks against them) and workerService (which refuses to start when a filter it registered
+// has no schema here, or the other way round). Filters still check their own parameters, the
+// schema is there so clients find out what's wrong before a task is created.
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// The filter used when a task doesn't name one, so old clients keep getting the red/green swap.
+const defaultFilter = "swapRedGreen"
+
+// Workers publish the schema of every plugin filter they load in the key-value store, as JSON
+// under this prefix and the plugin's name, for masterService to add to the built-in ones. One key
+// per plugin means workers with different plugins don't overwrite each other.
+const pluginSchemaPrefix = "filterPlugin."
+
+// A parameter of a filter. Types are number, integer, boolean, text, color (#rgb, #rrggbb or
+// #rrggbbaa), numbers and colors (JSON arrays or strings separated by commas, semicolons or
+// spaces), input (the name of an image uploaded with the task), image (base64) and expression (a
+// program for the expression filter). Values, when given, are the only ones allowed. Min and Max
+// apply to every number of a list.
+type paramSchema struct {
+    Name string `json:"name"`
+    Type string `json:"type"`
+    Required bool `json:"required,omitempty"`
+    Min *float64 `json:"min,omitempty"`
+    Max *float64 `json:"max,omitempty"`
+    // The minimum itself isn't allowed
+    ExclusiveMin bool `json:"exclusiveMin,omitempty"`
+    Values []string `json:"values,omitempty"`
+    Default interface{} `json:"default,omitempty"`
+    Description string `json:"description"`
+}
+
+type filterSchema struct {
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Params []paramSchema `json:"params"`
+}
+
+// What's wrong with a pipeline step, for the structured error of /new. Param is empty when it's
+// the step itself.
+type paramError struct {
+    Step int `json:"step"`
+    Filter string `json:"filter"`
+    Param string `json:"param,omitempty"`
+    Message string `json:"message"`
+}
+
+func (myError paramError) Error() string {
+    if len(myError.Param) == 0 {
+        return fmt.Sprintf("step %d (%s): %s", myError.Step, myError.Filter, myError.Message)
+    }
+    return fmt.Sprintf("step %d (%s): parameter %q: %s", myError.Step, myError.Filter, myError.Param, myError.Message)
+}
+
+func bound(value float64) *float64 {
+    return &value
+}
+
+// Parameters several filters share
+var (
+    edgeSchema = paramSchema{Name: "edge", Type: "text", Values: []string{"clamp", "wrap", "mirror"}, Default: "clamp", Description: "how pixels outside the image are read"}
+    interpolationSchema = paramSchema{Name: "interpolation", Type: "text", Values: []string{"nearest", "bilinear", "bicubic", "lanczos"}, Default: "bilinear", Description: "how pixels are resampled"}
+    channelsSchema = paramSchema{Name: "channels", Type: "text", Default: "rgb", Description: "which of r, g and b change"}
+    radiusSchema = paramSchema{Name: "radius", Type: "integer", Min: bound(0), Max: bound(100), Description: "pixels around every pixel the kernel reaches"}
+    sigmaSchema = paramSchema{Name: "sigma", Type: "number", Min: bound(0), ExclusiveMin: true, Description: "standard deviation of the Gaussian, a third of the radius by default"}
+    hueShiftSchema = paramSchema{Name: "hue", Type: "number", Default: 0, Description: "degrees to turn the hue"}
+    saturationSchema = paramSchema{Name: "saturation", Type: "number", Min: bound(0), Max: bound(10), Default: 1, Description: "factor for the saturation"}
+    lightnessSchema = paramSchema{Name: "lightness", Type: "number", Min: bound(0), Max: bound(10), Default: 1, Description: "factor for the lightness"}
+    pixelKeyValues = []string{"brightness", "hue", "saturation"}
+)
+
+// Shorthands for a parameter with a default or a range
+func withDefault(schema paramSchema, fallback interface{}) paramSchema {
+    schema.Default = fallback
+    return schema
+}
+
+func numberSchema(name string, min float64, max float64, fallback interface{}, description string) paramSchema {
+    return paramSchema{Name: name, Type: "number", Min: bound(min), Max: bound(max), Default: fallback, Description: description}
+}
+
+var filterSchemas = map[string]filterSchema{}
+
+func init() {
+    for _, schema := range []filterSchema{
+        {"swapRedGreen", "Swap the red and green channels", nil},
+        {"channelShift", "Chromatic aberration: red moves one way, blue the other", []paramSchema{
+            {Name: "offset", Type: "number", Default: 10, Description: "pixels the channels move"},
+            {Name: "angle", Type: "number", Default: 0, Description: "direction in degrees clockwise from pointing right"},
+        }},
+
+        {"boxBlur", "Average every pixel with its neighbourhood", []paramSchema{withDefault(radiusSchema, 1), edgeSchema}},
+        {"gaussianBlur", "Gaussian blur", []paramSchema{withDefault(radiusSchema, 2), sigmaSchema, edgeSchema}},
+        {"unsharpMask", "Sharpen by adding back the difference to a Gaussian blur", []paramSchema{
+            withDefault(radiusSchema, 2), sigmaSchema, edgeSchema,
+            {Name: "amount", Type: "number", Default: 1, Description: "how much of the difference is added"},
+            numberSchema("threshold", 0, 1, 0, "differences smaller than this are left alone"),
+        }},
+        {"sharpen", "A 3x3 sharpening kernel", []paramSchema{
+            {Name: "amount", Type: "number", Default: 1, Description: "strength"},
+            edgeSchema,
+        }},
+        {"sobel", "Sobel edge detection", []paramSchema{
+            {Name: "grayscale", Type: "boolean", Default: true, Description: "merge the channels into one brightness"},
+            edgeSchema,
+        }},
+        {"laplacian", "Laplacian edge detection", []paramSchema{
+            {Name: "diagonals", Type: "boolean", Default: false, Description: "take the diagonal neighbours into account"},
+            {Name: "grayscale", Type: "boolean", Default: true, Description: "merge the channels into one brightness"},
+            edgeSchema,
+        }},
+        {"emboss", "Emboss lit from the top left", []paramSchema{
+            {Name: "strength", Type: "number", Default: 1, Description: "scale of the relief"},
+            edgeSchema,
+        }},
+        {"convolve", "Convolve with your own kernel", []paramSchema{
+            {Name: "kernel", Type: "numbers", Required: true, Description: "the weights, row by row"},
+            {Name: "width", Type: "integer", Min: bound(1), Max: bound(201), Description: "weights per row, a square kernel by default"},
+            {Name: "divisor", Type: "number", Description: "the weights are divided by it, their sum (or 1) by default"},
+            numberSchema("bias", -1, 1, 0, "added afterwards"),
+            edgeSchema,
+        }},
+
+        {"resize", "Scale to a new size", []paramSchema{
+            {Name: "width", Type: "integer", Min: bound(0), Max: bound(16384), Default: 0, Description: "pixels, 0 keeps the aspect ratio"},
+            {Name: "height", Type: "integer", Min: bound(0), Max: bound(16384), Default: 0, Description: "pixels, 0 keeps the aspect ratio"},
+            interpolationSchema,
+        }},
+        {"rotate", "Rotate by any angle", []paramSchema{
+            {Name: "angle", Type: "number", Default: 0, Description: "degrees clockwise"},
+            {Name: "background", Type: "color", Default: "#00000000", Description: "fills the uncovered corners"},
+            {Name: "expand", Type: "boolean", Default: true, Description: "grow the canvas to fit the rotated image"},
+            interpolationSchema,
+        }},
+        {"flip", "Mirror the image", []paramSchema{
+            {Name: "direction", Type: "text", Values: []string{"horizontal", "vertical", "both"}, Default: "horizontal", Description: "horizontal mirrors left to right"},
+        }},
+        {"crop", "Cut out a rectangle", []paramSchema{
+            {Name: "x", Type: "integer", Default: 0, Description: "left edge, from the left of the image"},
+            {Name: "y", Type: "integer", Default: 0, Description: "top edge, from the top of the image"},
+            {Name: "width", Type: "integer", Min: bound(0), ExclusiveMin: true, Description: "pixels, up to the right edge by default"},
+            {Name: "height", Type: "integer", Min: bound(0), ExclusiveMin: true, Description: "pixels, down to the bottom by default"},
+        }},
+
+        {"pixelSort", "Sort runs of pixels along lines", []paramSchema{
+            {Name: "direction", Type: "text", Values: []string{"rows", "columns", "angle"}, Default: "rows", Description: "which lines to sort along"},
+            {Name: "angle", Type: "number", Default: 0, Description: "degrees clockwise, for direction=angle"},
+            {Name: "sortBy", Type: "text", Values: pixelKeyValues, Default: "brightness", Description: "what pixels are ordered by"},
+            {Name: "thresholdBy", Type: "text", Values: pixelKeyValues, Description: "what decides the runs, sortBy by default"},
+            numberSchema("lower", 0, 1, 0.25, "runs are pixels with a value above this"),
+            numberSchema("upper", 0, 1, 0.8, "and below this"),
+            {Name: "reverse", Type: "boolean", Default: false, Description: "sort the other way"},
+            numberSchema("randomness", 0, 1, 0, "chance of cutting a run short at any pixel"),
+            {Name: "seed", Type: "integer", Default: 0, Description: "makes the randomness reproducible"},
+        }},
+        {"quantize", "Reduce the image to a palette", []paramSchema{
+            {Name: "palette", Type: "text", Values: []string{"medianCut", "kMeans", "gameBoy", "cga", "webSafe"}, Default: "medianCut", Description: "built from the image or a fixed one"},
+            {Name: "colors", Type: "integer", Min: bound(2), Max: bound(256), Default: 16, Description: "palette size for medianCut and kMeans"},
+            {Name: "dither", Type: "text", Values: []string{"none", "bayer", "floydSteinberg", "atkinson"}, Default: "floydSteinberg", Description: "how colours in between are faked"},
+            {Name: "bayerSize", Type: "integer", Values: []string{"2", "4", "8"}, Default: 4, Description: "size of the Bayer matrix"},
+        }},
+
+        {"blend", "Blend another uploaded image into this one", []paramSchema{
+            {Name: "with", Type: "input", Required: true, Description: "the uploaded image to blend in"},
+            {Name: "mode", Type: "text", Values: []string{"multiply", "screen", "overlay", "difference"}, Default: "multiply", Description: "blend mode"},
+            numberSchema("amount", 0, 1, 1, "how much of the blend shows"),
+        }},
+        {"displace", "Move pixels by the red and green of another uploaded image", []paramSchema{
+            {Name: "map", Type: "input", Required: true, Description: "the uploaded displacement map"},
+            numberSchema("scale", -16384, 16384, 20, "pixels full red or green moves a pixel"),
+        }},
+
+        {"overlay", "Draw a caption and a logo", []paramSchema{
+            {Name: "text", Type: "text", Description: "lines split by \\n"},
+            {Name: "size", Type: "integer", Min: bound(1), Max: bound(64), Default: 2, Description: "image pixels per font pixel"},
+            {Name: "color", Type: "color", Default: "#ffffff", Description: "of the text"},
+            {Name: "outline", Type: "color", Description: "colour of an outline around the text"},
+            {Name: "outlineWidth", Type: "integer", Min: bound(0), Max: bound(64), Description: "pixels, size by default"},
+            numberSchema("opacity", 0, 1, 1, "of the text"),
+            numberSchema("logoOpacity", 0, 1, nil, "of the logo, opacity by default"),
+            {Name: "position", Type: "text", Values: []string{"topLeft", "top", "topRight", "left", "center", "right", "bottomLeft", "bottom", "bottomRight"}, Default: "bottomRight", Description: "where the block goes"},
+            {Name: "margin", Type: "integer", Default: 8, Description: "pixels from the edges"},
+            {Name: "x", Type: "integer", Description: "left edge of the block, instead of position"},
+            {Name: "y", Type: "integer", Description: "top edge of the block, instead of position"},
+            {Name: "logo", Type: "image", Description: "base64 or a data: URL, drawn above the text"},
+            {Name: "logoScale", Type: "number", Min: bound(0), ExclusiveMin: true, Max: bound(16), Default: 1, Description: "scale of the logo"},
+        }},
+
+        {"brightnessContrast", "Brightness and contrast", []paramSchema{
+            numberSchema("brightness", -1, 1, 0, "added to every channel"),
+            numberSchema("contrast", 0, 10, 1, "stretch away from middle grey"),
+        }},
+        {"gamma", "Gamma correction", []paramSchema{
+            numberSchema("gamma", 0.01, 10, 1, "above 1 brightens the midtones"),
+            channelsSchema,
+        }},
+        {"levels", "Input and output levels", []paramSchema{
+            numberSchema("inBlack", 0, 1, 0, "becomes black"),
+            numberSchema("inWhite", 0, 1, 1, "becomes white"),
+            numberSchema("gamma", 0.01, 10, 1, "of the midtones"),
+            numberSchema("outBlack", 0, 1, 0, "darkest output"),
+            numberSchema("outWhite", 0, 1, 1, "brightest output"),
+            channelsSchema,
+        }},
+        {"curves", "Tone curves through control points", []paramSchema{
+            {Name: "points", Type: "numbers", Min: bound(0), Max: bound(1), Description: "x0,y0,x1,y1,... for every channel"},
+            {Name: "red", Type: "numbers", Min: bound(0), Max: bound(1), Description: "points for red only"},
+            {Name: "green", Type: "numbers", Min: bound(0), Max: bound(1), Description: "points for green only"},
+            {Name: "blue", Type: "numbers", Min: bound(0), Max: bound(1), Description: "points for blue only"},
+        }},
+        {"equalize", "Histogram equalization", []paramSchema{
+            {Name: "mode", Type: "text", Values: []string{"luma", "rgb"}, Default: "luma", Description: "brightness only or every channel"},
+        }},
+        {"clahe", "Contrast limited adaptive histogram equalization", []paramSchema{
+            {Name: "tiles", Type: "integer", Min: bound(2), Max: bound(64), Default: 8, Description: "regions across and down"},
+            numberSchema("clipLimit", 1, 100, 2, "how much any one tone can be stretched"),
+        }},
+
+        {"hueRotate", "Turn every hue around the colour wheel", []paramSchema{
+            {Name: "angle", Type: "number", Default: 180, Description: "degrees"},
+        }},
+        {"hueSaturation", "Hue, saturation and lightness", []paramSchema{
+            hueShiftSchema, saturationSchema, lightnessSchema,
+            {Name: "space", Type: "text", Values: []string{"hsl", "hsv"}, Default: "hsl", Description: "which lightness"},
+        }},
+        {"channelMap", "Rearrange the channels", []paramSchema{
+            {Name: "order", Type: "text", Required: true, Description: "three or four of r, g, b and a, e.g. bgr"},
+        }},
+        {"colorMatrix", "Mix the channels with a matrix", []paramSchema{
+            {Name: "matrix", Type: "numbers", Required: true, Description: "9 (3x3) or 20 (4x5) numbers, row by row"},
+        }},
+        {"selectiveColor", "Change only the hues in a range", []paramSchema{
+            {Name: "hueFrom", Type: "number", Default: 330, Description: "start of the range in degrees"},
+            {Name: "hueTo", Type: "number", Default: 30, Description: "end of the range in degrees"},
+            numberSchema("feather", 0, 180, 15, "degrees over which the change fades out"),
+            hueShiftSchema, saturationSchema, lightnessSchema,
+        }},
+        {"sepia", "Brown tint of old photographs", []paramSchema{
+            numberSchema("amount", 0, 1, 1, "how much of it"),
+        }},
+        {"duotone", "Two colours by brightness", []paramSchema{
+            {Name: "shadows", Type: "color", Default: "#1d1452", Description: "for the darkest parts"},
+            {Name: "highlights", Type: "color", Default: "#ffd27f", Description: "for the brightest parts"},
+        }},
+        {"gradientMap", "Recolour along a gradient by brightness", []paramSchema{
+            {Name: "colors", Type: "colors", Required: true, Description: "2 to 256 colours, darkest first"},
+        }},
+
+        {"expression", "Run your own program on every pixel", []paramSchema{
+            {Name: "expression", Type: "expression", Required: true, Description: "assignments to r, g, b and a, e.g. r = g; g = r; b = (x ^ y) & 255"},
+            {Name: "t", Type: "number", Default: 0, Description: "readable as t in the expression, to animate it"},
+        }},
+    } {
+        filterSchemas[schema.Name] = schema
+    }
+}
+
+// All filters of schemas, by name.
+func sortedFilterSchemas(schemas map[string]filterSchema) []filterSchema {
+    sorted := []filterSchema{}
+    for _, schema := range schemas {
+        sorted = append(sorted, schema)
+    }
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i].Name < sorted[j].Name
+    })
+    return sorted
+}
+
+// Check one pipeline step against the schema of its filter: the filter exists, every parameter
+// is one it has, of the right type and in range, and the required ones are there. inputs are the
+// names of the images uploaded with the task, schemas the filters to check against.
+func checkStepParams(schemas map[string]filterSchema, step int, filter string, params map[string]interface{}, inputs []string) []paramError {
+    if len(filter) == 0 {
+        filter = defaultFilter
+    }
+    schema, ok := schemas[filter]
+    if !ok {
+        return []paramError{{Step: step, Filter: filter, Message: "unknown filter"}}
+    }
+
+    myErrors := []paramError{}
+    known := map[string]bool{}
+    for _, param := range schema.Params {
+        known[param.Name] = true
+        value, given := params[param.Name]
+        if !given || value == nil {
+            if param.Required {
+                myErrors = append(myErrors, paramError{step, filter, param.Name, "is required"})
+            }
+            continue
+        }
+        if message := checkParamValue(param, value, inputs); len(message) > 0 {
+            myErrors = append(myErrors, paramError{step, filter, param.Name, message})
+        }
+    }
+    for name := range params {
+        if !known[name] {
+            myErrors = append(myErrors, paramError{step, filter, name, "unknown parameter"})
+        }
+    }
+    sort.Slice(myErrors, func(i, j int) bool {
+        return myErrors[i].Param < myErrors[j].Param
+    })
+    return myErrors
+}
+
+// What's wrong with a value, empty when nothing is. Values come as strings from a query string and
+// as JSON values from a pipeline.
+func checkParamValue(param paramSchema, value interface{}, inputs []string) string {
+    text := fmt.Sprint(value)
+    if number, ok := value.(float64); ok {
+        text = strconv.FormatFloat(number, 'f', -1, 64)
+    }
+
+    switch param.Type {
+    case "number", "integer":
+        number, ok := paramNumber(value)
+        if !ok {
+            return fmt.Sprintf("%q is not a number", text)
+        }
+        if param.Type == "integer" && number != math.Trunc(number) {
+            return fmt.Sprintf("%v is not a whole number", number)
+        }
+        if message := checkParamRange(param, number); len(message) > 0 {
+            return message
+        }
+    case "boolean":
+        if _, ok := value.(bool); !ok {
+            if _, err := strconv.ParseBool(text); err != nil {
+                return fmt.Sprintf("%q is not a boolean", text)
+            }
+        }
+    case "color":
+        if !paramColor(text) {
+            return fmt.Sprintf("%q is not a #rrggbb or #rrggbbaa colour", text)
+        }
+    case "numbers", "colors":
+        items, ok := paramList(value)
+        if !ok {
+            return "expected a list"
+        }
+        for _, item := range items {
+            if param.Type == "colors" {
+                if !paramColor(fmt.Sprint(item)) {
+                    return fmt.Sprintf("%q is not a #rrggbb or #rrggbbaa colour", fmt.Sprint(item))
+                }
+                continue
+            }
+            number, ok := paramNumber(item)
+            if !ok {
+                return fmt.Sprintf("%q is not a number", fmt.Sprint(item))
+            }
+            if message := checkParamRange(param, number); len(message) > 0 {
+                return message
+            }
+        }
+    case "expression":
+        if _, err := compileExpression(text); err != nil {
+            return err.Error()
+        }
+    case "input":
+        for _, name := range inputs {
+            if name == text {
+                return ""
+            }
+        }
+        return fmt.Sprintf("no image named %q was uploaded with the task", text)
+    }
+
+    if len(param.Values) > 0 {
+        for _, allowed := range param.Values {
+            if text == allowed {
+                return ""
+            }
+        }
+        return "must be " + strings.Join(param.Values[:len(param.Values) - 1], ", ") + " or " + param.Values[len(param.Values) - 1]
+    }
+    return ""
+}
+
+func checkParamRange(param paramSchema, number float64) string {
+    below := param.Min != nil && (number < *param.Min || (param.ExclusiveMin && number == *param.Min))
+    above := param.Max != nil && number > *param.Max
+    switch {
+    case !below && !above:
+        return ""
+    case param.Min != nil && param.Max != nil && param.ExclusiveMin:
+        return fmt.Sprintf("must be more than %v and at most %v", *param.Min, *param.Max)
+    case param.Min != nil && param.Max != nil:
+        return fmt.Sprintf("must be between %v and %v", *param.Min, *param.Max)
+    case param.Min != nil && param.ExclusiveMin:
+        return fmt.Sprintf("must be more than %v", *param.Min)
+    case param.Min != nil:
+        return fmt.Sprintf("must be at least %v", *param.Min)
+    }
+    return fmt.Sprintf("must be at most %v", *param.Max)
+}
+
+func paramNumber(value interface{}) (float64, bool) {
+    switch typed := value.(type) {
+    case float64:
+        return typed, true
+    case string:
+        number, err := strconv.ParseFloat(typed, 64)
+        return number, err == nil && !math.IsNaN(number) && !math.IsInf(number, 0)
+    }
+    return 0, false
+}
+
+func paramColor(text string) bool {
+    hex := strings.TrimPrefix(text, "#")
+    _, err := strconv.ParseUint(hex, 16, 32)
+    return err == nil && (len(hex) == 3 || len(hex) == 6 || len(hex) == 8)
+}
+
+// A JSON array, or a string separated by commas, semicolons or spaces.
+func paramList(value interface{}) ([]interface{}, bool) {
+    switch typed := value.(type) {
+    case []interface{}:
+        return typed, true
+    case string:
+        items := []interface{}{}
+        for _, field := range strings.FieldsFunc(typed, func(c rune) bool {
+            return c == ',' || c == ';' || unicode.IsSpace(c)
+        }) {
+            items = append(items, field)
+        }
+        return items, true
+    }
+    return nil, false
+}
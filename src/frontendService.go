@@ -9,7 +9,7 @@ import (
     "io"
 )
 
-const indexPage = "<html><head><title>incoherent_imgs</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
+const indexPage = "<html><head><title>incoherent_imgs</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <input type=\"text\" name=\"filter\" placeholder=\"swapRedGreen\" /> <select name=\"output\"><option value=\"png\">PNG</option><option value=\"jpeg\">JPEG</option><option value=\"gif\">GIF</option><option value=\"text\">Text</option><option value=\"html\">HTML text</option></select> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
 
 var kVStoreAddress string
 var masterLocation string
@@ -44,6 +44,7 @@ func main() {
     http.HandleFunc("/submitTask", handleTask)
     http.HandleFunc("/isReady", handleCheckForReadiness)
     http.HandleFunc("/getImage", serveImage)
+    http.HandleFunc("/getPreview", servePreview)
     http.ListenAndServe(":3004", nil)
 }
 
@@ -71,12 +72,18 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
         }
 
         fmt.Println("Yeah! Sending request")
-        response, err := http.Post("http://" + masterLocation + "/new", "image", file)
-        if err != nil || response.StatusCode != http.StatusOK {
+        response, err := http.Post("http://" + masterLocation + "/new?filter=" + url.QueryEscape(r.FormValue("filter")) + "&output=" + url.QueryEscape(r.FormValue("output")), "image", file)
+        if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, "Error getting response from master service:", err)
             return
         }
+        if response.StatusCode != http.StatusOK {
+            // e.g. the upload isn't an image the cluster can read, pass on the master's explanation
+            w.WriteHeader(response.StatusCode)
+            io.Copy(w, response.Body)
+            return
+        }
 
         fmt.Println("Yeah! Reading body")
         data, err := ioutil.ReadAll(response.Body)
@@ -127,6 +134,10 @@ func handleCheckForReadiness(w http.ResponseWriter, r *http.Request) {
             fmt.Fprint(w, "Your image is not ready yet.")
         case "1":
             fmt.Fprint(w, "Your image is ready.")
+        case "-1":
+            fmt.Fprint(w, "Your image could not be processed, see /getImage for why.")
+        case "-2":
+            fmt.Fprint(w, "Your image was rejected for being too large, see /getImage for the limits.")
         default :
             fmt.Fprint(w, "Internal server error.")
         }
@@ -151,18 +162,54 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
         }
 
         response, err := http.Get("http://" + masterLocation + "/get?id=" + values.Get("id") + "&state=finished")
-        if err != nil || response.StatusCode != http.StatusOK {
+        if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, "Error:", err)
             return
         }
 
+        w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+        w.WriteHeader(response.StatusCode)
         _, err = io.Copy(w, response.Body)
+        if err != nil {
+            fmt.Println("Error:", err)
+            return
+        }
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error: Only GET accepted")
+    }
+}
+
+// Serve the small renditions of a task, ?size=128|512 and ?of=original|result
+func servePreview(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodGet {
+        values, err := url.ParseQuery(r.URL.RawQuery)
+        if err != nil {
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(values.Get("id")) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input")
+            return
+        }
+
+        query := url.Values{"id": {values.Get("id")}, "size": {values.Get("size")}, "of": {values.Get("of")}}
+        response, err := http.Get("http://" + masterLocation + "/getPreview?" + query.Encode())
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, "Error:", err)
             return
         }
+
+        w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+        w.WriteHeader(response.StatusCode)
+        _, err = io.Copy(w, response.Body)
+        if err != nil {
+            fmt.Println("Error:", err)
+            return
+        }
     } else {
         w.WriteHeader(http.StatusBadRequest)
         fmt.Fprint(w, "Error: Only GET accepted")
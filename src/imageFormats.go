@@ -0,0 +1,706 @@
+package main
+
+// Shared between masterService (which checks uploads) and workerService (which decodes them), so
+// both know the same image formats. The standard library brings PNG, JPEG and GIF, BMP and TIFF
+// are decoded here.
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    _ "image/gif"
+    _ "image/jpeg"
+    _ "image/png"
+    "io"
+    "io/ioutil"
+)
+
+func init() {
+    image.RegisterFormat("bmp", "BM????\x00\x00\x00\x00", decodeBMP, decodeBMPConfig)
+    image.RegisterFormat("tiff", "II*\x00", decodeTIFF, decodeTIFFConfig)
+    image.RegisterFormat("tiff", "MM\x00*", decodeTIFF, decodeTIFFConfig)
+}
+
+var errUnsupportedImage = errors.New("unsupported image")
+
+// ---- BMP ----
+
+type bmpHeader struct {
+    Width int
+    Height int
+    TopDown bool
+    BitsPerPixel int
+    Compression uint32
+    PixelOffset int
+    Masks [4]uint32
+    Palette color.Palette
+}
+
+func readBMPHeader(data []byte) (bmpHeader, error) {
+    header := bmpHeader{}
+    if len(data) < 26 || data[0] != 'B' || data[1] != 'M' {
+        return header, fmt.Errorf("bmp: %v", errUnsupportedImage)
+    }
+    header.PixelOffset = int(binary.LittleEndian.Uint32(data[10:14]))
+    infoSize := int(binary.LittleEndian.Uint32(data[14:18]))
+    if len(data) < 14 + infoSize {
+        return header, fmt.Errorf("bmp: header is truncated")
+    }
+    info := data[14:14 + infoSize]
+
+    paletteEntrySize := 4
+    colorsUsed := 0
+    switch {
+    case infoSize == 12:
+        header.Width = int(binary.LittleEndian.Uint16(info[4:6]))
+        header.Height = int(binary.LittleEndian.Uint16(info[6:8]))
+        header.BitsPerPixel = int(binary.LittleEndian.Uint16(info[10:12]))
+        paletteEntrySize = 3
+    case infoSize >= 40:
+        header.Width = int(int32(binary.LittleEndian.Uint32(info[4:8])))
+        header.Height = int(int32(binary.LittleEndian.Uint32(info[8:12])))
+        header.BitsPerPixel = int(binary.LittleEndian.Uint16(info[14:16]))
+        header.Compression = binary.LittleEndian.Uint32(info[16:20])
+        colorsUsed = int(binary.LittleEndian.Uint32(info[32:36]))
+    default:
+        return header, fmt.Errorf("bmp: unknown header size %d", infoSize)
+    }
+    if header.Height < 0 {
+        header.Height = -header.Height
+        header.TopDown = true
+    }
+    if header.Width <= 0 || header.Height <= 0 {
+        return header, fmt.Errorf("bmp: bad dimensions %dx%d", header.Width, header.Height)
+    }
+
+    // BI_RGB (0) and BI_BITFIELDS (3, 6 with alpha) only, no run length encoding
+    paletteStart := 14 + infoSize
+    switch header.Compression {
+    case 0:
+        switch header.BitsPerPixel {
+        case 16:
+            header.Masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+        case 24, 32:
+            header.Masks = [4]uint32{0xff0000, 0x00ff00, 0x0000ff, 0}
+        }
+    case 3, 6:
+        if header.BitsPerPixel != 16 && header.BitsPerPixel != 32 {
+            return header, fmt.Errorf("bmp: bitfields with %d bits per pixel", header.BitsPerPixel)
+        }
+        masks := info[40:]
+        if infoSize == 40 {
+            // The masks follow a plain info header
+            count := 3
+            if header.Compression == 6 {
+                count = 4
+            }
+            if len(data) < paletteStart + 4 * count {
+                return header, fmt.Errorf("bmp: header is truncated")
+            }
+            masks = data[paletteStart:paletteStart + 4 * count]
+            paletteStart += 4 * count
+        }
+        for i := 0; i < 4 && 4 * i + 4 <= len(masks); i++ {
+            header.Masks[i] = binary.LittleEndian.Uint32(masks[4 * i:])
+        }
+    default:
+        return header, fmt.Errorf("bmp: compression %d is not supported", header.Compression)
+    }
+
+    switch header.BitsPerPixel {
+    case 1, 2, 4, 8:
+        if colorsUsed == 0 || colorsUsed > 1 << uint(header.BitsPerPixel) {
+            colorsUsed = 1 << uint(header.BitsPerPixel)
+        }
+        if len(data) < paletteStart + paletteEntrySize * colorsUsed {
+            return header, fmt.Errorf("bmp: palette is truncated")
+        }
+        header.Palette = make(color.Palette, colorsUsed)
+        for i := range header.Palette {
+            entry := data[paletteStart + paletteEntrySize * i:]
+            header.Palette[i] = color.RGBA{entry[2], entry[1], entry[0], 0xff}
+        }
+    case 16, 24, 32:
+    default:
+        return header, fmt.Errorf("bmp: %d bits per pixel is not supported", header.BitsPerPixel)
+    }
+
+    return header, nil
+}
+
+func decodeBMPConfig(reader io.Reader) (image.Config, error) {
+    data, err := ioutil.ReadAll(io.LimitReader(reader, 1 << 16))
+    if err != nil {
+        return image.Config{}, err
+    }
+    header, err := readBMPHeader(data)
+    if err != nil {
+        return image.Config{}, err
+    }
+    var model color.Model = color.NRGBAModel
+    if header.Palette != nil {
+        model = header.Palette
+    }
+    return image.Config{ColorModel: model, Width: header.Width, Height: header.Height}, nil
+}
+
+func decodeBMP(reader io.Reader) (image.Image, error) {
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        return nil, err
+    }
+    header, err := readBMPHeader(data)
+    if err != nil {
+        return nil, err
+    }
+
+    // Divided rather than multiplied, a huge width times a huge height can overflow into a size
+    // that looks fine
+    stride := (header.Width * header.BitsPerPixel + 31) / 32 * 4
+    if header.PixelOffset > len(data) || header.Height > (len(data) - header.PixelOffset) / stride {
+        return nil, fmt.Errorf("bmp: pixel data is truncated")
+    }
+    row := func(y int) []byte {
+        if !header.TopDown {
+            y = header.Height - 1 - y
+        }
+        return data[header.PixelOffset + y * stride:header.PixelOffset + (y + 1) * stride]
+    }
+
+    if header.Palette != nil {
+        myImage := image.NewPaletted(image.Rect(0, 0, header.Width, header.Height), header.Palette)
+        bits := header.BitsPerPixel
+        for y := 0; y < header.Height; y++ {
+            pixels := row(y)
+            for x := 0; x < header.Width; x++ {
+                bit := x * bits
+                index := pixels[bit / 8] >> uint(8 - bits - bit % 8) & byte(1 << uint(bits) - 1)
+                if int(index) >= len(header.Palette) {
+                    index = 0
+                }
+                myImage.Pix[y * myImage.Stride + x] = index
+            }
+        }
+        return myImage, nil
+    }
+
+    myImage := image.NewNRGBA(image.Rect(0, 0, header.Width, header.Height))
+    bytesPerPixel := header.BitsPerPixel / 8
+    sawAlpha := false
+    for y := 0; y < header.Height; y++ {
+        pixels := row(y)
+        for x := 0; x < header.Width; x++ {
+            var value uint32
+            for i := bytesPerPixel - 1; i >= 0; i-- {
+                value = value << 8 | uint32(pixels[x * bytesPerPixel + i])
+            }
+            offset := y * myImage.Stride + 4 * x
+            myImage.Pix[offset] = bmpChannel(value, header.Masks[0])
+            myImage.Pix[offset + 1] = bmpChannel(value, header.Masks[1])
+            myImage.Pix[offset + 2] = bmpChannel(value, header.Masks[2])
+            myImage.Pix[offset + 3] = 0xff
+            if header.Masks[3] != 0 {
+                myImage.Pix[offset + 3] = bmpChannel(value, header.Masks[3])
+                sawAlpha = sawAlpha || myImage.Pix[offset + 3] != 0
+            }
+        }
+    }
+
+    // Plenty of writers declare an alpha mask and then leave it all zero, those images are opaque
+    if header.Masks[3] != 0 && !sawAlpha {
+        for i := 3; i < len(myImage.Pix); i += 4 {
+            myImage.Pix[i] = 0xff
+        }
+    }
+
+    return myImage, nil
+}
+
+// Pull the bits under mask out of value and scale them to 8 bits.
+func bmpChannel(value uint32, mask uint32) uint8 {
+    if mask == 0 {
+        return 0
+    }
+    shift := uint(0)
+    for mask & 1 == 0 {
+        mask >>= 1
+        shift++
+    }
+    channel := value >> shift & mask
+    return uint8(uint64(channel) * 255 / uint64(mask))
+}
+
+// ---- TIFF ----
+
+const (
+    tiffImageWidth = 256
+    tiffImageLength = 257
+    tiffBitsPerSample = 258
+    tiffCompression = 259
+    tiffPhotometric = 262
+    tiffStripOffsets = 273
+    tiffSamplesPerPixel = 277
+    tiffRowsPerStrip = 278
+    tiffStripByteCounts = 279
+    tiffPlanarConfiguration = 284
+    tiffPredictor = 317
+    tiffColorMap = 320
+    tiffTileWidth = 322
+    tiffTileLength = 323
+    tiffTileOffsets = 324
+    tiffTileByteCounts = 325
+    tiffExtraSamples = 338
+)
+
+// No compression we read makes more than this many bytes of one byte: an LZW code of at least 9
+// bits stands for at most 4096 bytes, Deflate and PackBits for far fewer. An image or a strip that
+// would need more than the file can hold this way is broken, and is turned away before its pixels
+// are allocated.
+const tiffMaxExpansion = 4096
+
+// Baseline TIFF: the first image of the file, chunky (interleaved) samples in strips or tiles,
+// uncompressed, PackBits, LZW or Deflate.
+type tiffDecoder struct {
+    data []byte
+    order binary.ByteOrder
+    tags map[uint16][]uint32
+}
+
+func newTIFFDecoder(data []byte) (*tiffDecoder, error) {
+    if len(data) < 8 {
+        return nil, fmt.Errorf("tiff: %v", errUnsupportedImage)
+    }
+    myDecoder := &tiffDecoder{data: data, tags: map[uint16][]uint32{}}
+    switch string(data[0:4]) {
+    case "II*\x00":
+        myDecoder.order = binary.LittleEndian
+    case "MM\x00*":
+        myDecoder.order = binary.BigEndian
+    default:
+        return nil, fmt.Errorf("tiff: %v", errUnsupportedImage)
+    }
+
+    ifd := int(myDecoder.order.Uint32(data[4:8]))
+    if ifd < 8 || ifd + 2 > len(data) {
+        return nil, fmt.Errorf("tiff: bad directory offset")
+    }
+    entries := int(myDecoder.order.Uint16(data[ifd:]))
+    if ifd + 2 + 12 * entries > len(data) {
+        return nil, fmt.Errorf("tiff: directory is truncated")
+    }
+
+    for i := 0; i < entries; i++ {
+        entry := data[ifd + 2 + 12 * i:]
+        tag := myDecoder.order.Uint16(entry[0:2])
+        fieldType := myDecoder.order.Uint16(entry[2:4])
+        count := int(myDecoder.order.Uint32(entry[4:8]))
+
+        size := 0
+        switch fieldType {
+        case 1, 7: // BYTE, UNDEFINED
+            size = 1
+        case 3: // SHORT
+            size = 2
+        case 4: // LONG
+            size = 4
+        default:
+            continue
+        }
+        if count < 0 || count > len(data) {
+            return nil, fmt.Errorf("tiff: bad count for tag %d", tag)
+        }
+        values := entry[8:12]
+        if size * count > 4 {
+            offset := int(myDecoder.order.Uint32(entry[8:12]))
+            if offset < 0 || offset + size * count > len(data) {
+                return nil, fmt.Errorf("tiff: tag %d points outside the file", tag)
+            }
+            values = data[offset:offset + size * count]
+        }
+
+        parsed := make([]uint32, count)
+        for j := range parsed {
+            switch size {
+            case 1:
+                parsed[j] = uint32(values[j])
+            case 2:
+                parsed[j] = uint32(myDecoder.order.Uint16(values[2 * j:]))
+            case 4:
+                parsed[j] = myDecoder.order.Uint32(values[4 * j:])
+            }
+        }
+        myDecoder.tags[tag] = parsed
+    }
+
+    return myDecoder, nil
+}
+
+func (myDecoder *tiffDecoder) tag(tag uint16, fallback uint32) uint32 {
+    values := myDecoder.tags[tag]
+    if len(values) == 0 {
+        return fallback
+    }
+    return values[0]
+}
+
+type tiffLayout struct {
+    Width int
+    Height int
+    BitsPerSample int
+    SamplesPerPixel int
+    Photometric uint32
+    // Associated (premultiplied) alpha, unassociated alpha or no alpha at all
+    Alpha uint32
+}
+
+func (myDecoder *tiffDecoder) layout() (tiffLayout, error) {
+    myLayout := tiffLayout{
+        Width: int(myDecoder.tag(tiffImageWidth, 0)),
+        Height: int(myDecoder.tag(tiffImageLength, 0)),
+        BitsPerSample: int(myDecoder.tag(tiffBitsPerSample, 1)),
+        SamplesPerPixel: int(myDecoder.tag(tiffSamplesPerPixel, 1)),
+        Photometric: myDecoder.tag(tiffPhotometric, 1),
+        Alpha: myDecoder.tag(tiffExtraSamples, 0),
+    }
+    if myLayout.Width <= 0 || myLayout.Height <= 0 {
+        return myLayout, fmt.Errorf("tiff: bad dimensions %dx%d", myLayout.Width, myLayout.Height)
+    }
+    if myDecoder.tag(tiffPlanarConfiguration, 1) != 1 && myLayout.SamplesPerPixel > 1 {
+        return myLayout, fmt.Errorf("tiff: planar images are not supported")
+    }
+
+    colorSamples := 1
+    switch myLayout.Photometric {
+    case 0, 1: // WhiteIsZero, BlackIsZero
+        if myLayout.BitsPerSample != 1 && myLayout.BitsPerSample != 2 && myLayout.BitsPerSample != 4 && myLayout.BitsPerSample != 8 && myLayout.BitsPerSample != 16 {
+            return myLayout, fmt.Errorf("tiff: %d bit grayscale is not supported", myLayout.BitsPerSample)
+        }
+    case 2: // RGB
+        colorSamples = 3
+        if myLayout.BitsPerSample != 8 && myLayout.BitsPerSample != 16 {
+            return myLayout, fmt.Errorf("tiff: %d bit RGB is not supported", myLayout.BitsPerSample)
+        }
+    case 3: // Palette
+        if (myLayout.BitsPerSample != 1 && myLayout.BitsPerSample != 2 && myLayout.BitsPerSample != 4 && myLayout.BitsPerSample != 8) || len(myDecoder.tags[tiffColorMap]) < 3 << uint(myLayout.BitsPerSample) {
+            return myLayout, fmt.Errorf("tiff: bad palette")
+        }
+    default:
+        return myLayout, fmt.Errorf("tiff: photometric interpretation %d is not supported", myLayout.Photometric)
+    }
+    if myLayout.SamplesPerPixel < colorSamples {
+        return myLayout, fmt.Errorf("tiff: %d samples per pixel is too few", myLayout.SamplesPerPixel)
+    }
+    if myLayout.SamplesPerPixel == colorSamples {
+        myLayout.Alpha = 0
+    }
+
+    return myLayout, nil
+}
+
+func decodeTIFFConfig(reader io.Reader) (image.Config, error) {
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        return image.Config{}, err
+    }
+    myDecoder, err := newTIFFDecoder(data)
+    if err != nil {
+        return image.Config{}, err
+    }
+    myLayout, err := myDecoder.layout()
+    if err != nil {
+        return image.Config{}, err
+    }
+    // Only the colour model is wanted, the image for it can be a single pixel. One the size in the
+    // header would be allocated before anybody checked the size against the limits.
+    onePixel := myLayout
+    onePixel.Width, onePixel.Height = 1, 1
+    return image.Config{ColorModel: myDecoder.newImage(onePixel).ColorModel(), Width: myLayout.Width, Height: myLayout.Height}, nil
+}
+
+func (myDecoder *tiffDecoder) newImage(myLayout tiffLayout) image.Image {
+    rect := image.Rect(0, 0, myLayout.Width, myLayout.Height)
+    deep := myLayout.BitsPerSample == 16
+    switch {
+    case myLayout.Photometric == 3:
+        colorMap := myDecoder.tags[tiffColorMap]
+        entries := 1 << uint(myLayout.BitsPerSample)
+        palette := make(color.Palette, entries)
+        for i := range palette {
+            palette[i] = color.RGBA64{uint16(colorMap[i]), uint16(colorMap[entries + i]), uint16(colorMap[2 * entries + i]), 0xffff}
+        }
+        return image.NewPaletted(rect, palette)
+    case myLayout.Alpha == 1 && deep:
+        return image.NewRGBA64(rect)
+    case myLayout.Alpha == 1:
+        return image.NewRGBA(rect)
+    case myLayout.Alpha == 2 && deep:
+        return image.NewNRGBA64(rect)
+    case myLayout.Alpha == 2:
+        return image.NewNRGBA(rect)
+    case myLayout.Photometric == 2 && deep:
+        return image.NewRGBA64(rect)
+    case myLayout.Photometric == 2:
+        return image.NewRGBA(rect)
+    case deep:
+        return image.NewGray16(rect)
+    }
+    return image.NewGray(rect)
+}
+
+func decodeTIFF(reader io.Reader) (image.Image, error) {
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        return nil, err
+    }
+    myDecoder, err := newTIFFDecoder(data)
+    if err != nil {
+        return nil, err
+    }
+    myLayout, err := myDecoder.layout()
+    if err != nil {
+        return nil, err
+    }
+
+    bytesPerPixel := float64(myLayout.SamplesPerPixel * myLayout.BitsPerSample) / 8
+    if float64(myLayout.Width) * float64(myLayout.Height) * bytesPerPixel > float64(len(data)) * tiffMaxExpansion {
+        return nil, fmt.Errorf("tiff: %dx%d is more than the file can hold", myLayout.Width, myLayout.Height)
+    }
+
+    // Strips are just tiles as wide as the image
+    blockWidth, blockHeight := myLayout.Width, int(myDecoder.tag(tiffRowsPerStrip, uint32(myLayout.Height)))
+    offsets, counts := myDecoder.tags[tiffStripOffsets], myDecoder.tags[tiffStripByteCounts]
+    if _, tiled := myDecoder.tags[tiffTileWidth]; tiled {
+        blockWidth, blockHeight = int(myDecoder.tag(tiffTileWidth, 0)), int(myDecoder.tag(tiffTileLength, 0))
+        offsets, counts = myDecoder.tags[tiffTileOffsets], myDecoder.tags[tiffTileByteCounts]
+    }
+    if blockWidth <= 0 || blockHeight <= 0 {
+        return nil, fmt.Errorf("tiff: bad strip or tile size")
+    }
+    if blockHeight > myLayout.Height {
+        blockHeight = myLayout.Height
+    }
+    if float64(blockWidth) * float64(blockHeight) * bytesPerPixel > float64(len(data)) * tiffMaxExpansion {
+        return nil, fmt.Errorf("tiff: %dx%d tiles are more than the file can hold", blockWidth, blockHeight)
+    }
+    blocksAcross := (myLayout.Width + blockWidth - 1) / blockWidth
+    blocksDown := (myLayout.Height + blockHeight - 1) / blockHeight
+    if len(offsets) < blocksAcross * blocksDown || len(counts) < blocksAcross * blocksDown {
+        return nil, fmt.Errorf("tiff: missing strips or tiles")
+    }
+
+    myImage := myDecoder.newImage(myLayout)
+    rowBytes := (blockWidth * myLayout.SamplesPerPixel * myLayout.BitsPerSample + 7) / 8
+    for block := 0; block < blocksAcross * blocksDown; block++ {
+        start, end := int(offsets[block]), int(offsets[block]) + int(counts[block])
+        if start < 0 || end > len(data) || start > end {
+            return nil, fmt.Errorf("tiff: strip or tile %d points outside the file", block)
+        }
+        pixels, err := myDecoder.decompress(data[start:end], rowBytes * blockHeight)
+        if err != nil {
+            return nil, err
+        }
+        if myDecoder.tag(tiffPredictor, 1) == 2 {
+            myDecoder.undoPredictor(pixels, rowBytes, myLayout)
+        }
+
+        originX, originY := block % blocksAcross * blockWidth, block / blocksAcross * blockHeight
+        for y := 0; y < blockHeight && originY + y < myLayout.Height; y++ {
+            if (y + 1) * rowBytes > len(pixels) {
+                break
+            }
+            row := pixels[y * rowBytes:(y + 1) * rowBytes]
+            for x := 0; x < blockWidth && originX + x < myLayout.Width; x++ {
+                myDecoder.setPixel(myImage, originX + x, originY + y, row, x, myLayout)
+            }
+        }
+    }
+
+    return myImage, nil
+}
+
+func (myDecoder *tiffDecoder) decompress(compressed []byte, expected int) ([]byte, error) {
+    switch compression := myDecoder.tag(tiffCompression, 1); compression {
+    case 1:
+        return compressed, nil
+    case 5:
+        return tiffLZW(compressed, expected)
+    case 8, 32946:
+        reader, err := zlib.NewReader(bytes.NewReader(compressed))
+        if err != nil {
+            return nil, fmt.Errorf("tiff: %v", err)
+        }
+        return ioutil.ReadAll(io.LimitReader(reader, int64(expected)))
+    case 32773:
+        return tiffPackBits(compressed, expected), nil
+    default:
+        return nil, fmt.Errorf("tiff: compression %d is not supported", compression)
+    }
+}
+
+// Horizontal differencing: every sample was stored as the difference to the same sample of the previous pixel.
+func (myDecoder *tiffDecoder) undoPredictor(pixels []byte, rowBytes int, myLayout tiffLayout) {
+    samples := myLayout.SamplesPerPixel
+    for start := 0; start + rowBytes <= len(pixels); start += rowBytes {
+        row := pixels[start:start + rowBytes]
+        switch myLayout.BitsPerSample {
+        case 8:
+            for i := samples; i < len(row); i++ {
+                row[i] += row[i - samples]
+            }
+        case 16:
+            for i := 2 * samples; i + 1 < len(row); i += 2 {
+                value := myDecoder.order.Uint16(row[i:]) + myDecoder.order.Uint16(row[i - 2 * samples:])
+                myDecoder.order.PutUint16(row[i:], value)
+            }
+        }
+    }
+}
+
+// Sample number n of a row, scaled to 16 bits.
+func (myDecoder *tiffDecoder) sample(row []byte, n int, bits int) uint32 {
+    switch bits {
+    case 16:
+        return uint32(myDecoder.order.Uint16(row[2 * n:]))
+    case 8:
+        return uint32(row[n]) * 0x101
+    }
+    bit := n * bits
+    value := uint32(row[bit / 8] >> uint(8 - bits - bit % 8)) & (1 << uint(bits) - 1)
+    return value * 0xffff / (1 << uint(bits) - 1)
+}
+
+func (myDecoder *tiffDecoder) setPixel(myImage image.Image, x int, y int, row []byte, column int, myLayout tiffLayout) {
+    bits := myLayout.BitsPerSample
+    first := column * myLayout.SamplesPerPixel
+
+    if paletted, ok := myImage.(*image.Paletted); ok {
+        bit := first * bits
+        paletted.Pix[y * paletted.Stride + x] = row[bit / 8] >> uint(8 - bits - bit % 8) & byte(1 << uint(bits) - 1)
+        return
+    }
+
+    var r, g, b uint32
+    alphaSample := first + 1
+    if myLayout.Photometric == 2 {
+        r, g, b = myDecoder.sample(row, first, bits), myDecoder.sample(row, first + 1, bits), myDecoder.sample(row, first + 2, bits)
+        alphaSample = first + 3
+    } else {
+        r = myDecoder.sample(row, first, bits)
+        if myLayout.Photometric == 0 {
+            r = 0xffff - r
+        }
+        g, b = r, r
+    }
+    a := uint32(0xffff)
+    if myLayout.Alpha != 0 {
+        a = myDecoder.sample(row, alphaSample, bits)
+    }
+
+    switch typed := myImage.(type) {
+    case *image.Gray:
+        typed.SetGray(x, y, color.Gray{uint8(r >> 8)})
+    case *image.Gray16:
+        typed.SetGray16(x, y, color.Gray16{uint16(r)})
+    case *image.RGBA:
+        typed.SetRGBA(x, y, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
+    case *image.RGBA64:
+        typed.SetRGBA64(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+    case *image.NRGBA:
+        typed.SetNRGBA(x, y, color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
+    case *image.NRGBA64:
+        typed.SetNRGBA64(x, y, color.NRGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+    }
+}
+
+func tiffPackBits(compressed []byte, expected int) []byte {
+    out := make([]byte, 0, expected)
+    for i := 0; i < len(compressed) && len(out) < expected; {
+        header := int8(compressed[i])
+        i++
+        switch {
+        case header >= 0:
+            end := i + int(header) + 1
+            if end > len(compressed) {
+                end = len(compressed)
+            }
+            out = append(out, compressed[i:end]...)
+            i = end
+        case header != -128:
+            if i < len(compressed) {
+                for n := 0; n < 1 - int(header); n++ {
+                    out = append(out, compressed[i])
+                }
+            }
+            i++
+        }
+    }
+    // A run can go past the end
+    if len(out) > expected {
+        out = out[:expected]
+    }
+    return out
+}
+
+// TIFF's flavour of LZW: most significant bit first and the code width grows one code early,
+// which is why compress/lzw can't read it.
+func tiffLZW(compressed []byte, expected int) ([]byte, error) {
+    const clearCode, endCode = 256, 257
+    out := make([]byte, 0, expected)
+    table := make([][]byte, 4096)
+    for i := 0; i < 256; i++ {
+        table[i] = []byte{byte(i)}
+    }
+
+    var buffer uint32
+    bufferedBits := uint(0)
+    width := uint(9)
+    next := 258
+    var previous []byte
+
+    for position := 0; len(out) < expected; {
+        for bufferedBits < width && position < len(compressed) {
+            buffer = buffer << 8 | uint32(compressed[position])
+            bufferedBits += 8
+            position++
+        }
+        if bufferedBits < width {
+            break
+        }
+        code := int(buffer >> (bufferedBits - width) & (1 << width - 1))
+        bufferedBits -= width
+
+        if code == clearCode {
+            width, next, previous = 9, 258, nil
+            continue
+        }
+        if code == endCode {
+            break
+        }
+
+        var entry []byte
+        switch {
+        case code < next && table[code] != nil:
+            entry = table[code]
+        case code == next && previous != nil:
+            entry = append(append([]byte{}, previous...), previous[0])
+        default:
+            return nil, fmt.Errorf("tiff: bad LZW code %d", code)
+        }
+        out = append(out, entry...)
+
+        if previous != nil && next < 4096 {
+            table[next] = append(append(make([]byte, 0, len(previous) + 1), previous...), entry[0])
+            next++
+        }
+        if next + 1 >= 1 << width && width < 12 {
+            width++
+        }
+        previous = entry
+    }
+
+    return out, nil
+}
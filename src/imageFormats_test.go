@@ -0,0 +1,633 @@
+package main
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "image"
+    "image/color"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// ---- BMP ----
+
+// A BMP with a 40 byte info header, extra (masks or palette) after it and then the pixel rows as
+// given. A negative height is a top-down image.
+func bmpFile(width int, height int, bits int, compression uint32, extra []byte, pixels []byte) []byte {
+    data := make([]byte, 54, 54 + len(extra) + len(pixels))
+    copy(data, "BM")
+    binary.LittleEndian.PutUint32(data[2:], uint32(54 + len(extra) + len(pixels)))
+    binary.LittleEndian.PutUint32(data[10:], uint32(54 + len(extra)))
+    binary.LittleEndian.PutUint32(data[14:], 40)
+    binary.LittleEndian.PutUint32(data[18:], uint32(int32(width)))
+    binary.LittleEndian.PutUint32(data[22:], uint32(int32(height)))
+    binary.LittleEndian.PutUint16(data[26:], 1)
+    binary.LittleEndian.PutUint16(data[28:], uint16(bits))
+    binary.LittleEndian.PutUint32(data[30:], compression)
+    data = append(data, extra...)
+    return append(data, pixels...)
+}
+
+func littleEndianWords(words ...uint32) []byte {
+    data := make([]byte, 4 * len(words))
+    for i, word := range words {
+        binary.LittleEndian.PutUint32(data[4 * i:], word)
+    }
+    return data
+}
+
+// Pixels of a decoded image to check, by position
+type pixelChecks map[image.Point]color.Color
+
+func checkPixels(t *testing.T, name string, myImage image.Image, width int, height int, want pixelChecks) {
+    t.Helper()
+    if myImage.Bounds() != image.Rect(0, 0, width, height) {
+        t.Errorf("%s: bounds are %v, want %dx%d", name, myImage.Bounds(), width, height)
+        return
+    }
+    for point, wantColor := range want {
+        r, g, b, a := myImage.At(point.X, point.Y).RGBA()
+        wr, wg, wb, wa := wantColor.RGBA()
+        if r != wr || g != wg || b != wb || a != wa {
+            t.Errorf("%s: pixel %v is %v, want %v", name, point, []uint32{r, g, b, a}, []uint32{wr, wg, wb, wa})
+        }
+    }
+}
+
+var validBMPs = []struct {
+    name string
+    data []byte
+    width, height int
+    want pixelChecks
+}{
+    // Rows are bottom up and padded to 4 bytes, pixels BGR
+    {"24 bit", bmpFile(2, 2, 24, 0, nil, []byte{
+        0, 0, 0xff, 0, 0xff, 0, 0, 0,
+        0xff, 0, 0, 0x10, 0x20, 0x30, 0, 0,
+    }), 2, 2, pixelChecks{
+        {0, 0}: color.NRGBA{0, 0, 0xff, 0xff},
+        {1, 0}: color.NRGBA{0x30, 0x20, 0x10, 0xff},
+        {0, 1}: color.NRGBA{0xff, 0, 0, 0xff},
+        {1, 1}: color.NRGBA{0, 0xff, 0, 0xff},
+    }},
+    {"32 bit top down", bmpFile(1, -2, 32, 0, nil, []byte{
+        1, 2, 3, 0,
+        4, 5, 6, 0,
+    }), 1, 2, pixelChecks{
+        {0, 0}: color.NRGBA{3, 2, 1, 0xff},
+        {0, 1}: color.NRGBA{6, 5, 4, 0xff},
+    }},
+    {"32 bit with alpha", bmpFile(2, 1, 32, 6, littleEndianWords(0xff0000, 0xff00, 0xff, 0xff000000), []byte{
+        0x30, 0x20, 0x10, 0x80,
+        0, 0, 0xff, 0,
+    }), 2, 1, pixelChecks{
+        {0, 0}: color.NRGBA{0x10, 0x20, 0x30, 0x80},
+        {1, 0}: color.NRGBA{0xff, 0, 0, 0},
+    }},
+    // An alpha mask and not one pixel that isn't transparent: the writer meant opaque
+    {"32 bit with empty alpha", bmpFile(1, 1, 32, 6, littleEndianWords(0xff0000, 0xff00, 0xff, 0xff000000), []byte{
+        0x30, 0x20, 0x10, 0,
+    }), 1, 1, pixelChecks{
+        {0, 0}: color.NRGBA{0x10, 0x20, 0x30, 0xff},
+    }},
+    {"16 bit 5-5-5", bmpFile(2, 1, 16, 0, nil, []byte{
+        0x00, 0x7c, 0x1f, 0x00,
+    }), 2, 1, pixelChecks{
+        {0, 0}: color.NRGBA{0xff, 0, 0, 0xff},
+        {1, 0}: color.NRGBA{0, 0, 0xff, 0xff},
+    }},
+    {"16 bit 5-6-5", bmpFile(1, 1, 16, 3, littleEndianWords(0xf800, 0x07e0, 0x001f), []byte{
+        0xe0, 0x07, 0, 0,
+    }), 1, 1, pixelChecks{
+        {0, 0}: color.NRGBA{0, 0xff, 0, 0xff},
+    }},
+    {"8 bit palette", bmpFile(3, 1, 8, 0, append(littleEndianWords(0x000000, 0xff0000, 0x00ff00), make([]byte, 4 * 253)...), []byte{
+        1, 2, 0, 0,
+    }), 3, 1, pixelChecks{
+        {0, 0}: color.RGBA{0xff, 0, 0, 0xff},
+        {1, 0}: color.RGBA{0, 0xff, 0, 0xff},
+        {2, 0}: color.RGBA{0, 0, 0, 0xff},
+    }},
+    {"1 bit", bmpFile(10, 1, 1, 0, littleEndianWords(0x000000, 0xffffff), []byte{
+        0xa0, 0x40, 0, 0,
+    }), 10, 1, pixelChecks{
+        {0, 0}: color.White,
+        {1, 0}: color.Black,
+        {2, 0}: color.White,
+        {8, 0}: color.Black,
+        {9, 0}: color.White,
+    }},
+}
+
+func TestDecodeBMP(t *testing.T) {
+    for _, test := range validBMPs {
+        myImage, format, err := image.Decode(bytes.NewReader(test.data))
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if format != "bmp" {
+            t.Errorf("%s: decoded as %s", test.name, format)
+        }
+        checkPixels(t, test.name, myImage, test.width, test.height, test.want)
+
+        config, _, err := image.DecodeConfig(bytes.NewReader(test.data))
+        if err != nil || config.Width != test.width || config.Height != test.height {
+            t.Errorf("%s: config is %dx%d, %v", test.name, config.Width, config.Height, err)
+        }
+    }
+}
+
+// Masks of any width scale to 8 bits, up to one covering all 32.
+func TestBMPChannel(t *testing.T) {
+    tests := []struct {
+        value uint32
+        mask uint32
+        want uint8
+    }{
+        {0x00ff0000, 0x00ff0000, 0xff},
+        {0x00800000, 0x00ff0000, 0x80},
+        {0x7c00, 0x7c00, 0xff},
+        {0x4000, 0x7c00, 0x83},
+        {0xffffffff, 0xffffffff, 0xff},
+        {0x80000000, 0xffffffff, 0x7f},
+        {0xfffffffc, 0xfffffffc, 0xff},
+        {0x3ffffffc, 0x3ffffffc, 0xff},
+        {0x12345678, 0, 0},
+    }
+    for _, test := range tests {
+        if got := bmpChannel(test.value, test.mask); got != test.want {
+            t.Errorf("bmpChannel(%#x, %#x) = %#x, want %#x", test.value, test.mask, got, test.want)
+        }
+    }
+}
+
+func TestDecodeBMPErrors(t *testing.T) {
+    valid := validBMPs[0].data
+    withHeader := func(offset int, value uint32) []byte {
+        data := append([]byte{}, valid...)
+        binary.LittleEndian.PutUint32(data[offset:], value)
+        return data
+    }
+    tests := []struct {
+        name string
+        data []byte
+        message string
+    }{
+        {"empty", nil, "unsupported"},
+        {"not a BMP", []byte("BX" + strings.Repeat("\x00", 60)), "unsupported"},
+        {"unknown header size", withHeader(14, 20), "header size"},
+        {"header longer than the file", withHeader(14, 1000), "truncated"},
+        {"zero width", bmpFile(0, 1, 24, 0, nil, make([]byte, 4)), "dimensions"},
+        {"zero height", bmpFile(1, 0, 24, 0, nil, nil), "dimensions"},
+        {"7 bits", bmpFile(1, 1, 7, 0, nil, make([]byte, 4)), "bits per pixel"},
+        {"run length encoded", bmpFile(1, 1, 8, 1, make([]byte, 1024), make([]byte, 4)), "compression 1"},
+        {"bitfields with 24 bits", bmpFile(1, 1, 24, 3, littleEndianWords(1, 2, 4), make([]byte, 4)), "bitfields"},
+        {"masks cut off", bmpFile(1, 1, 32, 6, littleEndianWords(1, 2), nil), "truncated"},
+        {"palette cut off", bmpFile(1, 1, 8, 0, make([]byte, 100), nil), "palette"},
+        {"pixels cut off", bmpFile(4, 4, 24, 0, nil, make([]byte, 47)), "pixel data"},
+        {"pixels past the end", withHeader(10, 1 << 30), "pixel data"},
+        {"pixels before the start", withHeader(10, 1 << 31), "pixel data"},
+        // Dimensions whose product overflows must not get through as a small image
+        {"huge", bmpFile(1 << 30, 1 << 30, 32, 0, nil, make([]byte, 64)), ""},
+        {"huge top down", bmpFile(1 << 31 - 1, -(1 << 31 - 1), 32, 0, nil, make([]byte, 64)), ""},
+    }
+    for _, test := range tests {
+        _, err := decodeBMP(bytes.NewReader(test.data))
+        if err == nil || !strings.Contains(err.Error(), test.message) {
+            t.Errorf("%s: got %v, want an error about %q", test.name, err, test.message)
+        }
+    }
+}
+
+// ---- TIFF ----
+
+type tiffEntry struct {
+    Tag uint16
+    Type uint16
+    Values []uint32
+}
+
+// A TIFF of one image described by entries, with blocks (strips, or tiles when tiled) stored after
+// the directory. The offset and byte count tags are added.
+func tiffFile(order binary.ByteOrder, tiled bool, entries []tiffEntry, blocks ...[]byte) []byte {
+    offsetsTag, countsTag := uint16(tiffStripOffsets), uint16(tiffStripByteCounts)
+    if tiled {
+        offsetsTag, countsTag = tiffTileOffsets, tiffTileByteCounts
+    }
+    offsets, counts := make([]uint32, len(blocks)), make([]uint32, len(blocks))
+    for i, block := range blocks {
+        counts[i] = uint32(len(block))
+    }
+    entries = append(append([]tiffEntry{}, entries...), tiffEntry{offsetsTag, 4, offsets}, tiffEntry{countsTag, 4, counts})
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Tag < entries[j].Tag
+    })
+
+    size := func(entry tiffEntry) int {
+        return map[uint16]int{1: 1, 3: 2, 4: 4}[entry.Type] * len(entry.Values)
+    }
+    start := 8 + 2 + 12 * len(entries) + 4
+    for _, entry := range entries {
+        if size(entry) > 4 {
+            start += size(entry)
+        }
+    }
+    for i, block := range blocks {
+        offsets[i] = uint32(start)
+        start += len(block)
+    }
+
+    put := func(data []byte, entry tiffEntry) {
+        for i, value := range entry.Values {
+            switch entry.Type {
+            case 1:
+                data[i] = byte(value)
+            case 3:
+                order.PutUint16(data[2 * i:], uint16(value))
+            case 4:
+                order.PutUint32(data[4 * i:], value)
+            }
+        }
+    }
+    header := make([]byte, 8)
+    if order == binary.LittleEndian {
+        copy(header, "II*\x00")
+    } else {
+        copy(header, "MM\x00*")
+    }
+    order.PutUint32(header[4:], 8)
+    directory := make([]byte, 2 + 12 * len(entries) + 4)
+    order.PutUint16(directory, uint16(len(entries)))
+    var values []byte
+    for i, entry := range entries {
+        field := directory[2 + 12 * i:]
+        order.PutUint16(field, entry.Tag)
+        order.PutUint16(field[2:], entry.Type)
+        order.PutUint32(field[4:], uint32(len(entry.Values)))
+        if size(entry) <= 4 {
+            put(field[8:12], entry)
+            continue
+        }
+        order.PutUint32(field[8:], uint32(8 + len(directory) + len(values)))
+        outside := make([]byte, size(entry))
+        put(outside, entry)
+        values = append(values, outside...)
+    }
+
+    data := append(append(header, directory...), values...)
+    for _, block := range blocks {
+        data = append(data, block...)
+    }
+    return data
+}
+
+// The usual entries of a width x height image
+func tiffEntries(width int, height int, bits int, samples int, photometric int, more ...tiffEntry) []tiffEntry {
+    bitsPerSample := make([]uint32, samples)
+    for i := range bitsPerSample {
+        bitsPerSample[i] = uint32(bits)
+    }
+    return append([]tiffEntry{
+        {tiffImageWidth, 4, []uint32{uint32(width)}},
+        {tiffImageLength, 4, []uint32{uint32(height)}},
+        {tiffBitsPerSample, 3, bitsPerSample},
+        {tiffPhotometric, 3, []uint32{uint32(photometric)}},
+        {tiffSamplesPerPixel, 3, []uint32{uint32(samples)}},
+    }, more...)
+}
+
+func tiffCompressed(compression int) tiffEntry {
+    return tiffEntry{tiffCompression, 3, []uint32{uint32(compression)}}
+}
+
+// LZW codes as TIFF writes them, 9 bits each, most significant bit first. Enough for short tests
+// that never reach 10 bit codes.
+func lzwCodes(codes ...int) []byte {
+    var data []byte
+    var buffer uint32
+    bits := uint(0)
+    for _, code := range codes {
+        buffer = buffer << 9 | uint32(code)
+        bits += 9
+        for bits >= 8 {
+            data = append(data, byte(buffer >> (bits - 8)))
+            bits -= 8
+        }
+    }
+    if bits > 0 {
+        data = append(data, byte(buffer << (8 - bits)))
+    }
+    return data
+}
+
+func zlibCompressed(data []byte) []byte {
+    buffer := &bytes.Buffer{}
+    writer := zlib.NewWriter(buffer)
+    writer.Write(data)
+    writer.Close()
+    return buffer.Bytes()
+}
+
+var rgbPixels = []byte{
+    0xff, 0, 0, 0, 0xff, 0,
+    0, 0, 0xff, 0x10, 0x20, 0x30,
+}
+var rgbChecks = pixelChecks{
+    {0, 0}: color.RGBA{0xff, 0, 0, 0xff},
+    {1, 0}: color.RGBA{0, 0xff, 0, 0xff},
+    {0, 1}: color.RGBA{0, 0, 0xff, 0xff},
+    {1, 1}: color.RGBA{0x10, 0x20, 0x30, 0xff},
+}
+
+var validTIFFs = []struct {
+    name string
+    data []byte
+    width, height int
+    want pixelChecks
+}{
+    {"RGB little endian", tiffFile(binary.LittleEndian, false, tiffEntries(2, 2, 8, 3, 2), rgbPixels), 2, 2, rgbChecks},
+    {"RGB big endian", tiffFile(binary.BigEndian, false, tiffEntries(2, 2, 8, 3, 2), rgbPixels), 2, 2, rgbChecks},
+    {"RGB in two strips", tiffFile(binary.LittleEndian, false, tiffEntries(2, 2, 8, 3, 2, tiffEntry{tiffRowsPerStrip, 3, []uint32{1}}), rgbPixels[:6], rgbPixels[6:]), 2, 2, rgbChecks},
+    // A literal run of two, a repeat of three zeros, a no-op and a literal of one
+    {"PackBits", tiffFile(binary.LittleEndian, false, append(tiffEntries(6, 1, 8, 1, 1), tiffCompressed(32773)), []byte{1, 10, 20, 0xfe, 0, 0x80, 0, 30}), 6, 1, pixelChecks{
+        {0, 0}: color.Gray{10},
+        {1, 0}: color.Gray{20},
+        {2, 0}: color.Gray{0},
+        {4, 0}: color.Gray{0},
+        {5, 0}: color.Gray{30},
+    }},
+    // ABABABA: the last code is the one being added, the case LZW decoders get wrong
+    {"LZW", tiffFile(binary.LittleEndian, false, append(tiffEntries(7, 1, 8, 1, 1), tiffCompressed(5)), lzwCodes(256, 65, 66, 258, 260, 257)), 7, 1, pixelChecks{
+        {0, 0}: color.Gray{65},
+        {1, 0}: color.Gray{66},
+        {2, 0}: color.Gray{65},
+        {5, 0}: color.Gray{66},
+        {6, 0}: color.Gray{65},
+    }},
+    {"Deflate with unassociated alpha", tiffFile(binary.LittleEndian, false, append(tiffEntries(1, 2, 8, 4, 2, tiffEntry{tiffExtraSamples, 3, []uint32{2}}), tiffCompressed(8)), zlibCompressed([]byte{0xff, 0x80, 0, 0x80, 1, 2, 3, 0xff})), 1, 2, pixelChecks{
+        {0, 0}: color.NRGBA{0xff, 0x80, 0, 0x80},
+        {0, 1}: color.NRGBA{1, 2, 3, 0xff},
+    }},
+    {"16 bit associated alpha", tiffFile(binary.BigEndian, false, tiffEntries(1, 1, 16, 4, 2, tiffEntry{tiffExtraSamples, 3, []uint32{1}}), []byte{0x12, 0x34, 0, 0, 0x56, 0x78, 0x80, 0}), 1, 1, pixelChecks{
+        {0, 0}: color.RGBA64{0x1234, 0, 0x5678, 0x8000},
+    }},
+    {"horizontal predictor", tiffFile(binary.LittleEndian, false, tiffEntries(4, 1, 8, 1, 1, tiffEntry{tiffPredictor, 3, []uint32{2}}), []byte{10, 5, 5, 0xff}), 4, 1, pixelChecks{
+        {0, 0}: color.Gray{10},
+        {1, 0}: color.Gray{15},
+        {2, 0}: color.Gray{20},
+        {3, 0}: color.Gray{19},
+    }},
+    {"16 bit grey", tiffFile(binary.BigEndian, false, tiffEntries(2, 1, 16, 1, 1), []byte{0x12, 0x34, 0xff, 0xff}), 2, 1, pixelChecks{
+        {0, 0}: color.Gray16{0x1234},
+        {1, 0}: color.Gray16{0xffff},
+    }},
+    {"white is zero", tiffFile(binary.LittleEndian, false, tiffEntries(10, 1, 1, 1, 0), []byte{0xa0, 0x40}), 10, 1, pixelChecks{
+        {0, 0}: color.Gray{0},
+        {1, 0}: color.Gray{0xff},
+        {2, 0}: color.Gray{0},
+        {9, 0}: color.Gray{0},
+    }},
+    {"palette", tiffFile(binary.LittleEndian, false, tiffEntries(2, 1, 1, 1, 3, tiffEntry{tiffColorMap, 3, []uint32{0xffff, 0, 0, 0xffff, 0, 0}}), []byte{0x40}), 2, 1, pixelChecks{
+        {0, 0}: color.RGBA{0xff, 0, 0, 0xff},
+        {1, 0}: color.RGBA{0, 0xff, 0, 0xff},
+    }},
+    // Four 2x2 tiles for a 3x3 image, the ones on the right and bottom sticking out
+    {"tiled", tiffFile(binary.LittleEndian, true, tiffEntries(3, 3, 8, 1, 1, tiffEntry{tiffTileWidth, 3, []uint32{2}}, tiffEntry{tiffTileLength, 3, []uint32{2}}),
+        []byte{1, 2, 4, 5}, []byte{3, 0, 6, 0}, []byte{7, 8, 0, 0}, []byte{9, 0, 0, 0}), 3, 3, pixelChecks{
+        {0, 0}: color.Gray{1},
+        {2, 0}: color.Gray{3},
+        {1, 1}: color.Gray{5},
+        {0, 2}: color.Gray{7},
+        {2, 2}: color.Gray{9},
+    }},
+}
+
+func TestDecodeTIFF(t *testing.T) {
+    for _, test := range validTIFFs {
+        myImage, format, err := image.Decode(bytes.NewReader(test.data))
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if format != "tiff" {
+            t.Errorf("%s: decoded as %s", test.name, format)
+        }
+        checkPixels(t, test.name, myImage, test.width, test.height, test.want)
+
+        config, _, err := image.DecodeConfig(bytes.NewReader(test.data))
+        if err != nil || config.Width != test.width || config.Height != test.height {
+            t.Errorf("%s: config is %dx%d, %v", test.name, config.Width, config.Height, err)
+        }
+    }
+}
+
+func TestDecodeTIFFErrors(t *testing.T) {
+    valid := validTIFFs[0].data
+    patched := func(offset int, value ...byte) []byte {
+        data := append([]byte{}, valid...)
+        copy(data[offset:], value)
+        return data
+    }
+    rgb := func(more ...tiffEntry) []byte {
+        return tiffFile(binary.LittleEndian, false, tiffEntries(2, 2, 8, 3, 2, more...), rgbPixels)
+    }
+    tests := []struct {
+        name string
+        data []byte
+        message string
+    }{
+        {"empty", nil, "unsupported"},
+        {"header only", valid[:7], "unsupported"},
+        {"not a TIFF", patched(0, 'I', 'M'), "unsupported"},
+        {"directory before the header ends", patched(4, 4, 0, 0, 0), "directory offset"},
+        {"directory past the end", patched(4, 0xff, 0xff, 0, 0), "directory offset"},
+        {"directory offset overflowing", patched(4, 0xff, 0xff, 0xff, 0xff), "directory offset"},
+        {"too many entries", patched(8, 0xff, 0x7f), "directory is truncated"},
+        {"count past the end", patched(8 + 2 + 4, 0xff, 0xff, 0xff, 0x7f), "bad count"},
+        {"value past the end", patched(8 + 2 + 12 * 2 + 4, 3, 0, 0, 0, 0xff, 0xff, 0, 0), "outside the file"},
+        {"zero width", tiffFile(binary.LittleEndian, false, tiffEntries(0, 1, 8, 1, 1), []byte{0}), "dimensions"},
+        {"no dimensions", tiffFile(binary.LittleEndian, false, nil, []byte{0}), "dimensions"},
+        {"12 bit RGB", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 12, 3, 2), make([]byte, 5)), "12 bit RGB"},
+        {"3 bit grey", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 3, 1, 1), []byte{0}), "3 bit grayscale"},
+        {"CMYK", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 8, 4, 5), make([]byte, 4)), "photometric"},
+        {"too few samples", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 8, 1, 2), make([]byte, 3)), "too few"},
+        {"planar", rgb(tiffEntry{tiffPlanarConfiguration, 3, []uint32{2}}), "planar"},
+        {"palette without a colour map", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 8, 1, 3), []byte{0}), "palette"},
+        {"16 bit palette", tiffFile(binary.LittleEndian, false, tiffEntries(1, 1, 16, 1, 3), []byte{0, 0}), "palette"},
+        {"JPEG compressed", rgb(tiffCompressed(7)), "compression 7"},
+        {"zero rows per strip", rgb(tiffEntry{tiffRowsPerStrip, 3, []uint32{0}}), "strip or tile size"},
+        {"missing strips", rgb(tiffEntry{tiffRowsPerStrip, 3, []uint32{1}}), "missing"},
+        {"strip cut off", valid[:len(valid) - 1], "outside the file"},
+        {"not Deflate", rgb(tiffCompressed(8)), "zlib"},
+        {"LZW code from nowhere", tiffFile(binary.LittleEndian, false, append(tiffEntries(2, 1, 8, 1, 1), tiffCompressed(5)), lzwCodes(256, 300, 257)), "LZW code 300"},
+        // Allocating pixels for these before finding out the data isn't there would take the
+        // worker down
+        {"huge", tiffFile(binary.LittleEndian, false, tiffEntries(1 << 30, 1 << 30, 8, 3, 2), rgbPixels), ""},
+        {"huge tiles", tiffFile(binary.LittleEndian, true, tiffEntries(2, 2, 8, 3, 2, tiffEntry{tiffTileWidth, 4, []uint32{1 << 31}}, tiffEntry{tiffTileLength, 4, []uint32{1 << 31}}), rgbPixels), ""},
+    }
+    for _, test := range tests {
+        _, err := decodeTIFF(bytes.NewReader(test.data))
+        if err == nil || !strings.Contains(err.Error(), test.message) {
+            t.Errorf("%s: got %v, want an error about %q", test.name, err, test.message)
+        }
+    }
+}
+
+func TestTIFFPackBits(t *testing.T) {
+    tests := []struct {
+        name string
+        compressed []byte
+        expected int
+        want []byte
+    }{
+        {"literal", []byte{2, 1, 2, 3}, 3, []byte{1, 2, 3}},
+        {"repeat", []byte{0xfd, 7}, 4, []byte{7, 7, 7, 7}},
+        {"no-op", []byte{0x80, 0, 9}, 1, []byte{9}},
+        {"stops at expected", []byte{0x81, 7, 0, 8}, 3, []byte{7, 7, 7}},
+        {"literal cut off", []byte{5, 1, 2}, 6, []byte{1, 2}},
+        {"repeat cut off", []byte{0, 1, 0xfd}, 5, []byte{1}},
+        {"empty", nil, 4, []byte{}},
+    }
+    for _, test := range tests {
+        got := tiffPackBits(test.compressed, test.expected)
+        if !bytes.Equal(got, test.want) {
+            t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestTIFFLZW(t *testing.T) {
+    tests := []struct {
+        name string
+        compressed []byte
+        expected int
+        want []byte
+        message string
+    }{
+        {"literals", lzwCodes(256, 1, 2, 3, 257), 3, []byte{1, 2, 3}, ""},
+        {"codes from the table", lzwCodes(256, 65, 66, 258, 260, 257), 7, []byte("ABABABA"), ""},
+        {"clear in the middle", lzwCodes(256, 65, 66, 256, 67, 258, 257), 10, []byte("ABCCC"), ""},
+        {"code from before the clear", lzwCodes(256, 65, 66, 67, 256, 67, 259), 10, nil, "bad LZW code 259"},
+        {"stops at expected", lzwCodes(256, 1, 2, 3, 4), 2, []byte{1, 2}, ""},
+        {"no end code", lzwCodes(256, 1, 2), 10, []byte{1, 2}, ""},
+        {"cut off in a code", lzwCodes(256, 1, 2)[:3], 10, []byte{1}, ""},
+        {"code not there yet", lzwCodes(256, 65, 270), 10, nil, "bad LZW code 270"},
+        {"repeat without a previous code", lzwCodes(256, 258), 10, nil, "bad LZW code 258"},
+        {"empty", nil, 10, []byte{}, ""},
+    }
+    for _, test := range tests {
+        got, err := tiffLZW(test.compressed, test.expected)
+        if len(test.message) > 0 {
+            if err == nil || !strings.Contains(err.Error(), test.message) {
+                t.Errorf("%s: got %v, want an error about %q", test.name, err, test.message)
+            }
+            continue
+        }
+        if err != nil || !bytes.Equal(got, test.want) {
+            t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+        }
+    }
+}
+
+// Long sequences go past 9 bit codes, and the width has to grow one code early like in TIFF.
+func TestTIFFLZWCodeWidth(t *testing.T) {
+    // Every pair of bytes is new, so every code adds an entry and the codes are all literals.
+    // Written with the width growing where TIFF writers grow it.
+    var want []byte
+    for i := 0; i < 600; i++ {
+        want = append(want, byte(i * 7), byte(i * 13 + 1))
+    }
+    var data []byte
+    var buffer uint64
+    bits, width, next := uint(0), uint(9), 258
+    write := func(code int) {
+        buffer = buffer << width | uint64(code)
+        bits += width
+        for bits >= 8 {
+            data = append(data, byte(buffer >> (bits - 8)))
+            bits -= 8
+        }
+    }
+    write(256)
+    for i, value := range want {
+        write(int(value))
+        if i > 0 && next < 4096 {
+            next++
+        }
+        if next + 1 >= 1 << width && width < 12 {
+            width++
+        }
+    }
+    write(257)
+    if bits > 0 {
+        data = append(data, byte(buffer << (8 - bits)))
+    }
+
+    got, err := tiffLZW(data, len(want))
+    if err != nil || !bytes.Equal(got, want) {
+        t.Errorf("got %d bytes, %v, want %d bytes", len(got), err, len(want))
+    }
+}
+
+// ---- Anything at all ----
+
+// Every valid image cut short and with every byte changed, decoded with the standard library's
+// image.Decode like the services do. A broken file has to give an error and nothing may panic.
+func TestDecodeCorruptImages(t *testing.T) {
+    var valid [][]byte
+    for _, test := range validBMPs {
+        valid = append(valid, test.data)
+    }
+    for _, test := range validTIFFs {
+        valid = append(valid, test.data)
+    }
+
+    for n, data := range valid {
+        for length := 0; length < len(data); length++ {
+            truncated := data[:length]
+            if _, _, err := image.Decode(bytes.NewReader(truncated)); err == nil {
+                t.Errorf("image %d cut to %d of %d bytes decodes without an error", n, length, len(data))
+            }
+            image.DecodeConfig(bytes.NewReader(truncated))
+        }
+        for i := range data {
+            for _, value := range []byte{0, 1, 0x7f, 0x80, 0xff} {
+                changed := append([]byte{}, data...)
+                changed[i] = value
+                decodeWithoutPanic(t, changed)
+            }
+        }
+    }
+}
+
+func decodeWithoutPanic(t *testing.T, data []byte) {
+    t.Helper()
+    defer func() {
+        if problem := recover(); problem != nil {
+            t.Fatalf("decoding %q panics: %v", data, problem)
+        }
+    }()
+    config, _, err := image.DecodeConfig(bytes.NewReader(data))
+    // Like the services, only decode what's small enough to
+    if err == nil && config.Width * config.Height <= 1 << 20 {
+        image.Decode(bytes.NewReader(data))
+    }
+    decodeBMP(bytes.NewReader(data))
+    decodeTIFF(bytes.NewReader(data))
+}
+
+// go test -fuzz FuzzDecodeImage ... looks for more, starting from the images above.
+func FuzzDecodeImage(f *testing.F) {
+    for _, test := range validBMPs {
+        f.Add(test.data)
+    }
+    for _, test := range validTIFFs {
+        f.Add(test.data)
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        decodeWithoutPanic(t, data)
+    })
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+)
+
+// How big an uploaded image may be. Both masterService (on submission) and workerService (before
+// decoding) check uploads against these, looking only at the header so a tiny file claiming to be
+// 50000x50000 pixels never gets decoded.
+type imageLimits struct {
+    MaxWidth int
+    MaxHeight int
+    MaxPixels int
+    // All frames of an animation together, frames x width x height
+    MaxAnimationPixels int
+}
+
+// Used for every limit that isn't set in the key-value store
+var defaultImageLimits = imageLimits{
+    MaxWidth: 16384,
+    MaxHeight: 16384,
+    MaxPixels: 40000000,
+    MaxAnimationPixels: 100000000,
+}
+
+// The limits are cluster wide settings in the key-value store, e.g.
+// POST /set?key=maxImagePixels&value=10000000. They're read every time, so changes apply right away.
+func loadImageLimits(kVStoreAddress string) (imageLimits, error) {
+    limits := defaultImageLimits
+    settings := []struct {
+        Key string
+        Limit *int
+    }{
+        {"maxImageWidth", &limits.MaxWidth},
+        {"maxImageHeight", &limits.MaxHeight},
+        {"maxImagePixels", &limits.MaxPixels},
+        {"maxAnimationPixels", &limits.MaxAnimationPixels},
+    }
+
+    for _, setting := range settings {
+        response, err := http.Get("http://" + kVStoreAddress + "/get?key=" + setting.Key)
+        if err != nil {
+            return limits, err
+        }
+        data, err := ioutil.ReadAll(response.Body)
+        if err != nil {
+            return limits, err
+        }
+        if response.StatusCode != http.StatusOK {
+            return limits, fmt.Errorf("Can't get %s: %s", setting.Key, data)
+        }
+        if len(data) == 0 {
+            continue
+        }
+
+        value, err := strconv.Atoi(string(data))
+        if err != nil || value <= 0 {
+            return limits, fmt.Errorf("%s must be a positive number, not %q", setting.Key, data)
+        }
+        *setting.Limit = value
+    }
+
+    return limits, nil
+}
+
+// An imageTooLargeError means the image is over the limits. It's not worth retrying, the task is
+// rejected instead.
+type imageTooLargeError struct {
+    Width int
+    Height int
+    // More than one for an animation that's too large as a whole
+    Frames int
+    Limits imageLimits
+}
+
+func (myError imageTooLargeError) Error() string {
+    switch {
+    case myError.Width > myError.Limits.MaxWidth:
+        return fmt.Sprintf("image is %d pixels wide, the limit is %d", myError.Width, myError.Limits.MaxWidth)
+    case myError.Height > myError.Limits.MaxHeight:
+        return fmt.Sprintf("image is %d pixels high, the limit is %d", myError.Height, myError.Limits.MaxHeight)
+    case myError.Width * myError.Height > myError.Limits.MaxPixels:
+        return fmt.Sprintf("image has %d pixels (%dx%d), the limit is %d", myError.Width * myError.Height, myError.Width, myError.Height, myError.Limits.MaxPixels)
+    }
+    return fmt.Sprintf("animation has %d pixels (%d frames of %dx%d), the limit is %d", myError.Frames * myError.Width * myError.Height, myError.Frames, myError.Width, myError.Height, myError.Limits.MaxAnimationPixels)
+}
+
+// The most bytes a file of an image within the limits takes: 8 a pixel for 16 bit RGBA stored
+// without compression, 2 a pixel for the frames of a GIF (whose codes are at most 12 bits and
+// stand for at least a pixel each), and room for the headers and metadata. Anything bigger can be
+// turned away without reading it all.
+func (limits imageLimits) maxFileBytes() int {
+    return max(8 * limits.MaxPixels, 2 * limits.MaxAnimationPixels) + 16 << 20
+}
+
+// Read just the header of the image to find its format and size, and check the size. GIFs are
+// checked with all their frames.
+func checkImageData(data []byte, limits imageLimits) (image.Config, string, error) {
+    config, format, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return config, format, err
+    }
+    err = checkImageSize(config.Width, config.Height, imageFrames(data, format), limits)
+    return config, format, err
+}
+
+// Check the size of an image, or of an animation of that many frames, against the limits.
+func checkImageSize(width int, height int, frames int, limits imageLimits) error {
+    if width > limits.MaxWidth || height > limits.MaxHeight || width * height > limits.MaxPixels {
+        return imageTooLargeError{width, height, 1, limits}
+    }
+    if frames > 1 && frames * width * height > limits.MaxAnimationPixels {
+        return imageTooLargeError{width, height, frames, limits}
+    }
+    return nil
+}
+
+// The number of frames of a GIF, counted by walking its blocks without decoding any of them. Other
+// formats have one. A GIF that's broken halfway counts the frames before the break, decoding fails
+// on it anyway.
+func imageFrames(data []byte, format string) int {
+    if format != "gif" || len(data) < 13 {
+        return 1
+    }
+    // Header and logical screen descriptor, then the global colour table if there is one
+    i := 13
+    if data[10] & 0x80 != 0 {
+        i += 3 << (data[10] & 7 + 1)
+    }
+    frames := 0
+    for i < len(data) {
+        switch data[i] {
+        case 0x21:
+            // Extension: a label and sub-blocks
+            i = skipGIFSubBlocks(data, i + 2)
+        case 0x2C:
+            // Image descriptor, local colour table, LZW code size and sub-blocks of image data
+            if i + 10 > len(data) {
+                return max(frames, 1)
+            }
+            flags := data[i + 9]
+            i += 10
+            if flags & 0x80 != 0 {
+                i += 3 << (flags & 7 + 1)
+            }
+            frames++
+            i = skipGIFSubBlocks(data, i + 1)
+        default:
+            // The trailer, or garbage
+            return max(frames, 1)
+        }
+    }
+    return max(frames, 1)
+}
+
+// The position after a run of sub-blocks starting at i, each one a length byte and that many bytes,
+// the last one empty.
+func skipGIFSubBlocks(data []byte, i int) int {
+    for i < len(data) && data[i] != 0 {
+        i += int(data[i]) + 1
+    }
+    return i + 1
+}
@@ -0,0 +1,270 @@
+package main
+
+// Shared between masterService and workerService: the EXIF data of JPEG uploads. Phones store
+// photos the way the sensor saw them and say in the EXIF orientation how to turn them, so both
+// turn them upright before looking at the pixels. workerService also carries the fields a task
+// asks to keep into its result.
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/draw"
+)
+
+// The three directories of EXIF data we know: the main one (IFD0) with the camera and the
+// author, the Exif one with how the photo was taken and the GPS one.
+const (
+    exifImageIFD = iota
+    exifPhotoIFD
+    exifGPSIFD
+)
+
+// Tags that point to the other directories or say how to show the pixels
+const (
+    exifTagOrientation = 0x0112
+    exifTagPhotoIFD = 0x8769
+    exifTagGPSIFD = 0x8825
+)
+
+// One EXIF field, its value as raw bytes in the byte order of the data it came from.
+type exifField struct {
+    IFD int
+    Tag uint16
+    Type uint16
+    Count uint32
+    Value []byte
+}
+
+type exifData struct {
+    Order binary.ByteOrder
+    // 1 (upright) to 8, see orientImage
+    Orientation int
+    Fields []exifField
+}
+
+// Bytes per value of the EXIF field types: BYTE, ASCII, SHORT, LONG, RATIONAL, SBYTE, UNDEFINED,
+// SSHORT, SLONG, SRATIONAL, FLOAT and DOUBLE
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// The fields a task can keep, in groups: ?metadataFields=camera,date keeps the make and model of
+// the camera and when the photo was taken. The GPS group is the whole GPS directory.
+var metadataGroups = map[string][]struct {
+    IFD int
+    Tag uint16
+}{
+    "camera": {
+        {exifImageIFD, 0x010F}, // Make
+        {exifImageIFD, 0x0110}, // Model
+        {exifImageIFD, 0x0131}, // Software
+        {exifPhotoIFD, 0xA433}, // LensMake
+        {exifPhotoIFD, 0xA434}, // LensModel
+    },
+    "date": {
+        {exifImageIFD, 0x0132}, // DateTime
+        {exifPhotoIFD, 0x9003}, // DateTimeOriginal
+        {exifPhotoIFD, 0x9004}, // DateTimeDigitized
+        {exifPhotoIFD, 0x9010}, // OffsetTime
+        {exifPhotoIFD, 0x9011}, // OffsetTimeOriginal
+    },
+    "author": {
+        {exifImageIFD, 0x010E}, // ImageDescription
+        {exifImageIFD, 0x013B}, // Artist
+        {exifImageIFD, 0x8298}, // Copyright
+    },
+    "exposure": {
+        {exifPhotoIFD, 0x829A}, // ExposureTime
+        {exifPhotoIFD, 0x829D}, // FNumber
+        {exifPhotoIFD, 0x8822}, // ExposureProgram
+        {exifPhotoIFD, 0x8827}, // ISOSpeedRatings
+        {exifPhotoIFD, 0x9204}, // ExposureBiasValue
+        {exifPhotoIFD, 0x9207}, // MeteringMode
+        {exifPhotoIFD, 0x9209}, // Flash
+        {exifPhotoIFD, 0x920A}, // FocalLength
+        {exifPhotoIFD, 0xA403}, // WhiteBalance
+        {exifPhotoIFD, 0xA405}, // FocalLengthIn35mmFilm
+    },
+    "gps": nil,
+}
+
+// What ?metadata=keep keeps without ?metadataFields: everything but where the photo was taken
+var defaultMetadataGroups = []string{"camera", "date", "author", "exposure"}
+
+// The EXIF data of a JPEG, nil when it has none. Only the segments before the image data are
+// looked at.
+func readJPEGEXIF(data []byte) (*exifData, error) {
+    if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+        return nil, nil
+    }
+    for i := 2; i + 4 <= len(data); {
+        if data[i] != 0xFF {
+            return nil, nil
+        }
+        marker := data[i + 1]
+        if marker == 0xFF {
+            // Fill byte
+            i++
+            continue
+        }
+        if marker == 0xDA || marker == 0xD9 {
+            return nil, nil
+        }
+        if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+            i += 2
+            continue
+        }
+
+        length := int(binary.BigEndian.Uint16(data[i + 2:]))
+        if length < 2 || i + 2 + length > len(data) {
+            return nil, fmt.Errorf("exif: truncated segment")
+        }
+        segment := data[i + 4:i + 2 + length]
+        if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+            return parseEXIF(segment[6:])
+        }
+        i += 2 + length
+    }
+    return nil, nil
+}
+
+// EXIF data is a small TIFF file: IFD0 and the Exif and GPS directories it points to. Thumbnails
+// (IFD1) are left out.
+func parseEXIF(data []byte) (*exifData, error) {
+    if len(data) < 8 {
+        return nil, fmt.Errorf("exif: truncated header")
+    }
+    myEXIF := &exifData{Orientation: 1}
+    switch string(data[0:4]) {
+    case "II*\x00":
+        myEXIF.Order = binary.LittleEndian
+    case "MM\x00*":
+        myEXIF.Order = binary.BigEndian
+    default:
+        return nil, fmt.Errorf("exif: not a TIFF header")
+    }
+
+    pointers, err := myEXIF.readIFD(data, myEXIF.Order.Uint32(data[4:8]), exifImageIFD)
+    if err != nil {
+        return nil, err
+    }
+    for _, ifd := range []int{exifPhotoIFD, exifGPSIFD} {
+        if offset, ok := pointers[ifd]; ok {
+            _, err = myEXIF.readIFD(data, offset, ifd)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    return myEXIF, nil
+}
+
+// Read the fields of one directory. For IFD0 the offsets of the Exif and GPS directories come
+// back, they aren't fields of their own.
+func (myEXIF *exifData) readIFD(data []byte, offset uint32, ifd int) (map[int]uint32, error) {
+    if uint64(offset) + 2 > uint64(len(data)) {
+        return nil, fmt.Errorf("exif: bad directory offset")
+    }
+    start := int(offset)
+    entries := int(myEXIF.Order.Uint16(data[start:]))
+    if start + 2 + 12 * entries > len(data) {
+        return nil, fmt.Errorf("exif: directory is truncated")
+    }
+
+    pointers := map[int]uint32{}
+    for i := 0; i < entries; i++ {
+        entry := data[start + 2 + 12 * i:]
+        field := exifField{
+            IFD: ifd,
+            Tag: myEXIF.Order.Uint16(entry[0:2]),
+            Type: myEXIF.Order.Uint16(entry[2:4]),
+            Count: myEXIF.Order.Uint32(entry[4:8]),
+        }
+        size, ok := exifTypeSizes[field.Type]
+        if !ok {
+            continue
+        }
+        length := uint64(size) * uint64(field.Count)
+        if length > uint64(len(data)) {
+            return nil, fmt.Errorf("exif: bad count for tag %#04x", field.Tag)
+        }
+        value := entry[8:12]
+        if length <= 4 {
+            value = value[:length]
+        } else {
+            valueOffset := uint64(myEXIF.Order.Uint32(entry[8:12]))
+            if valueOffset + length > uint64(len(data)) {
+                return nil, fmt.Errorf("exif: tag %#04x points outside the data", field.Tag)
+            }
+            value = data[valueOffset:valueOffset + length]
+        }
+        field.Value = append([]byte{}, value...)
+
+        switch {
+        case ifd == exifImageIFD && field.Tag == exifTagPhotoIFD && length == 4:
+            pointers[exifPhotoIFD] = myEXIF.Order.Uint32(value)
+        case ifd == exifImageIFD && field.Tag == exifTagGPSIFD && length == 4:
+            pointers[exifGPSIFD] = myEXIF.Order.Uint32(value)
+        case ifd == exifImageIFD && field.Tag == exifTagOrientation && field.Type == 3 && field.Count == 1:
+            orientation := int(myEXIF.Order.Uint16(value))
+            if orientation >= 1 && orientation <= 8 {
+                myEXIF.Orientation = orientation
+            }
+        default:
+            myEXIF.Fields = append(myEXIF.Fields, field)
+        }
+    }
+    return pointers, nil
+}
+
+// The EXIF orientation of the image in data, 1 (upright) when it isn't a JPEG or says nothing.
+// Broken EXIF data isn't worth failing over, the pixels are fine.
+func imageOrientation(data []byte) int {
+    myEXIF, err := readJPEGEXIF(data)
+    if err != nil || myEXIF == nil {
+        return 1
+    }
+    return myEXIF.Orientation
+}
+
+// Turn an image upright according to its EXIF orientation: 2 needs mirroring, 3 half a turn, 4
+// flipping upside down, 6 a quarter turn clockwise and 8 anticlockwise, 5 and 7 are 8 and 6 mirrored.
+// 5 to 8 swap width and height. JPEGs are 8 bit, so the result is RGBA.
+func orientImage(myImage image.Image, orientation int) image.Image {
+    if orientation < 2 || orientation > 8 {
+        return myImage
+    }
+    bounds := myImage.Bounds()
+    src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+    draw.Draw(src, src.Rect, myImage, bounds.Min, draw.Src)
+
+    width, height := bounds.Dx(), bounds.Dy()
+    if orientation >= 5 {
+        width, height = height, width
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, width, height))
+    srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+    for y := 0; y < srcHeight; y++ {
+        for x := 0; x < srcWidth; x++ {
+            dstX, dstY := x, y
+            switch orientation {
+            case 2:
+                dstX = srcWidth - 1 - x
+            case 3:
+                dstX, dstY = srcWidth - 1 - x, srcHeight - 1 - y
+            case 4:
+                dstY = srcHeight - 1 - y
+            case 5:
+                dstX, dstY = y, x
+            case 6:
+                dstX, dstY = srcHeight - 1 - y, x
+            case 7:
+                dstX, dstY = srcHeight - 1 - y, srcWidth - 1 - x
+            case 8:
+                dstX, dstY = y, srcWidth - 1 - x
+            }
+            copy(dst.Pix[dst.PixOffset(dstX, dstY):dst.PixOffset(dstX, dstY) + 4], src.Pix[src.PixOffset(x, y):])
+        }
+    }
+    return dst
+}
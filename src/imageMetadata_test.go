@@ -0,0 +1,369 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "image/png"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// EXIF data with a field or two of every group, in the given byte order. Values longer than four
+// bytes (and one of odd length) go after the directories.
+func testEXIF(order binary.ByteOrder) *exifData {
+    short := func(value uint16) []byte {
+        data := make([]byte, 2)
+        order.PutUint16(data, value)
+        return data
+    }
+    rationals := func(values ...uint32) []byte {
+        data := make([]byte, 4 * len(values))
+        for i, value := range values {
+            order.PutUint32(data[4 * i:], value)
+        }
+        return data
+    }
+    return &exifData{Order: order, Orientation: 6, Fields: []exifField{
+        {exifImageIFD, 0x010F, 2, 6, []byte("Canon\x00")},
+        {exifImageIFD, 0x0110, 2, 8, []byte("Phone X\x00")},
+        {exifImageIFD, 0x0131, 2, 5, []byte("gimp\x00")},
+        {exifImageIFD, 0x0132, 2, 20, []byte("2024:05:01 12:00:00\x00")},
+        {exifImageIFD, 0x013B, 2, 4, []byte("Ann\x00")},
+        {exifImageIFD, 0x8298, 2, 12, []byte("(c) 2024 me\x00")},
+        // Not in any group, never kept
+        {exifImageIFD, 0x011A, 5, 1, rationals(72, 1)},
+        {exifPhotoIFD, 0x829A, 5, 1, rationals(1, 250)},
+        {exifPhotoIFD, 0x8827, 3, 1, short(400)},
+        {exifPhotoIFD, 0x9003, 2, 20, []byte("2024:05:01 11:59:58\x00")},
+        {exifGPSIFD, 0x0001, 2, 2, []byte("N\x00")},
+        {exifGPSIFD, 0x0002, 5, 3, rationals(52, 1, 31, 1, 1234, 100)},
+    }}
+}
+
+// The fields of myEXIF in the given groups, in the order parseEXIF finds them.
+func exifFieldsIn(myEXIF *exifData, groups ...string) []exifField {
+    var fields []exifField
+    for _, ifd := range []int{exifImageIFD, exifPhotoIFD, exifGPSIFD} {
+        for _, field := range myEXIF.Fields {
+            if field.IFD != ifd {
+                continue
+            }
+            kept := false
+            for _, group := range groups {
+                kept = kept || (field.IFD == exifGPSIFD && (group == "gps" || group == "all"))
+                for name, tags := range metadataGroups {
+                    for _, tag := range tags {
+                        kept = kept || ((group == name || group == "all") && tag.IFD == field.IFD && tag.Tag == field.Tag)
+                    }
+                }
+            }
+            if kept {
+                fields = append(fields, field)
+            }
+        }
+    }
+    return fields
+}
+
+func encodedImage(t *testing.T, format string) []byte {
+    t.Helper()
+    myImage := image.NewRGBA(image.Rect(0, 0, 8, 8))
+    buffer := &bytes.Buffer{}
+    var err error
+    if format == "jpeg" {
+        err = jpeg.Encode(buffer, myImage, nil)
+    } else {
+        err = png.Encode(buffer, myImage)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return buffer.Bytes()
+}
+
+func TestEXIFRoundTrip(t *testing.T) {
+    tests := []struct {
+        name string
+        groups []string
+    }{
+        {"camera", []string{"camera"}},
+        {"camera and date", []string{"camera", "date"}},
+        {"default", defaultMetadataGroups},
+        {"gps only", []string{"gps"}},
+        {"all", []string{"all"}},
+    }
+    for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+        for _, test := range tests {
+            name := order.String() + " " + test.name
+            myEXIF := testEXIF(order)
+            want := exifFieldsIn(myEXIF, test.groups...)
+
+            tiff := encodeEXIF(myEXIF, test.groups)
+            parsed, err := parseEXIF(tiff)
+            if err != nil {
+                t.Errorf("%s: %v", name, err)
+                continue
+            }
+            if parsed.Order != order || parsed.Orientation != 1 {
+                t.Errorf("%s: order %v and orientation %d, want %v and 1", name, parsed.Order, parsed.Orientation, order)
+            }
+            if !reflect.DeepEqual(parsed.Fields, want) {
+                t.Errorf("%s: fields are\n%v\nwant\n%v", name, parsed.Fields, want)
+            }
+
+            // Into a JPEG and out again, the JPEG still decoding
+            withEXIF := embedEXIF("jpeg", encodedImage(t, "jpeg"), tiff)
+            fromJPEG, err := readJPEGEXIF(withEXIF)
+            if err != nil || fromJPEG == nil || !reflect.DeepEqual(fromJPEG.Fields, want) {
+                t.Errorf("%s: from a JPEG %v, %v", name, fromJPEG, err)
+            }
+            if _, err := jpeg.Decode(bytes.NewReader(withEXIF)); err != nil {
+                t.Errorf("%s: JPEG with EXIF doesn't decode: %v", name, err)
+            }
+
+            // A PNG has it in an eXIf chunk, whose checksum png.Decode checks
+            withEXIF = embedEXIF("png", encodedImage(t, "png"), tiff)
+            if _, err := png.Decode(bytes.NewReader(withEXIF)); err != nil {
+                t.Errorf("%s: PNG with EXIF doesn't decode: %v", name, err)
+            }
+            chunk := bytes.Index(withEXIF, []byte("eXIf"))
+            if chunk < 0 || int(binary.BigEndian.Uint32(withEXIF[chunk - 4:])) != len(tiff) || !bytes.Equal(withEXIF[chunk + 4:chunk + 4 + len(tiff)], tiff) {
+                t.Errorf("%s: no eXIf chunk with the EXIF data in the PNG", name)
+            }
+        }
+    }
+}
+
+func TestEncodeEXIFNothingToKeep(t *testing.T) {
+    myEXIF := testEXIF(binary.LittleEndian)
+    tests := []struct {
+        name string
+        myEXIF *exifData
+        groups []string
+    }{
+        {"no EXIF", nil, []string{"all"}},
+        {"no groups", myEXIF, nil},
+        {"unknown group", myEXIF, []string{"lens"}},
+        {"group without fields", &exifData{Order: binary.LittleEndian, Fields: myEXIF.Fields[:1]}, []string{"exposure"}},
+    }
+    for _, test := range tests {
+        if tiff := encodeEXIF(test.myEXIF, test.groups); tiff != nil {
+            t.Errorf("%s: got %d bytes of EXIF", test.name, len(tiff))
+        }
+    }
+
+    // And nothing to keep leaves the image as it is, as do formats without a place for it
+    tiff := encodeEXIF(myEXIF, []string{"all"})
+    for _, test := range []struct {
+        format string
+        tiff []byte
+    }{
+        {"jpeg", nil},
+        {"png", nil},
+        {"gif", tiff},
+        {"jpeg", make([]byte, 0x10000)},
+    } {
+        encoded := []byte("\xff\xd8 not really an image, long enough to look like a PNG header")
+        if got := embedEXIF(test.format, encoded, test.tiff); !bytes.Equal(got, encoded) {
+            t.Errorf("%s with %d bytes of EXIF changed the image", test.format, len(test.tiff))
+        }
+    }
+}
+
+// EXIF data of IFD0 alone, written the way encodeEXIF writes it.
+func exifIFD0(order binary.ByteOrder, fields ...exifField) []byte {
+    header := []byte("II*\x00\x08\x00\x00\x00")
+    if order == binary.BigEndian {
+        header = []byte("MM\x00*\x00\x00\x00\x08")
+    }
+    return writeEXIFIFD(header, fields, order)
+}
+
+func TestImageOrientation(t *testing.T) {
+    jpegData := encodedImage(t, "jpeg")
+    orientationField := func(order binary.ByteOrder, fieldType uint16, value int) exifField {
+        data := make([]byte, 4)
+        order.PutUint16(data, uint16(value))
+        if fieldType == 4 {
+            order.PutUint32(data, uint32(value))
+        }
+        return exifField{exifImageIFD, exifTagOrientation, fieldType, 1, data[:exifTypeSizes[fieldType]]}
+    }
+    for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+        for orientation := 0; orientation <= 9; orientation++ {
+            want := orientation
+            if orientation < 1 || orientation > 8 {
+                want = 1
+            }
+            data := embedEXIF("jpeg", jpegData, exifIFD0(order, orientationField(order, 3, orientation)))
+            if got := imageOrientation(data); got != want {
+                t.Errorf("%v orientation %d reads as %d, want %d", order, orientation, got, want)
+            }
+        }
+        // Only a SHORT counts
+        data := embedEXIF("jpeg", jpegData, exifIFD0(order, orientationField(order, 4, 6)))
+        if got := imageOrientation(data); got != 1 {
+            t.Errorf("%v orientation as a LONG reads as %d, want 1", order, got)
+        }
+    }
+    if got := imageOrientation(encodedImage(t, "png")); got != 1 {
+        t.Errorf("a PNG has orientation %d", got)
+    }
+}
+
+func TestOrientImage(t *testing.T) {
+    // As stored, 3x2
+    stored := [][]uint8{
+        {1, 2, 3},
+        {4, 5, 6},
+    }
+    tests := []struct {
+        orientation int
+        want [][]uint8
+    }{
+        {1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+        {2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+        {3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+        {4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+        {5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+        {6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+        {7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+        {8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+        {0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+        {9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+    }
+
+    // The same pixels in an image that doesn't start at (0, 0)
+    whole := image.NewGray(image.Rect(0, 0, 5, 4))
+    for y, row := range stored {
+        for x, value := range row {
+            whole.SetGray(x + 2, y + 1, color.Gray{value})
+        }
+    }
+    shifted := whole.SubImage(image.Rect(2, 1, 5, 3))
+
+    for _, test := range tests {
+        result := orientImage(shifted, test.orientation)
+        bounds := result.Bounds()
+        if bounds.Dx() != len(test.want[0]) || bounds.Dy() != len(test.want) {
+            t.Errorf("orientation %d: %dx%d, want %dx%d", test.orientation, bounds.Dx(), bounds.Dy(), len(test.want[0]), len(test.want))
+            continue
+        }
+        for y, row := range test.want {
+            for x, value := range row {
+                if got := color.GrayModel.Convert(result.At(bounds.Min.X + x, bounds.Min.Y + y)).(color.Gray).Y; got != value {
+                    t.Errorf("orientation %d: pixel %d, %d is %d, want %d", test.orientation, x, y, got, value)
+                }
+            }
+        }
+    }
+}
+
+func TestParseEXIFErrors(t *testing.T) {
+    valid := encodeEXIF(testEXIF(binary.LittleEndian), []string{"all"})
+    patched := func(offset int, value uint32) []byte {
+        data := append([]byte{}, valid...)
+        binary.LittleEndian.PutUint32(data[offset:], value)
+        return data
+    }
+    // IFD0 is at 8, its first entry (Make) has its value outside the entry and the last one
+    // points to the GPS directory
+    firstEntry := 8 + 2
+    entries := int(binary.LittleEndian.Uint16(valid[8:]))
+    lastEntry := firstEntry + 12 * (entries - 1)
+    tests := []struct {
+        name string
+        data []byte
+        message string
+    }{
+        {"empty", nil, "truncated header"},
+        {"header only", valid[:7], "truncated header"},
+        {"not TIFF", append([]byte("GIF8"), valid[4:]...), "not a TIFF header"},
+        {"IFD0 past the end", patched(4, uint32(len(valid))), "bad directory offset"},
+        {"IFD0 offset overflowing", patched(4, 0xffffffff), "bad directory offset"},
+        {"too many entries", patched(8, 0xffff), "directory is truncated"},
+        {"value past the end", patched(firstEntry + 8, uint32(len(valid) - 2)), "points outside"},
+        {"value offset overflowing", patched(firstEntry + 8, 0xfffffffe), "points outside"},
+        {"count past the end", patched(firstEntry + 4, 0x7fffffff), "bad count"},
+        {"count overflowing", patched(firstEntry + 4, 0xffffffff), "bad count"},
+        {"GPS directory past the end", patched(lastEntry + 8, uint32(len(valid))), "bad directory offset"},
+        {"GPS directory overflowing", patched(lastEntry + 8, 0xfffffffe), "bad directory offset"},
+    }
+    for _, test := range tests {
+        _, err := parseEXIF(test.data)
+        if err == nil || !strings.Contains(err.Error(), test.message) {
+            t.Errorf("%s: got %v, want an error about %q", test.name, err, test.message)
+        }
+    }
+
+    // The last value (GPS latitude) ends the data, so cutting off anything loses part of it
+    for length := 0; length < len(valid); length++ {
+        if _, err := parseEXIF(valid[:length]); err == nil {
+            t.Errorf("cut to %d of %d bytes parses without an error", length, len(valid))
+        }
+    }
+}
+
+func TestReadJPEGEXIF(t *testing.T) {
+    tiff := encodeEXIF(testEXIF(binary.BigEndian), []string{"all"})
+    jpegData := encodedImage(t, "jpeg")
+    withEXIF := embedEXIF("jpeg", jpegData, tiff)
+    segment := func(marker byte, content string) []byte {
+        data := []byte{0xFF, marker, 0, 0}
+        binary.BigEndian.PutUint16(data[2:], uint16(2 + len(content)))
+        return append(data, content...)
+    }
+    start := []byte{0xFF, 0xD8}
+    join := func(parts ...[]byte) []byte {
+        return bytes.Join(parts, nil)
+    }
+
+    tests := []struct {
+        name string
+        data []byte
+        found bool
+        message string
+    }{
+        {"with EXIF", withEXIF, true, ""},
+        {"without EXIF", jpegData, false, ""},
+        {"not a JPEG", encodedImage(t, "png"), false, ""},
+        {"empty", nil, false, ""},
+        {"XMP rather than EXIF", join(start, segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00"), withEXIF[2:]), true, ""},
+        {"after other segments and fill bytes", join(start, segment(0xE0, "JFIF\x00 and so on"), []byte{0xFF, 0xFF}, withEXIF[2:]), true, ""},
+        {"after the image data starts", join(start, segment(0xDA, "scan"), withEXIF[2:]), false, ""},
+        {"segment longer than the file", join(start, segment(0xE1, "Exif\x00\x00")[:6]), false, "truncated segment"},
+        {"segment length below 2", join(start, []byte{0xFF, 0xE1, 0, 1}, withEXIF[2:]), false, "truncated segment"},
+        {"broken EXIF", join(start, segment(0xE1, "Exif\x00\x00II*\x00\xff\xff\xff\xff")), false, "bad directory offset"},
+    }
+    for _, test := range tests {
+        myEXIF, err := readJPEGEXIF(test.data)
+        if len(test.message) > 0 {
+            if err == nil || !strings.Contains(err.Error(), test.message) {
+                t.Errorf("%s: got %v, want an error about %q", test.name, err, test.message)
+            }
+            continue
+        }
+        if err != nil || (myEXIF != nil) != test.found {
+            t.Errorf("%s: got %v, %v, want EXIF data: %v", test.name, myEXIF, err, test.found)
+        }
+    }
+
+    // Cut anywhere, the JPEG has to give an error or no EXIF data, and never panic
+    for length := 0; length < len(withEXIF); length++ {
+        func() {
+            defer func() {
+                if problem := recover(); problem != nil {
+                    t.Fatalf("cut to %d bytes: %v", length, problem)
+                }
+            }()
+            myEXIF, err := readJPEGEXIF(withEXIF[:length])
+            if err == nil && myEXIF != nil && length < 2 + 4 + 6 + len(tiff) {
+                t.Errorf("cut to %d bytes, inside the EXIF segment, still has EXIF data", length)
+            }
+        }()
+    }
+}
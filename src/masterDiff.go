@@ -0,0 +1,198 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "image/png"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+// How much a finished image differs from its original. Errors are on the 0-255 scale over all four
+// premultiplied channels, so a pixel turning transparent counts as much as one turning black.
+type diffSummary struct {
+    Width int `json:"width"`
+    Height int `json:"height"`
+    MeanAbsoluteError float64 `json:"meanAbsoluteError"`
+    MaxError float64 `json:"maxError"`
+    // In dB, null when the images are identical
+    PSNR *float64 `json:"psnr"`
+    ChangedPixels int `json:"changedPixels"`
+}
+
+// Far more than it takes to turn the smallest change of an 8 bit channel into the largest
+const maxDiffGain = 1000
+
+// ?id=... returns a heatmap of how much every pixel of the result differs from the original, dark
+// where nothing changed through red to yellow and white for the largest possible change. ?gain=...
+// (up to maxDiffGain) multiplies the differences to make small ones visible. The summary comes along in X-Diff-*
+// headers, or on its own as JSON with ?summary=true. Animations are compared by their first frame.
+func getDiff(w http.ResponseWriter, r *http.Request)  {
+    if r.Method == http.MethodGet {
+        values, err := url.ParseQuery(r.URL.RawQuery)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(values.Get("id")) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input.")
+            return
+        }
+        gain := 1.0
+        if len(values.Get("gain")) > 0 {
+            gain, err = strconv.ParseFloat(values.Get("gain"), 64)
+            if err != nil || math.IsNaN(gain) || gain <= 0 || gain > maxDiffGain {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprintf(w, "Wrong input gain: must be a positive number up to %d", maxDiffGain)
+                return
+            }
+        }
+
+        myTask, err := getTask(values.Get("id"))
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        if myTask.State != 2 {
+            w.WriteHeader(http.StatusConflict)
+            fmt.Fprint(w, "Error 🚫: Task isn't finished.")
+            return
+        }
+        if textOutputs[myTask.Output.Format] {
+            w.WriteHeader(http.StatusUnprocessableEntity)
+            fmt.Fprint(w, "Error 🚫: Can't compare, the result is ", myTask.Output.Format, " rather than an image.")
+            return
+        }
+
+        original, err := getStoredImage(values.Get("id"), "working")
+        if err != nil {
+            w.WriteHeader(http.StatusBadGateway)
+            fmt.Fprint(w, "Error 🚫: ", err)
+            return
+        }
+        result, err := getStoredImage(values.Get("id"), "finished")
+        if err != nil {
+            w.WriteHeader(http.StatusBadGateway)
+            fmt.Fprint(w, "Error 🚫: ", err)
+            return
+        }
+        if original.Bounds().Dx() != result.Bounds().Dx() || original.Bounds().Dy() != result.Bounds().Dy() {
+            w.WriteHeader(http.StatusUnprocessableEntity)
+            fmt.Fprintf(w, "Error 🚫: Can't compare, the original is %dx%d but the result is %dx%d.", original.Bounds().Dx(), original.Bounds().Dy(), result.Bounds().Dx(), result.Bounds().Dy())
+            return
+        }
+
+        heatmap, summary := diffImages(original, result, gain)
+        if values.Get("summary") == "true" {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(summary)
+            return
+        }
+
+        psnr := "inf"
+        if summary.PSNR != nil {
+            psnr = strconv.FormatFloat(*summary.PSNR, 'f', 2, 64)
+        }
+        w.Header().Set("X-Diff-MAE", strconv.FormatFloat(summary.MeanAbsoluteError, 'f', 4, 64))
+        w.Header().Set("X-Diff-Max", strconv.FormatFloat(summary.MaxError, 'f', 0, 64))
+        w.Header().Set("X-Diff-PSNR", psnr)
+        w.Header().Set("X-Diff-Changed-Pixels", strconv.Itoa(summary.ChangedPixels))
+        w.Header().Set("Content-Type", "image/png")
+        err = png.Encode(w, heatmap)
+        if err != nil {
+            fmt.Println("Error:", err)
+        }
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error 🚫: Only GET accepted.")
+    }
+}
+
+// Fetch and decode an image from storage, after checking it against the size limits like an upload.
+// Photos are turned upright by their EXIF orientation, like workers do before filtering them.
+func getStoredImage(id string, state string) (image.Image, error) {
+    response, err := http.Get("http://" + storageLocation + "/getImage?state=" + state + "&id=" + url.QueryEscape(id))
+    if err != nil {
+        return nil, err
+    }
+    data, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return nil, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s", data)
+    }
+
+    limits, err := loadImageLimits(kVStoreLocation)
+    if err != nil {
+        return nil, err
+    }
+    _, _, err = checkImageData(data, limits)
+    if err != nil {
+        return nil, err
+    }
+    myImage, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    return orientImage(myImage, imageOrientation(data)), nil
+}
+
+// Compare two images of the same size pixel by pixel. The heatmap shows the mean difference over
+// the channels of every pixel, times gain.
+func diffImages(original image.Image, result image.Image, gain float64) (*image.RGBA, diffSummary) {
+    originalBounds, resultBounds := original.Bounds(), result.Bounds()
+    width, height := originalBounds.Dx(), originalBounds.Dy()
+    heatmap := image.NewRGBA(image.Rect(0, 0, width, height))
+    summary := diffSummary{Width: width, Height: height}
+
+    var absoluteSum, squaredSum float64
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            r1, g1, b1, a1 := original.At(originalBounds.Min.X + x, originalBounds.Min.Y + y).RGBA()
+            r2, g2, b2, a2 := result.At(resultBounds.Min.X + x, resultBounds.Min.Y + y).RGBA()
+
+            pixelSum := 0.0
+            for _, pair := range [4][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}, {a1, a2}} {
+                // Compared at 8 bits, JPEG originals decode to more precision than any result keeps
+                delta := math.Abs(float64(pair[0] >> 8) - float64(pair[1] >> 8))
+                pixelSum += delta
+                squaredSum += delta * delta
+                summary.MaxError = math.Max(summary.MaxError, delta)
+            }
+            absoluteSum += pixelSum
+            if pixelSum > 0 {
+                summary.ChangedPixels++
+            }
+            heatmap.SetRGBA(x, y, heatColor(pixelSum / 4 / 255 * gain))
+        }
+    }
+
+    channels := float64(4 * width * height)
+    if channels > 0 {
+        summary.MeanAbsoluteError = absoluteSum / channels
+        if meanSquared := squaredSum / channels; meanSquared > 0 {
+            psnr := 10 * math.Log10(255 * 255 / meanSquared)
+            summary.PSNR = &psnr
+        }
+    }
+    return heatmap, summary
+}
+
+// Black at 0, through dark red, red and yellow to white at 1.
+func heatColor(value float64) color.RGBA {
+    value = math.Max(0, math.Min(1, value))
+    channel := func(start float64) uint8 {
+        return uint8(255 * math.Max(0, math.Min(1, (value - start) * 3)) + 0.5)
+    }
+    return color.RGBA{channel(0), channel(1.0 / 3), channel(2.0 / 3), 0xff}
+}
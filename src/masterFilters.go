@@ -0,0 +1,120 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strings"
+)
+
+// What /new answers when the pipeline doesn't fit the filters: every problem found, so a client
+// can point at the parameter, with the first one as the message.
+type paramErrorResponse struct {
+    Error string `json:"error"`
+    Errors []paramError `json:"errors"`
+}
+
+// Lists every filter the workers have, plugins included, with the name, type, range and default
+// of each parameter, as JSON sorted by name.
+func getFilters(w http.ResponseWriter, r *http.Request)  {
+    if r.Method == http.MethodGet {
+        schemas, err := loadFilterSchemas(kVStoreLocation)
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprint(w, "Error 🚫: ", err)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(sortedFilterSchemas(schemas))
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error 🚫: Only GET accepted.")
+    }
+}
+
+// The built-in filters and the plugins workers published in the key-value store, one key each.
+// Plugins are read every time, so workers started with new ones are picked up right away.
+func loadFilterSchemas(kVStoreAddress string) (map[string]filterSchema, error) {
+    response, err := http.Get("http://" + kVStoreAddress + "/list")
+    if err != nil {
+        return nil, err
+    }
+    data, err := ioutil.ReadAll(response.Body)
+    response.Body.Close()
+    if err != nil {
+        return nil, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Can't list the plugins: %s", data)
+    }
+
+    schemas := map[string]filterSchema{}
+    for name, schema := range filterSchemas {
+        schemas[name] = schema
+    }
+    // /list gives a "key : value" line per key
+    for _, line := range strings.Split(string(data), "\n") {
+        entry := strings.SplitN(line, " : ", 2)
+        if len(entry) != 2 || !strings.HasPrefix(entry[0], pluginSchemaPrefix) {
+            continue
+        }
+        plugin := filterSchema{}
+        err = json.Unmarshal([]byte(entry[1]), &plugin)
+        if err != nil {
+            return nil, fmt.Errorf("%s is not a filter: %v", entry[0], err)
+        }
+        // Workers never load a plugin under the name of a built-in filter
+        if _, exists := schemas[plugin.Name]; !exists {
+            schemas[plugin.Name] = plugin
+        }
+    }
+    return schemas, nil
+}
+
+// Check every step of the task's pipeline against the filter schemas, and that the parameter an
+// animation sweeps is a number of its step.
+func checkTaskParams(myTask Task) ([]paramError, error) {
+    schemas, err := loadFilterSchemas(kVStoreLocation)
+    if err != nil {
+        return nil, err
+    }
+    myErrors := []paramError{}
+    for i, step := range myTask.Pipeline {
+        myErrors = append(myErrors, checkStepParams(schemas, i, step.Filter, step.Params, myTask.Inputs)...)
+    }
+    if len(myErrors) > 0 || len(myTask.Animate.Param) == 0 {
+        return myErrors, nil
+    }
+
+    step := myTask.Pipeline[myTask.Animate.Step]
+    filter := step.Filter
+    if len(filter) == 0 {
+        filter = defaultFilter
+    }
+    for _, param := range schemas[filter].Params {
+        if param.Name == myTask.Animate.Param && (param.Type == "number" || param.Type == "integer") {
+            // Every frame gets a value between the two ends, so they're all in range when the ends are
+            ends := []struct {
+                Key string
+                Number float64
+            }{{"animateFrom", myTask.Animate.From}, {"animateTo", myTask.Animate.To}}
+            for _, end := range ends {
+                if message := checkParamRange(param, end.Number); len(message) > 0 {
+                    myErrors = append(myErrors, paramError{Step: myTask.Animate.Step, Filter: filter, Param: param.Name, Message: end.Key + " " + message})
+                }
+            }
+            return myErrors, nil
+        }
+    }
+    return []paramError{{Step: myTask.Animate.Step, Filter: filter, Param: myTask.Animate.Param, Message: "animateParam must be a number parameter of the step"}}, nil
+}
+
+func writeParamErrors(w http.ResponseWriter, myErrors []paramError) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusBadRequest)
+    json.NewEncoder(w).Encode(paramErrorResponse{
+        Error: "Wrong input pipeline: " + myErrors[0].Error(),
+        Errors: myErrors,
+    })
+}
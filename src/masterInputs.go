@@ -0,0 +1,238 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// How many images one task can be given, and a batch task
+const maxUploads = 16
+const maxBatchUploads = 256
+
+// All uploads of a task are held in memory until they're stored, so the whole body can be at most
+// this many times the size of one file
+const maxUploadFiles = 4
+
+// The part of a multipart upload that is the task's image, every other part is an input the
+// filters can use by its name
+const mainUpload = "image"
+
+// An image uploaded to /new, with the name the pipeline knows it by. Inputs are stored by that name,
+// the task's own image by the task ID alone.
+type upload struct {
+    Name string
+    Data []byte
+    Format string
+    Input bool
+}
+
+// A plain body is the task's image, as it always was. A multipart/form-data body carries the image
+// as the "image" part and any other images as parts named after the input (letters and digits), e.g.
+// curl -F image=@cat.png -F texture=@paper.jpg. The task's image always comes first. A batch task
+// has no image of its own, every part is an input, in the order they were sent. No file can be
+// bigger than an image within the limits could be, they're cut off before they're read in full.
+func readUploads(w http.ResponseWriter, r *http.Request, batch bool, limits imageLimits) ([]upload, error) {
+    maxBytes := limits.maxFileBytes()
+    r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadFiles) * int64(maxBytes))
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != "multipart/form-data" {
+        data, err := readUpload(r.Body, mainUpload, maxBytes)
+        if err != nil {
+            return nil, err
+        }
+        return []upload{{Name: mainUpload, Data: data, Input: batch}}, nil
+    }
+
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return nil, err
+    }
+    uploads := []upload{{}}
+    limit := maxUploads
+    if batch {
+        uploads, limit = []upload{}, maxBatchUploads
+    }
+    seen := map[string]bool{}
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, uploadError(err, maxUploadFiles * maxBytes)
+        }
+        name := part.FormName()
+        if !validName(name) {
+            return nil, fmt.Errorf("Wrong input %q: upload names are letters and digits", name)
+        }
+        if seen[name] {
+            return nil, fmt.Errorf("Wrong input %s: uploaded twice", name)
+        }
+        seen[name] = true
+        if len(seen) > limit {
+            return nil, fmt.Errorf("Wrong input: at most %d images per task", limit)
+        }
+
+        data, err := readUpload(part, name, maxBytes)
+        if err != nil {
+            return nil, err
+        }
+        if name == mainUpload && !batch {
+            uploads[0] = upload{Name: name, Data: data}
+        } else {
+            uploads = append(uploads, upload{Name: name, Data: data, Input: true})
+        }
+    }
+    if batch && len(uploads) == 0 {
+        return nil, fmt.Errorf("Wrong input: a batch task needs images")
+    }
+    if !seen[mainUpload] && !batch {
+        return nil, fmt.Errorf("Wrong input: the task's image must be the %q part", mainUpload)
+    }
+    return uploads, nil
+}
+
+// An uploadTooLargeError means an upload, or all of them together, went over Limit bytes.
+type uploadTooLargeError struct {
+    Name string
+    Limit int
+}
+
+func (myError uploadTooLargeError) Error() string {
+    switch myError.Name {
+    case "":
+        return fmt.Sprintf("uploads are more than %d bytes together", myError.Limit)
+    case mainUpload:
+        return fmt.Sprintf("image is more than %d bytes", myError.Limit)
+    }
+    return fmt.Sprintf("image %s is more than %d bytes", myError.Name, myError.Limit)
+}
+
+// Read one upload, but not more than one byte past maxBytes.
+func readUpload(reader io.Reader, name string, maxBytes int) ([]byte, error) {
+    data, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxBytes) + 1))
+    if err != nil {
+        return nil, uploadError(err, maxUploadFiles * maxBytes)
+    }
+    if len(data) > maxBytes {
+        return nil, uploadTooLargeError{name, maxBytes}
+    }
+    return data, nil
+}
+
+// The body being cut off by http.MaxBytesReader becomes an uploadTooLargeError.
+func uploadError(err error, limit int) error {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        return uploadTooLargeError{"", limit}
+    }
+    return err
+}
+
+// ?batch=collage|mosaic makes a batch task out of all the uploads. A collage is a grid of
+// ?batchColumns columns (as square as possible by default) of ?batchCellSize pixel cells (16-2048,
+// 256 by default), ?batchSpacing pixels apart (0-512) on ?batchBackground (#rrggbb or #rrggbbaa,
+// white by default). A mosaic rebuilds the upload named ?batchTarget (the first by default) from
+// ?batchTileSize pixel squares (2-128, 16 by default) of the others, ?batchTint (0-1) of the way
+// towards the colour they replace.
+func batchFromQuery(values url.Values) (BatchOptions, error) {
+    batch := BatchOptions{
+        Layout: values.Get("batch"),
+        Background: values.Get("batchBackground"),
+        Target: values.Get("batchTarget"),
+    }
+    if len(batch.Layout) == 0 {
+        for key := range values {
+            if strings.HasPrefix(key, "batch") {
+                return batch, fmt.Errorf("Wrong input batch: must be collage or mosaic")
+            }
+        }
+        return batch, nil
+    }
+    if batch.Layout != "collage" && batch.Layout != "mosaic" {
+        return batch, fmt.Errorf("Wrong input batch: must be collage or mosaic")
+    }
+
+    integers := []struct {
+        Key string
+        Target *int
+        Min int
+        Max int
+    }{
+        {"batchColumns", &batch.Columns, 1, maxBatchUploads},
+        {"batchCellSize", &batch.CellSize, 16, 2048},
+        {"batchSpacing", &batch.Spacing, 0, 512},
+        {"batchTileSize", &batch.TileSize, 2, 128},
+    }
+    for _, integer := range integers {
+        if len(values.Get(integer.Key)) == 0 {
+            continue
+        }
+        value, err := strconv.Atoi(values.Get(integer.Key))
+        if err != nil || value < integer.Min || value > integer.Max {
+            return batch, fmt.Errorf("Wrong input %s: must be between %d and %d", integer.Key, integer.Min, integer.Max)
+        }
+        *integer.Target = value
+    }
+    if len(values.Get("batchTint")) > 0 {
+        var err error
+        batch.Tint, err = strconv.ParseFloat(values.Get("batchTint"), 64)
+        if err != nil || batch.Tint < 0 || batch.Tint > 1 {
+            return batch, fmt.Errorf("Wrong input batchTint: must be between 0 and 1")
+        }
+    }
+
+    if len(batch.Background) > 0 {
+        hex := strings.TrimPrefix(batch.Background, "#")
+        _, err := strconv.ParseUint(hex, 16, 32)
+        if err != nil || (len(hex) != 3 && len(hex) != 6 && len(hex) != 8) {
+            return batch, fmt.Errorf("Wrong input batchBackground: must be #rgb, #rrggbb or #rrggbbaa")
+        }
+    }
+    return batch, nil
+}
+
+// What a batch task needs of its uploads: a mosaic has a target among them and something to build
+// it from.
+func checkBatchInputs(myTask Task) error {
+    if myTask.Batch.Layout != "mosaic" {
+        return nil
+    }
+    if len(myTask.Inputs) < 2 {
+        return fmt.Errorf("Wrong input: a mosaic needs a target and at least one image to build it from")
+    }
+    if len(myTask.Batch.Target) == 0 {
+        return nil
+    }
+    for _, name := range myTask.Inputs {
+        if name == myTask.Batch.Target {
+            return nil
+        }
+    }
+    return fmt.Errorf("Wrong input batchTarget: no image named %q was uploaded", myTask.Batch.Target)
+}
+
+// Hand an upload to storage. The task's image is stored under the task ID, the others by name next to it.
+func storeUpload(id string, myUpload upload) error {
+    query := "?id=" + url.QueryEscape(id) + "&state=working&format=" + myUpload.Format
+    if myUpload.Input {
+        query += "&name=" + url.QueryEscape(myUpload.Name)
+    }
+    response, err := http.Post("http://" + storageLocation + "/sendImage" + query, "image/" + myUpload.Format, bytes.NewReader(myUpload.Data))
+    if err != nil {
+        return err
+    }
+    if response.StatusCode != http.StatusOK {
+        data, _ := ioutil.ReadAll(response.Body)
+        return fmt.Errorf("Can't store image %s: %s", myUpload.Name, data)
+    }
+    return nil
+}
@@ -8,15 +8,68 @@ import (
     "io"
     "encoding/json"
     "net/url"
+    "bytes"
+    "strconv"
+    "math"
+    "strings"
+    "unicode/utf8"
 )
 
 type Task struct {
     ID int `json:"id"`
     State int `json:"state"`
+    Pipeline []PipelineStep `json:"pipeline"`
+    Format string `json:"format"`
+    Output OutputOptions `json:"output"`
+    Animate AnimateOptions `json:"animate"`
+    // Names of the other images uploaded with the task
+    Inputs []string `json:"inputs,omitempty"`
+    Batch BatchOptions `json:"batch"`
+    Error string `json:"error,omitempty"`
+}
+
+// How the worker encodes the finished image
+type OutputOptions struct {
+    Format string `json:"format"`
+    Quality int `json:"quality,omitempty"`
+    Compression string `json:"compression,omitempty"`
+    PaletteSize int `json:"paletteSize,omitempty"`
+    Width int `json:"width,omitempty"`
+    Ramp string `json:"ramp,omitempty"`
+    // EXIF field groups to carry over from the original
+    Metadata []string `json:"metadata,omitempty"`
+}
+
+// Turns the task into an animation by sweeping one parameter of one pipeline step
+type AnimateOptions struct {
+    Frames int `json:"frames,omitempty"`
+    Delay int `json:"delay,omitempty"`
+    Step int `json:"step,omitempty"`
+    Param string `json:"param,omitempty"`
+    From float64 `json:"from,omitempty"`
+    To float64 `json:"to,omitempty"`
+}
+
+// Makes one image out of all the uploads of a batch task
+type BatchOptions struct {
+    Layout string `json:"layout,omitempty"`
+    Columns int `json:"columns,omitempty"`
+    CellSize int `json:"cellSize,omitempty"`
+    Spacing int `json:"spacing,omitempty"`
+    Background string `json:"background,omitempty"`
+    Target string `json:"target,omitempty"`
+    TileSize int `json:"tileSize,omitempty"`
+    Tint float64 `json:"tint,omitempty"`
+}
+
+type PipelineStep struct {
+    Filter string `json:"filter"`
+    Params map[string]interface{} `json:"params"`
 }
 
 var databaseLocation string
 var storageLocation string
+var kVStoreLocation string
 
 func main()  {
     // Register in database
@@ -28,6 +81,7 @@ func main()  {
     // (after getting them in registerInKVStore)
     // This is to allow access to these addresses via lexical scope from our route handlers
     kVStoreAddress := os.Args[2]
+    kVStoreLocation = kVStoreAddress
 
     response, err := http.Get("http://" + kVStoreAddress + "/get?key=databaseAddress")
     if response.StatusCode != http.StatusOK {
@@ -62,36 +116,127 @@ func main()  {
     // for those microservices
     http.HandleFunc("/new", newImage)
     http.HandleFunc("/get", getImage)
+    http.HandleFunc("/getPreview", getPreview)
+    http.HandleFunc("/diff", getDiff)
+    http.HandleFunc("/filters", getFilters)
     http.HandleFunc("/isReady", isReady)
     http.HandleFunc("/getNewTask", getNewTask)
     http.HandleFunc("/registerTaskFinished", registerTaskFinished)
+    http.HandleFunc("/registerTaskFailed", registerTaskFailed)
     fmt.Println("masterService is up! 😜")
     http.ListenAndServe(":3003", nil)
 }
 
 func newImage(w http.ResponseWriter, r *http.Request)  {
     if r.Method == http.MethodPost {
-        response, err := http.Post("http://" + databaseLocation + "/newTask", "text/plain", nil)
+        values, err := url.ParseQuery(r.URL.RawQuery)
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
 
-        id, err := ioutil.ReadAll(response.Body)
+        taskToAdd, err := taskFromQuery(values)
         if err != nil {
-            fmt.Println(err)
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
             return
         }
 
-        // Make call to storage microservice with image data
-        // Which saves a temp copy of the image file as .png
-        _, err = http.Post("http://" + storageLocation + "/sendImage?id=" + string(id) + "&state=working", "image", r.Body)
+        limits, err := loadImageLimits(kVStoreLocation)
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprint(w, "Error 🚫: ", err)
+            return
+        }
+        // Sniff the uploads before creating a task for them, anything we can't decode is turned away here
+        uploads, err := readUploads(w, r, len(taskToAdd.Batch.Layout) > 0, limits)
+        if tooLarge, ok := err.(uploadTooLargeError); ok {
+            w.WriteHeader(http.StatusRequestEntityTooLarge)
+            fmt.Fprint(w, "Error 🚫: ", tooLarge)
+            return
+        }
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
+        // Only the header is read, so an image too large to decode is rejected before anybody tries
+        for i := range uploads {
+            label, unsupported := "Image", "Not a supported image"
+            if uploads[i].Input {
+                label = "Image " + uploads[i].Name
+                unsupported = label + " is not a supported image"
+                taskToAdd.Inputs = append(taskToAdd.Inputs, uploads[i].Name)
+            }
+            _, format, err := checkImageData(uploads[i].Data, limits)
+            if tooLarge, ok := err.(imageTooLargeError); ok {
+                w.WriteHeader(http.StatusRequestEntityTooLarge)
+                fmt.Fprint(w, "Error 🚫: ", label, " rejected: ", tooLarge)
+                return
+            }
+            if err != nil {
+                w.WriteHeader(http.StatusUnsupportedMediaType)
+                fmt.Fprint(w, "Error 🚫: ", unsupported, " (PNG, JPEG, GIF, BMP or TIFF): ", err)
+                return
+            }
+            uploads[i].Format = format
+        }
+        taskToAdd.Format = uploads[0].Format
+        err = checkBatchInputs(taskToAdd)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        // Parameters are checked against the filter schemas now, rather than failing the task later
+        paramErrors, err := checkTaskParams(taskToAdd)
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprint(w, "Error 🚫: ", err)
+            return
+        }
+        if len(paramErrors) > 0 {
+            writeParamErrors(w, paramErrors)
+            return
+        }
+
+        taskData, err := json.Marshal(taskToAdd)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+
+        response, err := http.Post("http://" + databaseLocation + "/newTask", "application/json", bytes.NewReader(taskData))
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+
+        id, err := ioutil.ReadAll(response.Body)
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+        if response.StatusCode != http.StatusOK {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, string(id))
+            return
+        }
+
+        // Make calls to storage microservice with image data, which saves a temp copy of every image
+        // file with the extension of its format. The task's own image goes last, a worker starts
+        // with it and then expects the others to be there.
+        for i := len(uploads) - 1; i >= 0; i-- {
+            err = storeUpload(string(id), uploads[i])
+            if err != nil {
+                w.WriteHeader(http.StatusBadGateway)
+                fmt.Fprint(w, "Error 🚫: ", err)
+                return
+            }
+        }
         fmt.Fprint(w, string(id))
     } else {
         w.WriteHeader(http.StatusBadRequest)
@@ -99,6 +244,213 @@ func newImage(w http.ResponseWriter, r *http.Request)  {
     }
 }
 
+// Query values that describe the task itself rather than a filter parameter
+var taskQueryKeys = map[string]bool{
+    "filter": true,
+    "pipeline": true,
+    "output": true,
+    "outputQuality": true,
+    "outputCompression": true,
+    "outputPaletteSize": true,
+    "outputWidth": true,
+    "outputRamp": true,
+    "metadata": true,
+    "metadataFields": true,
+    "animateFrames": true,
+    "animateDelay": true,
+    "animateStep": true,
+    "animateParam": true,
+    "animateFrom": true,
+    "animateTo": true,
+    "batch": true,
+    "batchColumns": true,
+    "batchCellSize": true,
+    "batchSpacing": true,
+    "batchBackground": true,
+    "batchTarget": true,
+    "batchTileSize": true,
+    "batchTint": true,
+}
+
+// ?pipeline=[{"filter": "...", "params": {...}}, ...] gives the whole chain of filters as JSON.
+// As a shorthand ?filter=name makes a single step pipeline, with every other query value handed to
+// the filter as a parameter. The output, animation and batch options are read by outputFromQuery,
+// animateFromQuery and batchFromQuery. A batch task without a filter or pipeline has no pipeline,
+// its result is the assembled image.
+func taskFromQuery(values url.Values) (Task, error) {
+    myTask := Task{}
+    output, err := outputFromQuery(values)
+    if err != nil {
+        return myTask, err
+    }
+    myTask.Output = output
+    myTask.Batch, err = batchFromQuery(values)
+    if err != nil {
+        return myTask, err
+    }
+
+    if len(values.Get("pipeline")) > 0 {
+        err := json.Unmarshal([]byte(values.Get("pipeline")), &myTask.Pipeline)
+        if err != nil {
+            return myTask, fmt.Errorf("Wrong input pipeline: %v", err)
+        }
+    } else {
+        step := PipelineStep{
+            Filter: values.Get("filter"),
+            Params: map[string]interface{}{},
+        }
+        for key := range values {
+            if taskQueryKeys[key] {
+                continue
+            }
+            step.Params[key] = values.Get(key)
+        }
+        myTask.Pipeline = []PipelineStep{step}
+        if len(myTask.Batch.Layout) > 0 && len(step.Filter) == 0 {
+            myTask.Pipeline = nil
+        }
+    }
+
+    myTask.Animate, err = animateFromQuery(values, len(myTask.Pipeline))
+    if err != nil {
+        return myTask, err
+    }
+    return myTask, nil
+}
+
+// ?animateFrames=N (2-300) turns a still image into an N frame animated GIF, ?animateDelay is the time
+// per frame in 100ths of a second (10 by default). Over the frames ?animateParam of pipeline step
+// ?animateStep (0 by default) goes from ?animateFrom to ?animateTo, rounded to whole numbers when
+// both ends are. For an animated upload the sweep is spread over its own frames instead.
+func animateFromQuery(values url.Values, steps int) (AnimateOptions, error) {
+    animate := AnimateOptions{Param: values.Get("animateParam")}
+    if len(animate.Param) == 0 {
+        for key := range values {
+            if strings.HasPrefix(key, "animate") {
+                return animate, fmt.Errorf("Wrong input animateParam: which parameter to animate is required")
+            }
+        }
+        return animate, nil
+    }
+
+    integers := map[string]*int{"animateFrames": &animate.Frames, "animateDelay": &animate.Delay, "animateStep": &animate.Step}
+    for key, target := range integers {
+        if len(values.Get(key)) == 0 {
+            continue
+        }
+        value, err := strconv.Atoi(values.Get(key))
+        if err != nil {
+            return animate, fmt.Errorf("Wrong input %s: not a whole number", key)
+        }
+        *target = value
+    }
+    numbers := map[string]*float64{"animateFrom": &animate.From, "animateTo": &animate.To}
+    for key, target := range numbers {
+        value, err := strconv.ParseFloat(values.Get(key), 64)
+        if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+            return animate, fmt.Errorf("Wrong input %s: a number is required", key)
+        }
+        *target = value
+    }
+
+    if len(values.Get("animateFrames")) > 0 && (animate.Frames < 2 || animate.Frames > 300) {
+        return animate, fmt.Errorf("Wrong input animateFrames: must be between 2 and 300")
+    }
+    if animate.Delay < 0 {
+        return animate, fmt.Errorf("Wrong input animateDelay: can't be negative")
+    }
+    if animate.Step < 0 || animate.Step >= steps {
+        return animate, fmt.Errorf("Wrong input animateStep: the pipeline has %d steps", steps)
+    }
+    return animate, nil
+}
+
+// ?output=png|jpeg|gif picks the format of the finished image (png by default), with
+// ?outputCompression=default|none|speed|best for PNG, ?outputQuality=1-100 for JPEG and
+// ?outputPaletteSize=2-256 for GIF. ?output=text|ansi|html renders the image as characters
+// instead, ?outputWidth=1-1000 characters wide (80 by default) using ?outputRamp (ascii, blocks or
+// the characters themselves, darkest first).
+func outputFromQuery(values url.Values) (OutputOptions, error) {
+    output := OutputOptions{
+        Format: values.Get("output"),
+        Compression: values.Get("outputCompression"),
+        Ramp: values.Get("outputRamp"),
+    }
+    if len(output.Format) == 0 {
+        output.Format = "png"
+    }
+
+    var err error
+    if len(values.Get("outputQuality")) > 0 {
+        output.Quality, err = strconv.Atoi(values.Get("outputQuality"))
+        if err != nil || output.Quality < 1 || output.Quality > 100 {
+            return output, fmt.Errorf("Wrong input outputQuality: must be between 1 and 100")
+        }
+    }
+    if len(values.Get("outputPaletteSize")) > 0 {
+        output.PaletteSize, err = strconv.Atoi(values.Get("outputPaletteSize"))
+        if err != nil || output.PaletteSize < 2 || output.PaletteSize > 256 {
+            return output, fmt.Errorf("Wrong input outputPaletteSize: must be between 2 and 256")
+        }
+    }
+
+    if len(values.Get("outputWidth")) > 0 {
+        output.Width, err = strconv.Atoi(values.Get("outputWidth"))
+        if err != nil || output.Width < 1 || output.Width > 1000 {
+            return output, fmt.Errorf("Wrong input outputWidth: must be between 1 and 1000")
+        }
+    }
+
+    if len(output.Ramp) > 0 && output.Ramp != "ascii" && output.Ramp != "blocks" && utf8.RuneCountInString(output.Ramp) < 2 {
+        return output, fmt.Errorf("Wrong input outputRamp: must be ascii, blocks or at least two characters")
+    }
+
+    switch output.Format {
+    case "png", "jpeg", "gif", "text", "ansi", "html":
+    default:
+        return output, fmt.Errorf("Wrong input output: must be png, jpeg, gif, text, ansi or html")
+    }
+    switch output.Compression {
+    case "", "default", "none", "speed", "best":
+    default:
+        return output, fmt.Errorf("Wrong input outputCompression: must be default, none, speed or best")
+    }
+
+    output.Metadata, err = metadataFromQuery(values)
+    return output, err
+}
+
+// Results carry no metadata unless ?metadata=keep (?metadata=strip is the default). Then the EXIF
+// fields of a JPEG upload go into a JPEG or PNG result, the groups in ?metadataFields (camera, date,
+// author, exposure, gps or all) or all but gps when it's not given.
+func metadataFromQuery(values url.Values) ([]string, error) {
+    switch values.Get("metadata") {
+    case "", "strip":
+        if len(values.Get("metadataFields")) > 0 {
+            return nil, fmt.Errorf("Wrong input metadataFields: only with metadata=keep")
+        }
+        return nil, nil
+    case "keep":
+    default:
+        return nil, fmt.Errorf("Wrong input metadata: must be strip or keep")
+    }
+    if len(values.Get("metadataFields")) == 0 {
+        return defaultMetadataGroups, nil
+    }
+
+    groups := strings.Split(values.Get("metadataFields"), ",")
+    for _, group := range groups {
+        if _, ok := metadataGroups[group]; !ok && group != "all" {
+            return nil, fmt.Errorf("Wrong input metadataFields: %q is not camera, date, author, exposure, gps or all", group)
+        }
+    }
+    return groups, nil
+}
+
+// Output formats that turn the image into text
+var textOutputs = map[string]bool{"text": true, "ansi": true, "html": true}
+
+// Results come with the content type storage has for them, text/plain or text/html for text output
 func getImage(w http.ResponseWriter, r *http.Request)  {
     if r.Method == http.MethodGet {
         values, err := url.ParseQuery(r.URL.RawQuery)
@@ -112,6 +464,24 @@ func getImage(w http.ResponseWriter, r *http.Request)  {
             return
         }
 
+        // A failed task has no image, tell the client why instead
+        myTask, err := getTask(values.Get("id"))
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        switch myTask.State {
+        case 3:
+            w.WriteHeader(http.StatusUnprocessableEntity)
+            fmt.Fprint(w, "Error 🚫: Task failed: ", myTask.Error)
+            return
+        case 4:
+            w.WriteHeader(http.StatusRequestEntityTooLarge)
+            fmt.Fprint(w, "Error 🚫: Task rejected: ", myTask.Error)
+            return
+        }
+
         response, err := http.Get("http://" + storageLocation + "/getImage?id=" + values.Get("id") + "&state=finished")
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
@@ -120,12 +490,74 @@ func getImage(w http.ResponseWriter, r *http.Request)  {
         }
 
         // Copy over response to client
+        w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+        w.WriteHeader(response.StatusCode)
         _, err = io.Copy(w, response.Body)
+        if err != nil {
+            fmt.Println("Error:", err)
+            return
+        }
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error 🚫: Only GET accepted.")
+    }
+}
+
+// The longest side of the previews workers make of every finished task
+var previewSizes = []string{"128", "512"}
+
+// ?id=...&size=128|512&of=original|result, the size defaulting to 128 and of to the result. Previews
+// are written when the task finishes, until then there's none.
+func getPreview(w http.ResponseWriter, r *http.Request)  {
+    if r.Method == http.MethodGet {
+        values, err := url.ParseQuery(r.URL.RawQuery)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(values.Get("id")) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input.")
+            return
+        }
+        size := values.Get("size")
+        if len(size) == 0 {
+            size = previewSizes[0]
+        }
+        validSize := false
+        for _, previewSize := range previewSizes {
+            validSize = validSize || size == previewSize
+        }
+        if !validSize {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input size: must be ", strings.Join(previewSizes, " or "))
+            return
+        }
+        of := values.Get("of")
+        if len(of) == 0 {
+            of = "result"
+        }
+        if of != "original" && of != "result" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input of: must be original or result")
+            return
+        }
+
+        response, err := http.Get("http://" + storageLocation + "/getImage?state=previews&id=" + url.QueryEscape(values.Get("id")) + "&size=" + size + "&of=" + of)
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
+
+        w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+        w.WriteHeader(response.StatusCode)
+        _, err = io.Copy(w, response.Body)
+        if err != nil {
+            fmt.Println("Error:", err)
+            return
+        }
     } else {
         w.WriteHeader(http.StatusBadRequest)
         fmt.Fprint(w, "Error 🚫: Only GET accepted.")
@@ -147,25 +579,23 @@ func isReady(w http.ResponseWriter, r *http.Request)  {
 
         // Verify all the parameterss and request method
         // Asking databse for the Task requested
-        response, err := http.Get("http://" + databaseLocation + "/getByID?id=" + values.Get("id"))
+        myTask, err := getTask(values.Get("id"))
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
-        data, err := ioutil.ReadAll(response.Body)
-        if err != nil {
-            fmt.Println(err)
-            return
-        }
 
-        // Parse task and respond to client
-        myTask := Task{}
-        json.Unmarshal(data, &myTask)
-
-        if (myTask.State == 2) {
+        // Respond to client: 1 when done, -1 when it failed, -2 when the image was rejected for
+        // being too large (see /get for why), 0 otherwise
+        switch myTask.State {
+        case 2:
             fmt.Fprint(w, "1")
-        } else {
+        case 3:
+            fmt.Fprint(w, "-1")
+        case 4:
+            fmt.Fprint(w, "-2")
+        default:
             fmt.Fprint(w, "0")
         }
     } else {
@@ -174,6 +604,25 @@ func isReady(w http.ResponseWriter, r *http.Request)  {
     }
 }
 
+// Ask the database for a task by its ID.
+func getTask(id string) (Task, error) {
+    myTask := Task{}
+    response, err := http.Get("http://" + databaseLocation + "/getByID?id=" + url.QueryEscape(id))
+    if err != nil {
+        return myTask, err
+    }
+    data, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return myTask, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return myTask, fmt.Errorf("%s", data)
+    }
+
+    err = json.Unmarshal(data, &myTask)
+    return myTask, err
+}
+
 // Part of worker interface
 func getNewTask(w http.ResponseWriter, r *http.Request)  {
     if r.Method == http.MethodPost {
@@ -184,11 +633,11 @@ func getNewTask(w http.ResponseWriter, r *http.Request)  {
             return
         }
 
-        // Copy task over to client
+        // Copy task over to client (or the database's "no task" answer along with its status)
+        w.WriteHeader(response.StatusCode)
         _, err = io.Copy(w, response.Body)
         if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, err)
+            fmt.Println("Error:", err)
             return
         }
     } else {
@@ -232,6 +681,39 @@ func registerTaskFinished(w http.ResponseWriter, r *http.Request)  {
     }
 }
 
+// Part of worker interface
+// The body is the reason the task can't be done, ?rejected=true when that's because the image is too large
+func registerTaskFailed(w http.ResponseWriter, r *http.Request)  {
+    if r.Method == http.MethodPost {
+        values, err := url.ParseQuery(r.URL.RawQuery)
+        if err != nil {
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(values.Get("id")) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input")
+            return
+        }
+
+        response, err := http.Post("http://" + databaseLocation + "/failTask?id=" + url.QueryEscape(values.Get("id")) + "&rejected=" + url.QueryEscape(values.Get("rejected")), "text/plain", r.Body)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Error:", err)
+            return
+        }
+
+        w.WriteHeader(response.StatusCode)
+        _, err = io.Copy(w, response.Body)
+        if err != nil {
+            fmt.Println("Error:", err)
+        }
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error 🚫: Only POST accepted.")
+    }
+}
+
 func registerInKVStore() bool {
     if len(os.Args) < 3 {
         fmt.Println("Error 🚫: Too few arguments.")
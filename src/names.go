@@ -0,0 +1,15 @@
+package main
+
+// Shared between masterService, storageService and workerService: the names clients and plugins
+// choose. Uploads are stored in files named after them and plugins become filters by theirs, so
+// every service has to agree on what a name can be.
+
+// Letters and digits only, 64 at most.
+func validName(name string) bool {
+    for _, char := range name {
+        if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9') {
+            return false
+        }
+    }
+    return len(name) > 0 && len(name) <= 64
+}
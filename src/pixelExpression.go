@@ -0,0 +1,664 @@
+package main
+
+// The little language of the expression filter. Shared between masterService, which compiles
+// expressions to turn away broken ones before a task is created, and workerService, which
+// compiles them once per step and runs them on every pixel.
+//
+// A program is a list of assignments separated by semicolons or new lines:
+//
+//     r = g; g = r; b = (x ^ y) & 255
+//
+// It can read x and y (from the top left), w and h (the size of the image), r, g, b and a (the
+// pixel, 0 to 255), t (a parameter of the step, for animations) and pi and e. r(x, y) and so on
+// read the pixel at x, y instead, clamped to the image. Assigning to r, g, b or a sets the channel
+// of the result, they keep reading the original pixel, which is why the example swaps red and
+// green. Any other name that's assigned is a variable for the statements after it.
+//
+// Operators are those of Python, with the same precedence, plus C's !, && and || and the
+// condition ? then : otherwise: ** binds tightest, then unary - + ! ~, * / %, + -, << >>, &, ^,
+// |, comparisons, && and ||. Comparisons and logic give 1 or 0, bitwise operators work on whole
+// numbers and % takes the sign of the divisor, so (x - y) % 256 wraps. There are no loops and no
+// way to reach anything but the pixels, so every program ends, and quickly.
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Longer programs and deeper nesting than this are turned away, so parsing stays cheap and the
+// recursion shallow
+const maxExpressionLength = 4096
+const maxExpressionDepth = 64
+
+// Where every program keeps the names it can read. The program's result and its variables follow.
+const (
+    exprSlotX = iota
+    exprSlotY
+    exprSlotWidth
+    exprSlotHeight
+    exprSlotTime
+    exprSlotRed
+    exprSlotGreen
+    exprSlotBlue
+    exprSlotAlpha
+    exprSlotResult
+    exprSlotVariables = exprSlotResult + 4
+)
+
+var exprNames = map[string]int{
+    "x": exprSlotX, "y": exprSlotY, "w": exprSlotWidth, "h": exprSlotHeight, "t": exprSlotTime,
+    "r": exprSlotRed, "g": exprSlotGreen, "b": exprSlotBlue, "a": exprSlotAlpha,
+}
+
+var exprConstants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// Functions take one, two or three numbers, whichever is set
+type exprFunction struct {
+    One func(float64) float64
+    Two func(float64, float64) float64
+    Three func(float64, float64, float64) float64
+}
+
+var exprFunctions = map[string]exprFunction{
+    "sin": {One: math.Sin},
+    "cos": {One: math.Cos},
+    "tan": {One: math.Tan},
+    "asin": {One: math.Asin},
+    "acos": {One: math.Acos},
+    "atan": {One: math.Atan},
+    "sqrt": {One: math.Sqrt},
+    "abs": {One: math.Abs},
+    "floor": {One: math.Floor},
+    "ceil": {One: math.Ceil},
+    "round": {One: math.Round},
+    "trunc": {One: math.Trunc},
+    "exp": {One: math.Exp},
+    "log": {One: math.Log},
+    "log2": {One: math.Log2},
+    "sign": {One: func(value float64) float64 {
+        if value > 0 {
+            return 1
+        }
+        if value < 0 {
+            return -1
+        }
+        return 0
+    }},
+    "atan2": {Two: math.Atan2},
+    "pow": {Two: math.Pow},
+    "hypot": {Two: math.Hypot},
+    "min": {Two: math.Min},
+    "max": {Two: math.Max},
+    "clamp": {Three: func(value float64, low float64, high float64) float64 {
+        return math.Max(low, math.Min(high, value))
+    }},
+    "mix": {Three: func(from float64, to float64, amount float64) float64 {
+        return from + (to - from) * amount
+    }},
+}
+
+// What a program works on: the slots (see above) and the pixels around.
+type exprState struct {
+    Slots []float64
+    // Channel 0 to 3 (r, g, b, a) of the pixel at x, y, 0 to 255
+    Sample func(x float64, y float64, channel int) float64
+}
+
+type exprFunc func(state *exprState) float64
+
+// A compiled expression, and whether it's the same for every pixel, so it can be worked out once
+type exprNode struct {
+    Eval exprFunc
+    Constant bool
+}
+
+type exprStatement struct {
+    Slot int
+    Eval exprFunc
+}
+
+type pixelProgram struct {
+    Statements []exprStatement
+    Slots int
+}
+
+// A mistake in a program, where it was found.
+type exprError struct {
+    Line int
+    Column int
+    Message string
+}
+
+func (myError exprError) Error() string {
+    return fmt.Sprintf("line %d, column %d: %s", myError.Line, myError.Column, myError.Message)
+}
+
+// Parse a program and turn it into functions, ready to run on every pixel.
+func compileExpression(source string) (*pixelProgram, error) {
+    if len(strings.TrimSpace(source)) == 0 {
+        return nil, fmt.Errorf("is empty")
+    }
+    if len(source) > maxExpressionLength {
+        return nil, fmt.Errorf("is longer than %d characters", maxExpressionLength)
+    }
+    tokens, err := lexExpression(source)
+    if err != nil {
+        return nil, err
+    }
+
+    myParser := &exprParser{Tokens: tokens, Variables: map[string]int{}, Slots: exprSlotVariables}
+    myProgram := &pixelProgram{}
+    for {
+        for myParser.peek().Kind == exprSeparator {
+            myParser.next()
+        }
+        if myParser.peek().Kind == exprEnd {
+            break
+        }
+
+        target := myParser.next()
+        if target.Kind != exprName {
+            return nil, myParser.fail(target, "expected an assignment like r = g, found %s", target.describe())
+        }
+        if equals := myParser.next(); equals.Text != "=" || equals.Kind != exprOperator {
+            return nil, myParser.fail(equals, "expected \"=\" after %s, found %s", target.Text, equals.describe())
+        }
+        node, err := myParser.parseExpression()
+        if err != nil {
+            return nil, err
+        }
+        if after := myParser.peek(); after.Kind != exprSeparator && after.Kind != exprEnd {
+            return nil, myParser.fail(after, "expected \";\" or a new line, found %s", after.describe())
+        }
+
+        // The variable exists from the next statement on, so x = x + 1 can't read it unset
+        slot, err := myParser.assignable(target)
+        if err != nil {
+            return nil, err
+        }
+        myProgram.Statements = append(myProgram.Statements, exprStatement{slot, node.Eval})
+    }
+    if len(myProgram.Statements) == 0 {
+        return nil, fmt.Errorf("has no assignments")
+    }
+    myProgram.Slots = myParser.Slots
+    return myProgram, nil
+}
+
+// Fresh slots for one goroutine to run the program in.
+func (myProgram *pixelProgram) newState(sample func(x float64, y float64, channel int) float64) *exprState {
+    return &exprState{Slots: make([]float64, myProgram.Slots), Sample: sample}
+}
+
+// Run the program on one pixel, whose coordinates and channels are in the state's slots. The
+// channels it didn't assign stay as they were.
+func (myProgram *pixelProgram) run(state *exprState) [4]float64 {
+    copy(state.Slots[exprSlotResult:exprSlotResult + 4], state.Slots[exprSlotRed:exprSlotRed + 4])
+    for _, statement := range myProgram.Statements {
+        state.Slots[statement.Slot] = statement.Eval(state)
+    }
+    return [4]float64(state.Slots[exprSlotResult:exprSlotResult + 4])
+}
+
+const (
+    exprEnd = iota
+    exprSeparator
+    exprNumber
+    exprName
+    exprOperator
+)
+
+type exprToken struct {
+    Kind int
+    Text string
+    Value float64
+    Line int
+    Column int
+}
+
+func (myToken exprToken) describe() string {
+    switch myToken.Kind {
+    case exprEnd:
+        return "the end"
+    case exprSeparator:
+        if myToken.Text == "\n" {
+            return "a new line"
+        }
+    }
+    return strconv.Quote(myToken.Text)
+}
+
+// Longest first, so << isn't read as two <
+var exprOperators = []string{"**", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "+", "-", "*", "/", "%", "&", "|", "^", "~", "!", "<", ">", "(", ")", ",", "?", ":", "="}
+
+func lexExpression(source string) ([]exprToken, error) {
+    tokens := []exprToken{}
+    runes := []rune(source)
+    line, lineStart := 1, 0
+    for i := 0; i < len(runes); {
+        char := runes[i]
+        column := i - lineStart + 1
+        switch {
+        case char == '\n' || char == ';':
+            tokens = append(tokens, exprToken{Kind: exprSeparator, Text: string(char), Line: line, Column: column})
+            i++
+            if char == '\n' {
+                line, lineStart = line + 1, i
+            }
+        case unicode.IsSpace(char):
+            i++
+        case char == '#':
+            // Comments run to the end of the line
+            for i < len(runes) && runes[i] != '\n' {
+                i++
+            }
+        case char >= '0' && char <= '9' || char == '.':
+            // Everything up to the next operator or space, checked as a whole, so 2x is an error
+            // rather than 2 times x. Only an exponent may have a sign in it.
+            start := i
+            for i < len(runes) && (runes[i] == '.' || runes[i] == '_' || runes[i] < unicode.MaxASCII && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) ||
+                (runes[i] == '+' || runes[i] == '-') && (runes[i - 1] == 'e' || runes[i - 1] == 'E') && !strings.HasPrefix(strings.ToLower(string(runes[start:i])), "0x")) {
+                i++
+            }
+            text := string(runes[start:i])
+            value, err := parseExprNumber(text)
+            if err != nil {
+                return nil, exprError{line, column, fmt.Sprintf("%q is not a number", text)}
+            }
+            tokens = append(tokens, exprToken{Kind: exprNumber, Text: text, Value: value, Line: line, Column: column})
+        case char == '_' || char < unicode.MaxASCII && unicode.IsLetter(char):
+            start := i
+            for i < len(runes) && (runes[i] == '_' || runes[i] < unicode.MaxASCII && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))) {
+                i++
+            }
+            tokens = append(tokens, exprToken{Kind: exprName, Text: string(runes[start:i]), Line: line, Column: column})
+        default:
+            found := false
+            for _, operator := range exprOperators {
+                if strings.HasPrefix(string(runes[i:min(i + 2, len(runes))]), operator) {
+                    tokens = append(tokens, exprToken{Kind: exprOperator, Text: operator, Line: line, Column: column})
+                    i += len(operator)
+                    found = true
+                    break
+                }
+            }
+            if !found {
+                return nil, exprError{line, column, fmt.Sprintf("unexpected %q", string(char))}
+            }
+        }
+    }
+    column := len(runes) - lineStart + 1
+    return append(tokens, exprToken{Kind: exprEnd, Line: line, Column: column}), nil
+}
+
+// Decimal numbers with an optional exponent, or hexadecimal ones like 0xff.
+func parseExprNumber(text string) (float64, error) {
+    if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+        value, err := strconv.ParseUint(text[2:], 16, 64)
+        return float64(value), err
+    }
+    value, err := strconv.ParseFloat(text, 64)
+    if err != nil || math.IsInf(value, 0) {
+        return 0, fmt.Errorf("not a number")
+    }
+    return value, nil
+}
+
+type exprParser struct {
+    Tokens []exprToken
+    Position int
+    Depth int
+    // Slots of the variables assigned so far
+    Variables map[string]int
+    Slots int
+}
+
+func (myParser *exprParser) peek() exprToken {
+    return myParser.Tokens[myParser.Position]
+}
+
+func (myParser *exprParser) next() exprToken {
+    myToken := myParser.Tokens[myParser.Position]
+    if myToken.Kind != exprEnd {
+        myParser.Position++
+    }
+    return myToken
+}
+
+// Whether the next token is one of the operators, which is then taken.
+func (myParser *exprParser) accept(operators ...string) (string, bool) {
+    myToken := myParser.peek()
+    if myToken.Kind != exprOperator {
+        return "", false
+    }
+    for _, operator := range operators {
+        if myToken.Text == operator {
+            myParser.next()
+            return operator, true
+        }
+    }
+    return "", false
+}
+
+func (myParser *exprParser) fail(at exprToken, format string, args ...interface{}) error {
+    return exprError{at.Line, at.Column, fmt.Sprintf(format, args...)}
+}
+
+// The slot an assignment to target writes: a channel of the result or a variable.
+func (myParser *exprParser) assignable(target exprToken) (int, error) {
+    if slot, ok := exprNames[target.Text]; ok {
+        if slot < exprSlotRed {
+            return 0, myParser.fail(target, "%s can't be assigned, only r, g, b, a and variables", target.Text)
+        }
+        return exprSlotResult + slot - exprSlotRed, nil
+    }
+    if _, ok := exprConstants[target.Text]; ok {
+        return 0, myParser.fail(target, "%s is a constant", target.Text)
+    }
+    if _, ok := exprFunctions[target.Text]; ok {
+        return 0, myParser.fail(target, "%s is a function", target.Text)
+    }
+    if slot, ok := myParser.Variables[target.Text]; ok {
+        return slot, nil
+    }
+    myParser.Variables[target.Text] = myParser.Slots
+    myParser.Slots++
+    return myParser.Slots - 1, nil
+}
+
+// The binary operators from the loosest to the tightest, all left associative
+var exprLevels = [][]string{
+    {"||"},
+    {"&&"},
+    {"==", "!=", "<", "<=", ">", ">="},
+    {"|"},
+    {"^"},
+    {"&"},
+    {"<<", ">>"},
+    {"+", "-"},
+    {"*", "/", "%"},
+}
+
+var exprBinary = map[string]func(float64, float64) float64{
+    "||": func(left float64, right float64) float64 { return exprBool(left != 0 || right != 0) },
+    "&&": func(left float64, right float64) float64 { return exprBool(left != 0 && right != 0) },
+    "==": func(left float64, right float64) float64 { return exprBool(left == right) },
+    "!=": func(left float64, right float64) float64 { return exprBool(left != right) },
+    "<": func(left float64, right float64) float64 { return exprBool(left < right) },
+    "<=": func(left float64, right float64) float64 { return exprBool(left <= right) },
+    ">": func(left float64, right float64) float64 { return exprBool(left > right) },
+    ">=": func(left float64, right float64) float64 { return exprBool(left >= right) },
+    "|": func(left float64, right float64) float64 { return float64(exprInt(left) | exprInt(right)) },
+    "^": func(left float64, right float64) float64 { return float64(exprInt(left) ^ exprInt(right)) },
+    "&": func(left float64, right float64) float64 { return float64(exprInt(left) & exprInt(right)) },
+    "<<": func(left float64, right float64) float64 { return float64(exprInt(left) << exprShift(right)) },
+    ">>": func(left float64, right float64) float64 { return float64(exprInt(left) >> exprShift(right)) },
+    "+": func(left float64, right float64) float64 { return left + right },
+    "-": func(left float64, right float64) float64 { return left - right },
+    "*": func(left float64, right float64) float64 { return left * right },
+    "/": func(left float64, right float64) float64 { return left / right },
+    "%": func(left float64, right float64) float64 {
+        remainder := math.Mod(left, right)
+        if remainder != 0 && (remainder < 0) != (right < 0) {
+            remainder += right
+        }
+        return remainder
+    },
+    "**": math.Pow,
+}
+
+var exprUnary = map[string]func(float64) float64{
+    "-": func(value float64) float64 { return -value },
+    "+": func(value float64) float64 { return value },
+    "!": func(value float64) float64 { return exprBool(value == 0) },
+    "~": func(value float64) float64 { return float64(^exprInt(value)) },
+}
+
+func exprBool(value bool) float64 {
+    if value {
+        return 1
+    }
+    return 0
+}
+
+// A number as a whole number for the bitwise operators, 0 when it's too big to be one.
+func exprInt(value float64) int64 {
+    if math.IsNaN(value) || math.Abs(value) >= 1 << 62 {
+        return 0
+    }
+    return int64(value)
+}
+
+func exprShift(value float64) uint {
+    return uint(max(0, min(63, exprInt(value))))
+}
+
+func (myParser *exprParser) enter(at exprToken) error {
+    myParser.Depth++
+    if myParser.Depth > maxExpressionDepth {
+        return myParser.fail(at, "nested too deeply")
+    }
+    return nil
+}
+
+// condition ? then : otherwise, or just an operator expression.
+func (myParser *exprParser) parseExpression() (exprNode, error) {
+    start := myParser.peek()
+    err := myParser.enter(start)
+    if err != nil {
+        return exprNode{}, err
+    }
+    defer func() { myParser.Depth-- }()
+
+    condition, err := myParser.parseBinary(0)
+    if err != nil {
+        return exprNode{}, err
+    }
+    if _, ok := myParser.accept("?"); !ok {
+        return condition, nil
+    }
+    then, err := myParser.parseExpression()
+    if err != nil {
+        return exprNode{}, err
+    }
+    if colon := myParser.next(); colon.Kind != exprOperator || colon.Text != ":" {
+        return exprNode{}, myParser.fail(colon, "expected \":\", found %s", colon.describe())
+    }
+    otherwise, err := myParser.parseExpression()
+    if err != nil {
+        return exprNode{}, err
+    }
+    return foldNode(exprNode{
+        Eval: func(state *exprState) float64 {
+            if condition.Eval(state) != 0 {
+                return then.Eval(state)
+            }
+            return otherwise.Eval(state)
+        },
+        Constant: condition.Constant && then.Constant && otherwise.Constant,
+    }), nil
+}
+
+func (myParser *exprParser) parseBinary(level int) (exprNode, error) {
+    if level == len(exprLevels) {
+        return myParser.parseUnary()
+    }
+    left, err := myParser.parseBinary(level + 1)
+    if err != nil {
+        return exprNode{}, err
+    }
+    for {
+        operator, ok := myParser.accept(exprLevels[level]...)
+        if !ok {
+            return left, nil
+        }
+        right, err := myParser.parseBinary(level + 1)
+        if err != nil {
+            return exprNode{}, err
+        }
+        left = binaryNode(exprBinary[operator], left, right)
+    }
+}
+
+func binaryNode(apply func(float64, float64) float64, left exprNode, right exprNode) exprNode {
+    leftEval, rightEval := left.Eval, right.Eval
+    return foldNode(exprNode{
+        Eval: func(state *exprState) float64 {
+            return apply(leftEval(state), rightEval(state))
+        },
+        Constant: left.Constant && right.Constant,
+    })
+}
+
+// Unary operators, then ** (right associative, tighter than a unary minus on its left, so
+// -2 ** 2 is -4 like in Python).
+func (myParser *exprParser) parseUnary() (exprNode, error) {
+    start := myParser.peek()
+    if operator, ok := myParser.accept("-", "+", "!", "~"); ok {
+        err := myParser.enter(start)
+        if err != nil {
+            return exprNode{}, err
+        }
+        defer func() { myParser.Depth-- }()
+        operand, err := myParser.parseUnary()
+        if err != nil {
+            return exprNode{}, err
+        }
+        apply, operandEval := exprUnary[operator], operand.Eval
+        return foldNode(exprNode{
+            Eval: func(state *exprState) float64 {
+                return apply(operandEval(state))
+            },
+            Constant: operand.Constant,
+        }), nil
+    }
+
+    base, err := myParser.parsePrimary()
+    if err != nil {
+        return exprNode{}, err
+    }
+    if _, ok := myParser.accept("**"); !ok {
+        return base, nil
+    }
+    exponent, err := myParser.parseUnary()
+    if err != nil {
+        return exprNode{}, err
+    }
+    return binaryNode(exprBinary["**"], base, exponent), nil
+}
+
+func (myParser *exprParser) parsePrimary() (exprNode, error) {
+    myToken := myParser.next()
+    switch myToken.Kind {
+    case exprNumber:
+        return constantNode(myToken.Value), nil
+    case exprName:
+        if _, ok := myParser.accept("("); ok {
+            return myParser.parseCall(myToken)
+        }
+        if slot, ok := myParser.Variables[myToken.Text]; ok {
+            return exprNode{Eval: func(state *exprState) float64 { return state.Slots[slot] }}, nil
+        }
+        if slot, ok := exprNames[myToken.Text]; ok {
+            return exprNode{Eval: func(state *exprState) float64 { return state.Slots[slot] }}, nil
+        }
+        if value, ok := exprConstants[myToken.Text]; ok {
+            return constantNode(value), nil
+        }
+        if _, ok := exprFunctions[myToken.Text]; ok {
+            return exprNode{}, myParser.fail(myToken, "%s is a function, call it like %s(...)", myToken.Text, myToken.Text)
+        }
+        return exprNode{}, myParser.fail(myToken, "unknown name %q", myToken.Text)
+    case exprOperator:
+        if myToken.Text == "(" {
+            inner, err := myParser.parseExpression()
+            if err != nil {
+                return exprNode{}, err
+            }
+            if closing := myParser.next(); closing.Kind != exprOperator || closing.Text != ")" {
+                return exprNode{}, myParser.fail(closing, "expected \")\", found %s", closing.describe())
+            }
+            return inner, nil
+        }
+    }
+    return exprNode{}, myParser.fail(myToken, "expected a number, a name or \"(\", found %s", myToken.describe())
+}
+
+// A function call or, for r, g, b and a, the channel of another pixel. The name and "(" are
+// taken already.
+func (myParser *exprParser) parseCall(name exprToken) (exprNode, error) {
+    args := []exprNode{}
+    if _, ok := myParser.accept(")"); !ok {
+        for {
+            arg, err := myParser.parseExpression()
+            if err != nil {
+                return exprNode{}, err
+            }
+            args = append(args, arg)
+            if _, ok := myParser.accept(","); ok {
+                continue
+            }
+            if closing := myParser.next(); closing.Kind != exprOperator || closing.Text != ")" {
+                return exprNode{}, myParser.fail(closing, "expected \",\" or \")\", found %s", closing.describe())
+            }
+            break
+        }
+    }
+
+    if slot, ok := exprNames[name.Text]; ok && slot >= exprSlotRed {
+        if len(args) != 2 {
+            return exprNode{}, myParser.fail(name, "%s(x, y) takes 2 arguments, not %d", name.Text, len(args))
+        }
+        channel, xEval, yEval := slot - exprSlotRed, args[0].Eval, args[1].Eval
+        return exprNode{Eval: func(state *exprState) float64 {
+            return state.Sample(xEval(state), yEval(state), channel)
+        }}, nil
+    }
+
+    myFunction, ok := exprFunctions[name.Text]
+    if !ok {
+        return exprNode{}, myParser.fail(name, "unknown function %q", name.Text)
+    }
+    arity := 1
+    if myFunction.Two != nil {
+        arity = 2
+    } else if myFunction.Three != nil {
+        arity = 3
+    }
+    if len(args) != arity {
+        return exprNode{}, myParser.fail(name, "%s takes %d arguments, not %d", name.Text, arity, len(args))
+    }
+
+    constant := true
+    for _, arg := range args {
+        constant = constant && arg.Constant
+    }
+    node := exprNode{Constant: constant}
+    switch arity {
+    case 1:
+        apply, first := myFunction.One, args[0].Eval
+        node.Eval = func(state *exprState) float64 { return apply(first(state)) }
+    case 2:
+        apply, first, second := myFunction.Two, args[0].Eval, args[1].Eval
+        node.Eval = func(state *exprState) float64 { return apply(first(state), second(state)) }
+    default:
+        apply, first, second, third := myFunction.Three, args[0].Eval, args[1].Eval, args[2].Eval
+        node.Eval = func(state *exprState) float64 { return apply(first(state), second(state), third(state)) }
+    }
+    return foldNode(node), nil
+}
+
+func constantNode(value float64) exprNode {
+    return exprNode{Eval: func(state *exprState) float64 { return value }, Constant: true}
+}
+
+// Work out a constant expression now instead of for every pixel.
+func foldNode(node exprNode) exprNode {
+    if !node.Constant {
+        return node
+    }
+    return constantNode(node.Eval(nil))
+}
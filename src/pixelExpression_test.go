@@ -0,0 +1,223 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "math"
+    "strings"
+    "testing"
+)
+
+// Run a program on one pixel with the given channels, x = 1, y = 2 in a 4x3 image and t = 0.5.
+// Other pixels all read as 0.
+func runExpression(t *testing.T, source string, pixel [4]float64) [4]float64 {
+    t.Helper()
+    myProgram, err := compileExpression(source)
+    if err != nil {
+        t.Fatalf("%q: %v", source, err)
+    }
+    state := myProgram.newState(func(x float64, y float64, channel int) float64 {
+        return 0
+    })
+    state.Slots[exprSlotX], state.Slots[exprSlotY] = 1, 2
+    state.Slots[exprSlotWidth], state.Slots[exprSlotHeight] = 4, 3
+    state.Slots[exprSlotTime] = 0.5
+    copy(state.Slots[exprSlotRed:exprSlotRed + 4], pixel[:])
+    return myProgram.run(state)
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+    tests := []struct {
+        source string
+        want float64
+    }{
+        // ** binds tighter than a unary minus on its left and is right associative
+        {"r = -2 ** 2", -4},
+        {"r = (-2) ** 2", 4},
+        {"r = 2 ** -1", 0.5},
+        {"r = 2 ** 3 ** 2", 512},
+        {"r = 2 * 3 ** 2", 18},
+        // % takes the sign of the divisor
+        {"r = -7 % 3", 2},
+        {"r = 7 % -3", -2},
+        {"r = -7 % -3", -1},
+        {"r = 7.5 % 2", 1.5},
+        // + before <<, << before &, & before ^ before |, all before comparisons
+        {"r = 1 + 2 << 1", 6},
+        {"r = 1 << 2 & 4", 4},
+        {"r = 6 & 3 == 2", 1},
+        {"r = 1 | 2 ^ 3", 1},
+        {"r = 12 & 10 ^ 1", 9},
+        {"r = 256 >> 4 >> 2", 4},
+        {"r = ~0", -1},
+        // Comparisons before && before ||, and the condition last
+        {"r = 1 < 2 == 1", 1},
+        {"r = 0 && 1 || 1", 1},
+        {"r = 0 || 1 && 0", 0},
+        {"r = !0 + 1", 2},
+        {"r = 0 ? 1 : 2 ? 3 : 4", 3},
+        {"r = 1 ? 0 ? 5 : 6 : 7", 6},
+        // Functions and the names of the pixel
+        {"r = clamp(300, 0, 255)", 255},
+        {"r = mix(0, 10, t)", 5},
+        {"r = x + y * w + h", 12},
+        {"r = max(g, b) - min(g, b)", 20},
+    }
+    for _, test := range tests {
+        result := runExpression(t, test.source, [4]float64{10, 20, 40, 255})
+        if math.Abs(result[0] - test.want) > 1e-9 {
+            t.Errorf("%q gives %v, want %v", test.source, result[0], test.want)
+        }
+    }
+}
+
+func TestExpressionAssignments(t *testing.T) {
+    tests := []struct {
+        source string
+        want [4]float64
+    }{
+        // The right-hand side always reads the original pixel
+        {"r = g; g = r", [4]float64{20, 10, 40, 255}},
+        {"r = g\ng = r\nb = r", [4]float64{20, 10, 10, 255}},
+        {"r = r + 1; r = r + 1", [4]float64{11, 20, 40, 255}},
+        // Variables are what was last assigned to them
+        {"v = r; v = v * 2; a = v", [4]float64{10, 20, 40, 20}},
+        {"; ;\n\nb = 0;", [4]float64{10, 20, 0, 255}},
+    }
+    for _, test := range tests {
+        result := runExpression(t, test.source, [4]float64{10, 20, 40, 255})
+        if result != test.want {
+            t.Errorf("%q gives %v, want %v", test.source, result, test.want)
+        }
+    }
+}
+
+func TestExpressionErrors(t *testing.T) {
+    tests := []struct {
+        source string
+        line int
+        column int
+        message string
+    }{
+        {"r = g\ng = (r +", 2, 9, "found the end"},
+        {"r = g\n  g = 1 +* 2", 2, 10, "found \"*\""},
+        {"r = 1\nq", 2, 2, "expected \"=\" after q"},
+        {"r = foo(1)", 1, 5, "unknown function \"foo\""},
+        {"r = sin(1, 2)", 1, 5, "takes 1 arguments, not 2"},
+        {"r = r(1)", 1, 5, "takes 2 arguments, not 1"},
+        {"r = 1 2", 1, 7, "expected \";\" or a new line"},
+        {"r = v", 1, 5, "v"},
+        {"x = 1", 1, 1, "x"},
+    }
+    for _, test := range tests {
+        _, err := compileExpression(test.source)
+        myError, ok := err.(exprError)
+        if !ok {
+            t.Errorf("%q gives %v, want an error at line %d, column %d", test.source, err, test.line, test.column)
+            continue
+        }
+        if myError.Line != test.line || myError.Column != test.column || !strings.Contains(myError.Message, test.message) {
+            t.Errorf("%q gives %v, want line %d, column %d: ...%s...", test.source, err, test.line, test.column, test.message)
+        }
+    }
+}
+
+func TestExpressionLimits(t *testing.T) {
+    nested := func(depth int) string {
+        return "r = " + strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+    }
+    tests := []struct {
+        source string
+        ok bool
+    }{
+        {nested(maxExpressionDepth - 1), true},
+        {nested(maxExpressionDepth), false},
+        {nested(100000), false},
+        {"r = " + strings.Repeat("-", maxExpressionDepth - 1) + "1", true},
+        {"r = " + strings.Repeat("-", maxExpressionDepth) + "1", false},
+        {"r = " + strings.Repeat("1 ? ", maxExpressionDepth) + "1" + strings.Repeat(" : 0", maxExpressionDepth), false},
+        {"r = 1" + strings.Repeat(" ", maxExpressionLength - 5), true},
+        {"r = 1" + strings.Repeat(" ", maxExpressionLength - 4), false},
+        {"", false},
+        {" ;\n", false},
+    }
+    for _, test := range tests {
+        _, err := compileExpression(test.source)
+        if (err == nil) != test.ok {
+            t.Errorf("%.40q... (%d characters) gives %v", test.source, len(test.source), err)
+        }
+    }
+}
+
+func TestExpressionConstantFolding(t *testing.T) {
+    tests := []struct {
+        source string
+        constant bool
+        want float64
+    }{
+        {"1 + 2 * 3", true, 7},
+        {"-2 ** 2", true, -4},
+        {"pi > 3 ? sqrt(16) : 0", true, 4},
+        {"clamp(2 ** 10, 0, 255) & 15", true, 15},
+        {"x + 1", false, 0},
+        {"1 ? x : 2", false, 0},
+        {"r(0, 0)", false, 0},
+        {"sin(t)", false, 0},
+    }
+    for _, test := range tests {
+        tokens, err := lexExpression(test.source)
+        if err != nil {
+            t.Fatalf("%q: %v", test.source, err)
+        }
+        myParser := &exprParser{Tokens: tokens, Variables: map[string]int{}, Slots: exprSlotVariables}
+        node, err := myParser.parseExpression()
+        if err != nil {
+            t.Fatalf("%q: %v", test.source, err)
+        }
+        if node.Constant != test.constant {
+            t.Errorf("%q is constant: %v, want %v", test.source, node.Constant, test.constant)
+            continue
+        }
+        // A folded node doesn't look at the state, so running it without one works
+        if test.constant && node.Eval(nil) != test.want {
+            t.Errorf("%q folds to %v, want %v", test.source, node.Eval(nil), test.want)
+        }
+    }
+}
+
+// Pixels outside the image read as the nearest one inside it.
+func TestExpressionSamplingEdges(t *testing.T) {
+    src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+    for y := 0; y < 2; y++ {
+        for x := 0; x < 3; x++ {
+            src.SetNRGBA(x, y, color.NRGBA{uint8(10 * (x + 1)), uint8(100 + 10 * y), 0, 0xff})
+        }
+    }
+    tests := []struct {
+        expression string
+        want [2][3]uint8
+    }{
+        {"r = r(x - 1, y)", [2][3]uint8{{10, 10, 20}, {10, 10, 20}}},
+        {"r = r(x + 1, y)", [2][3]uint8{{20, 30, 30}, {20, 30, 30}}},
+        {"r = r(-1000, y)", [2][3]uint8{{10, 10, 10}, {10, 10, 10}}},
+        {"r = r(w, h)", [2][3]uint8{{30, 30, 30}, {30, 30, 30}}},
+        {"r = g(x, y - 1)", [2][3]uint8{{100, 100, 100}, {100, 100, 100}}},
+        {"r = g(x, y + 1)", [2][3]uint8{{110, 110, 110}, {110, 110, 110}}},
+        {"r = r(x + 0.9, y)", [2][3]uint8{{10, 20, 30}, {10, 20, 30}}},
+        {"r = r(0 / 0, y)", [2][3]uint8{{10, 10, 10}, {10, 10, 10}}},
+    }
+    for _, test := range tests {
+        result, err := expressionFilter(src, FilterParams{"expression": test.expression})
+        if err != nil {
+            t.Fatalf("%q: %v", test.expression, err)
+        }
+        for y := 0; y < 2; y++ {
+            for x := 0; x < 3; x++ {
+                got := color.NRGBAModel.Convert(result.At(x, y)).(color.NRGBA).R
+                if got != test.want[y][x] {
+                    t.Errorf("%q at %d, %d gives %d, want %d", test.expression, x, y, got, test.want[y][x])
+                }
+            }
+        }
+    }
+}
@@ -8,13 +8,44 @@ import (
     "net/url"
     "io"
     "strconv"
+    "path/filepath"
 )
 
+// The formats we store, with the file extension and content type of each
+type storedFormat struct {
+    Extension string
+    ContentType string
+}
+
+var storedFormats = map[string]storedFormat{
+    "png": {"png", "image/png"},
+    "jpeg": {"jpg", "image/jpeg"},
+    "gif": {"gif", "image/gif"},
+    "bmp": {"bmp", "image/bmp"},
+    "tiff": {"tiff", "image/tiff"},
+    // Images rendered as characters
+    "text": {"txt", "text/plain; charset=utf-8"},
+    "ansi": {"ans", "text/plain; charset=utf-8"},
+    "html": {"html", "text/html; charset=utf-8"},
+}
+
+// Uploads are kept under working, results under finished, and the small renditions of both under
+// previews
+var states = []string{"working", "finished", "previews"}
+
 func main()  {
     if !registerInKVStore() {
         return
     }
 
+    for _, state := range states {
+        err := os.MkdirAll("/tmp/" + state, 0755)
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+    }
+
     http.HandleFunc("/sendImage", receiveImage)
     http.HandleFunc("/getImage", serveImage)
     fmt.Println("storageService is up! 🖼")
@@ -29,32 +60,40 @@ func receiveImage(w http.ResponseWriter, r *http.Request)  {
             fmt.Fprint(w, "Error 🚫:", err)
             return
         }
-        if len(values.Get("id")) == 0 {
+        // We check values of request from client
+        state, name, err := storedName(values)
+        if err != nil {
             w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, "Wrong input id.")
+            fmt.Fprint(w, err)
             return
         }
-        // We check values of request from client
-        if values.Get("state") != "working" && values.Get("state") != "finished" {
+        format := values.Get("format")
+        if len(format) == 0 {
+            format = "png"
+        }
+        myFormat, ok := storedFormats[format]
+        if !ok {
             w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, "Wrong inpnut state.")
+            fmt.Fprint(w, "Wrong input format.")
             return
         }
 
-        _, err = strconv.Atoi(values.Get("id"))
+        // Only one file per name and state, so a copy in another format must go first
+        err = removeStoredImage(state, name)
         if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, "Wrong input id.")
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprint(w, err)
             return
         }
-        // We create empty file in tmp/state dir with right ID
-        file, err := os.Create("/tmp/" + values.Get("state") + "/" + values.Get("id") + ".png")
-        defer file.Close()
+
+        // We create empty file in tmp/state dir with right ID and extension
+        file, err := os.Create("/tmp/" + state + "/" + name + "." + myFormat.Extension)
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
+        defer file.Close()
 
         // We copy over image data from request to file
         _, err = io.Copy(file, r.Body)
@@ -79,31 +118,28 @@ func serveImage(w http.ResponseWriter, r *http.Request)  {
             fmt.Fprint(w, err)
             return
         }
-        if len(values.Get("id")) == 0 {
-            w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, "Wrong input id.")
-            return
-        }
-        if values.Get("state") != "working" && values.Get("state") != "finished" {
+        state, name, err := storedName(values)
+        if err != nil {
             w.WriteHeader(http.StatusBadRequest)
-            fmt.Fprint(w, "Wrong input state.")
+            fmt.Fprint(w, err)
             return
         }
 
-        _, err = strconv.Atoi(values.Get("id"))
+        path, myFormat, err := findStoredImage(state, name)
         if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
+            w.WriteHeader(http.StatusNotFound)
             fmt.Fprint(w, err)
             return
         }
-
-        file, err := os.Open("/tmp/" + values.Get("State") + "/" + values.Get("id") + ".png")
-        defer file.Close()
+        file, err := os.Open(path)
         if err != nil {
             w.WriteHeader(http.StatusBadRequest)
             fmt.Fprint(w, err)
             return
         }
+        defer file.Close()
+
+        w.Header().Set("Content-Type", myFormat.ContentType)
 
         _, err = io.Copy(w, file)
         if err != nil {
@@ -117,6 +153,66 @@ func serveImage(w http.ResponseWriter, r *http.Request)  {
     }
 }
 
+// The state directory and the file name (without extension) a request is about. Files are named
+// by the task ID, the other images uploaded with a task also by their name (?name=...), previews by
+// which image they show (?of=original|result) and how big they are (?size=...).
+func storedName(values url.Values) (string, string, error) {
+    id := values.Get("id")
+    if _, err := strconv.Atoi(id); err != nil {
+        return "", "", fmt.Errorf("Wrong input id.")
+    }
+    state := values.Get("state")
+    switch state {
+    case "working":
+        name := values.Get("name")
+        if len(name) == 0 {
+            return state, id, nil
+        }
+        if !validName(name) {
+            return "", "", fmt.Errorf("Wrong input name.")
+        }
+        return state, id + "-" + name, nil
+    case "finished":
+        return state, id, nil
+    case "previews":
+        of := values.Get("of")
+        if of != "original" && of != "result" {
+            return "", "", fmt.Errorf("Wrong input of.")
+        }
+        size, err := strconv.Atoi(values.Get("size"))
+        if err != nil || size <= 0 {
+            return "", "", fmt.Errorf("Wrong input size.")
+        }
+        return state, id + "-" + of + "-" + strconv.Itoa(size), nil
+    }
+    return "", "", fmt.Errorf("Wrong input state.")
+}
+
+// Find the file stored under a name and state, whatever its extension.
+func findStoredImage(state string, name string) (string, storedFormat, error) {
+    for _, myFormat := range storedFormats {
+        path := "/tmp/" + state + "/" + name + "." + myFormat.Extension
+        if _, err := os.Stat(path); err == nil {
+            return path, myFormat, nil
+        }
+    }
+    return "", storedFormat{}, fmt.Errorf("No %s image %s.", state, name)
+}
+
+func removeStoredImage(state string, name string) error {
+    matches, err := filepath.Glob("/tmp/" + state + "/" + name + ".*")
+    if err != nil {
+        return err
+    }
+    for _, match := range matches {
+        err = os.Remove(match)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 func registerInKVStore() bool {
     if len(os.Args) < 3 {
         fmt.Println("Error 🚫: Too few arguments.")
@@ -10,12 +10,63 @@ import (
     "encoding/json"
     "os"
     "io/ioutil"
+    "strings"
 )
 
 // A Task data-type that we will use for storing tasks
+// State is 0 (not started), 1 (in progress), 2 (finished), 3 (failed) or 4 (rejected because the
+// image is too large), with the reason for the last two in Error
 type Task struct {
     ID int `json:"id"`
     State int `json:"state"`
+    Pipeline []PipelineStep `json:"pipeline"`
+    Format string `json:"format"`
+    Output OutputOptions `json:"output"`
+    Animate AnimateOptions `json:"animate"`
+    // Names of the other images uploaded with the task, stored next to its image
+    Inputs []string `json:"inputs,omitempty"`
+    // A batch task has no image of its own, the worker assembles one from the inputs
+    Batch BatchOptions `json:"batch"`
+    Error string `json:"error,omitempty"`
+}
+
+// How the worker encodes the finished image
+type OutputOptions struct {
+    Format string `json:"format"`
+    Quality int `json:"quality,omitempty"`
+    Compression string `json:"compression,omitempty"`
+    PaletteSize int `json:"paletteSize,omitempty"`
+    Width int `json:"width,omitempty"`
+    Ramp string `json:"ramp,omitempty"`
+    Metadata []string `json:"metadata,omitempty"`
+}
+
+// Turns the task into an animation by sweeping one parameter of one pipeline step
+type AnimateOptions struct {
+    Frames int `json:"frames,omitempty"`
+    Delay int `json:"delay,omitempty"`
+    Step int `json:"step,omitempty"`
+    Param string `json:"param,omitempty"`
+    From float64 `json:"from,omitempty"`
+    To float64 `json:"to,omitempty"`
+}
+
+// How the worker makes one image out of a batch task's inputs: a collage or a mosaic
+type BatchOptions struct {
+    Layout string `json:"layout,omitempty"`
+    Columns int `json:"columns,omitempty"`
+    CellSize int `json:"cellSize,omitempty"`
+    Spacing int `json:"spacing,omitempty"`
+    Background string `json:"background,omitempty"`
+    Target string `json:"target,omitempty"`
+    TileSize int `json:"tileSize,omitempty"`
+    Tint float64 `json:"tint,omitempty"`
+}
+
+// One step of a task's pipeline, applied by the worker in order
+type PipelineStep struct {
+    Filter string `json:"filter"`
+    Params map[string]interface{} `json:"params"`
 }
 
 var dataStore []Task
@@ -38,6 +89,7 @@ func main() {
     http.HandleFunc("/newTask", newTask)
     http.HandleFunc("/getNewTask", getNewTask)
     http.HandleFunc("/finishTask", finishTask)
+    http.HandleFunc("/failTask", failTask)
     http.HandleFunc("/setByID", setByID)
     http.HandleFunc("/list", list)
     fmt.Println("taskService is up! 📫")
@@ -100,18 +152,33 @@ func getByID(w http.ResponseWriter, r *http.Request) {
 func newTask(w http.ResponseWriter, r *http.Request) {
     if r.Method == http.MethodPost {
 
+        // The body optionally describes what to do with the image (the pipeline of filters)
+        taskToAdd := Task{}
+        data, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(data) > 0 {
+            err = json.Unmarshal(data, &taskToAdd)
+            if err != nil {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprint(w, err)
+                return
+            }
+        }
+
         // Create new Task with next ID and add it to our dataStore
-        fmt.Println("Before task mutex!")
         dataStoreMutex.Lock()
-        taskToAdd := Task{
-            ID: len(dataStore),
-            State: 0,
-        }
-        dataStore[taskToAdd.ID] = taskToAdd
+        taskToAdd.ID = len(dataStore)
+        taskToAdd.State = 0
+        dataStore = append(dataStore, taskToAdd)
         dataStoreMutex.Unlock()
 
-        // Return task ID to client
-        fmt.Fprint(w, taskToAdd.ID, "added successfully 😜")
+        // Return task ID to client (masterService uses the body as the ID, so nothing else goes here)
+        fmt.Println("Task", taskToAdd.ID, "added successfully 😜")
+        fmt.Fprint(w, taskToAdd.ID)
     } else {
         w.WriteHeader(http.StatusBadRequest)
         fmt.Fprint(w, "Error 🚫: Only POST accepted")
@@ -139,12 +206,12 @@ func getNewTask(w http.ResponseWriter, r *http.Request) {
         dataStoreMutex.Lock()
         // Find oldest task that hasn't started yet
         for i := oldestNotFinishedTask; i < len(dataStore); i++ {
-            if dataStore[i].State == 2 && i == oldestNotFinishedTask {
+            if dataStore[i].State >= 2 && i == oldestNotFinishedTask {
                 oldestNotFinishedTask++
                 continue
             }
             if dataStore[i].State == 0 {
-                dataStore[i] = Task{ ID: i, State: 1 }
+                dataStore[i].State = 1
                 taskToSend = dataStore[i]
                 break
             }
@@ -166,8 +233,9 @@ func getNewTask(w http.ResponseWriter, r *http.Request) {
             time.Sleep(time.Second * 120)
             dataStoreMutex.Lock()
             if dataStore[myID].State == 1 {
-                dataStore[myID] = Task{ ID: myID, State: 0 }
+                dataStore[myID].State = 0
             }
+            dataStoreMutex.Unlock()
         }()
 
         response, err := json.Marshal(taskToSend)
@@ -201,12 +269,69 @@ func finishTask(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        updatedTask := Task{ ID: id, State: 2 }
         bErrored := false
 
         dataStoreMutex.Lock()
-        if dataStore[id].State == 1 {
-            dataStore[id] = updatedTask
+        if id >= 0 && id < len(dataStore) && dataStore[id].State == 1 {
+            dataStore[id].State = 2
+        } else {
+            bErrored = true
+        }
+        dataStoreMutex.Unlock()
+
+        if bErrored {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input")
+            return
+        }
+
+        fmt.Fprint(w, "success")
+    } else {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Error 🚫: Only POST accepted")
+    }
+}
+
+// A worker gave up on a task that can never succeed (e.g. the upload isn't an image we can read).
+// The body holds the reason, which is kept on the task for the client.
+func failTask(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        values, err := url.ParseQuery(r.URL.RawQuery)
+        if err != nil {
+            fmt.Fprint(w, err)
+            return
+        }
+        if len(values.Get("id")) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "Wrong input")
+            return
+        }
+
+        id, err := strconv.Atoi(string(values.Get("id")))
+        if err != nil {
+            fmt.Fprint(w, err)
+            return
+        }
+
+        reason, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, err)
+            return
+        }
+
+        // ?rejected=true marks the task as rejected rather than failed
+        state := 3
+        if values.Get("rejected") == "true" {
+            state = 4
+        }
+
+        bErrored := false
+
+        dataStoreMutex.Lock()
+        if id >= 0 && id < len(dataStore) && dataStore[id].State == 1 {
+            dataStore[id].State = state
+            dataStore[id].Error = string(reason)
         } else {
             bErrored = true
         }
@@ -245,7 +370,7 @@ func setByID(w http.ResponseWriter, r *http.Request) {
 
         bErrored := false
         dataStoreMutex.Lock()
-        if taskToSet.ID >= len(dataStore) || taskToSet.State > 2 || taskToSet.State < 0 {
+        if taskToSet.ID >= len(dataStore) || taskToSet.State > 4 || taskToSet.State < 0 {
             bErrored = true
         } else {
             dataStore[taskToSet.ID] = taskToSet
@@ -268,7 +393,11 @@ func list(w http.ResponseWriter, r *http.Request) {
     if r.Method == http.MethodGet {
         dataStoreMutex.RLock()
         for key, value := range dataStore {
-            fmt.Fprintln(w, "KEY:", key, "ID:", value.ID, "STATE:", value.State)
+            filters := make([]string, len(value.Pipeline))
+            for i, step := range value.Pipeline {
+                filters[i] = step.Filter
+            }
+            fmt.Fprintln(w, "KEY:", key, "ID:", value.ID, "STATE:", value.State, "FORMAT:", value.Format, "OUTPUT:", value.Output.Format, "INPUTS:", strings.Join(value.Inputs, ","), "BATCH:", value.Batch.Layout, "PIPELINE:", strings.Join(filters, " -> "), value.Error)
         }
         dataStoreMutex.RUnlock()
     } else {
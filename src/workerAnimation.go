@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/draw"
+    "image/gif"
+    "io"
+    "math"
+    "runtime"
+    "sync"
+)
+
+// The worker passes images around as animations. A still image is an animation of one frame with
+// no timing, an animated GIF keeps its timing so we can write it back out the same way.
+type animation struct {
+    Frames []image.Image
+    // Per frame, in 100ths of a second
+    Delays []int
+    Disposals []byte
+    LoopCount int
+}
+
+// Sweeping a parameter of one pipeline step over the frames of an animation, as sent by masterService.
+// Frames and Delay (in 100ths of a second) only matter when the input is a still.
+type AnimateOptions struct {
+    Frames int `json:"frames,omitempty"`
+    Delay int `json:"delay,omitempty"`
+    Step int `json:"step,omitempty"`
+    Param string `json:"param,omitempty"`
+    From float64 `json:"from,omitempty"`
+    To float64 `json:"to,omitempty"`
+}
+
+const defaultAnimateFrames = 10
+const defaultAnimateDelay = 10
+
+func stillAnimation(myImage image.Image) *animation {
+    return &animation{Frames: []image.Image{myImage}}
+}
+
+func (myAnimation *animation) animated() bool {
+    return len(myAnimation.Frames) > 1
+}
+
+// Decode the upload. GIFs are decoded with all their frames, everything else is a single still.
+func decodeAnimation(data []byte) (*animation, string, error) {
+    myImage, format, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, format, err
+    }
+    if format != "gif" {
+        return stillAnimation(myImage), format, nil
+    }
+
+    myGIF, err := gif.DecodeAll(bytes.NewReader(data))
+    if err != nil {
+        return nil, format, err
+    }
+    if len(myGIF.Image) < 2 {
+        return stillAnimation(myImage), format, nil
+    }
+    return compositeGIF(myGIF), format, nil
+}
+
+// GIF frames are often only the part of the picture that changed, drawn over whatever the previous
+// frame's disposal left behind. Filters need whole pictures, so we replay the frames onto a canvas
+// and keep a copy of the canvas after every frame.
+func compositeGIF(myGIF *gif.GIF) *animation {
+    bounds := image.Rect(0, 0, myGIF.Config.Width, myGIF.Config.Height)
+    for _, frame := range myGIF.Image {
+        bounds = bounds.Union(frame.Bounds())
+    }
+
+    myAnimation := &animation{
+        Frames: make([]image.Image, len(myGIF.Image)),
+        Delays: myGIF.Delay,
+        Disposals: myGIF.Disposal,
+        LoopCount: myGIF.LoopCount,
+    }
+    canvas := image.NewRGBA(bounds)
+    for i, frame := range myGIF.Image {
+        disposal := byte(gif.DisposalNone)
+        if i < len(myGIF.Disposal) {
+            disposal = myGIF.Disposal[i]
+        }
+
+        var previous *image.RGBA
+        if disposal == gif.DisposalPrevious {
+            previous = copyRGBA(canvas)
+        }
+        draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+        myAnimation.Frames[i] = copyRGBA(canvas)
+
+        switch disposal {
+        case gif.DisposalBackground:
+            draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+        case gif.DisposalPrevious:
+            canvas = previous
+        }
+    }
+
+    return myAnimation
+}
+
+func copyRGBA(src *image.RGBA) *image.RGBA {
+    dst := image.NewRGBA(src.Rect)
+    copy(dst.Pix, src.Pix)
+    return dst
+}
+
+// Run the pipeline over every frame. When a parameter is animated, a still image is first turned
+// into as many copies as there are frames to be, and every frame gets its own value of the parameter.
+func applyPipelineToAnimation(pipeline []PipelineStep, animate AnimateOptions, myAnimation *animation, inputs inputImages, limits imageLimits) (*animation, error) {
+    result := &animation{
+        Delays: myAnimation.Delays,
+        Disposals: myAnimation.Disposals,
+        LoopCount: myAnimation.LoopCount,
+    }
+    if len(animate.Param) > 0 && animate.Step >= len(pipeline) {
+        return nil, fmt.Errorf("can't animate step %d of a %d step pipeline", animate.Step, len(pipeline))
+    }
+
+    frames := myAnimation.Frames
+    if len(animate.Param) > 0 && !myAnimation.animated() {
+        count, delay := sweepFrames(animate), animate.Delay
+        if delay == 0 {
+            delay = defaultAnimateDelay
+        }
+        frames = make([]image.Image, count)
+        result.Delays = make([]int, count)
+        for i := range frames {
+            frames[i] = myAnimation.Frames[0]
+            result.Delays[i] = delay
+        }
+    }
+
+    var err error
+    result.Frames, err = renderFrames(len(frames), func(frame int) (image.Image, error) {
+        return applyPipeline(sweepPipeline(pipeline, animate, frame, len(frames)), frames[frame], inputs, limits)
+    })
+    return result, err
+}
+
+// How many frames sweeping a parameter turns a still into.
+func sweepFrames(animate AnimateOptions) int {
+    if animate.Frames == 0 {
+        return defaultAnimateFrames
+    }
+    return animate.Frames
+}
+
+// The pipeline for one frame of a sweep: a copy with the animated parameter set to its value for
+// that frame.
+func sweepPipeline(pipeline []PipelineStep, animate AnimateOptions, frame int, frames int) []PipelineStep {
+    if len(animate.Param) == 0 || frames < 2 {
+        return pipeline
+    }
+
+    value := animate.From + (animate.To - animate.From) * float64(frame) / float64(frames - 1)
+    if animate.From == math.Trunc(animate.From) && animate.To == math.Trunc(animate.To) {
+        value = math.Round(value)
+    }
+
+    swept := append([]PipelineStep{}, pipeline...)
+    params := FilterParams{}
+    for key, param := range swept[animate.Step].Params {
+        params[key] = param
+    }
+    params[animate.Param] = value
+    swept[animate.Step].Params = params
+    return swept
+}
+
+// Render frames several at a time. Frames are independent of each other, so the result is the same
+// as doing them one after the other.
+func renderFrames(count int, render func(frame int) (image.Image, error)) ([]image.Image, error) {
+    frames := make([]image.Image, count)
+    frameErrors := make([]error, count)
+    next := make(chan int)
+    myWG := sync.WaitGroup{}
+    for i := 0; i < runtime.NumCPU() && i < count; i++ {
+        myWG.Add(1)
+        go func() {
+            defer myWG.Done()
+            for frame := range next {
+                frames[frame], frameErrors[frame] = render(frame)
+            }
+        }()
+    }
+    for frame := 0; frame < count; frame++ {
+        next <- frame
+    }
+    close(next)
+    myWG.Wait()
+
+    for frame, err := range frameErrors {
+        if err != nil {
+            if count == 1 {
+                return nil, err
+            }
+            return nil, fmt.Errorf("frame %d: %v", frame, err)
+        }
+    }
+    return frames, nil
+}
+
+// Write an animation as an animated GIF, every frame with a palette of its own. Frames are
+// complete pictures, so a frame with transparent parts is cleared away before the next one is
+// drawn (otherwise the older frame would show through); all other frames keep their disposal.
+func encodeAnimation(writer io.Writer, myAnimation *animation, options OutputOptions) error {
+    paletteSize := options.PaletteSize
+    if paletteSize == 0 {
+        paletteSize = 256
+    }
+    if paletteSize < 2 || paletteSize > 256 {
+        return taskError{fmt.Errorf("GIF palette size %d is not between 2 and 256", paletteSize)}
+    }
+
+    myGIF := &gif.GIF{LoopCount: myAnimation.LoopCount}
+    for i, frame := range myAnimation.Frames {
+        bounds := frame.Bounds()
+        myGIF.Config.Width = max(myGIF.Config.Width, bounds.Max.X)
+        myGIF.Config.Height = max(myGIF.Config.Height, bounds.Max.Y)
+
+        // Frames that already have a palette (from the quantize filter) keep it
+        paletted, ok := frame.(*image.Paletted)
+        if !ok || len(paletted.Palette) > paletteSize {
+            myPalette := medianCut(frame, paletteSize)
+            if len(myPalette) == 0 {
+                myPalette = append(myPalette, image.Transparent.C)
+            }
+            paletted = image.NewPaletted(bounds, myPalette)
+            draw.FloydSteinberg.Draw(paletted, bounds, frame, bounds.Min)
+        }
+        myGIF.Image = append(myGIF.Image, paletted)
+
+        delay := 0
+        if i < len(myAnimation.Delays) {
+            delay = myAnimation.Delays[i]
+        }
+        myGIF.Delay = append(myGIF.Delay, delay)
+
+        disposal := byte(gif.DisposalNone)
+        if i < len(myAnimation.Disposals) && myAnimation.Disposals[i] != 0 {
+            disposal = myAnimation.Disposals[i]
+        }
+        if !opaque(frame) {
+            disposal = gif.DisposalBackground
+        }
+        myGIF.Disposal = append(myGIF.Disposal, disposal)
+    }
+
+    return gif.EncodeAll(writer, myGIF)
+}
+
+func opaque(myImage image.Image) bool {
+    if myOpaque, ok := myImage.(interface{ Opaque() bool }); ok {
+        return myOpaque.Opaque()
+    }
+    bounds := myImage.Bounds()
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            if _, _, _, a := myImage.At(x, y).RGBA(); a != 0xffff {
+                return false
+            }
+        }
+    }
+    return true
+}
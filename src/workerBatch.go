@@ -0,0 +1,304 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+    "net/http"
+    "strconv"
+)
+
+// A batch task makes one image out of all the images uploaded with it, as sent by masterService.
+// Layout is collage (a grid of Columns, every image fit into a CellSize square, Spacing pixels of
+// Background around them) or mosaic (the Target image rebuilt from TileSize squares of the others,
+// tinted Tint of the way towards the colour they replace).
+type BatchOptions struct {
+    Layout string `json:"layout,omitempty"`
+    Columns int `json:"columns,omitempty"`
+    CellSize int `json:"cellSize,omitempty"`
+    Spacing int `json:"spacing,omitempty"`
+    Background string `json:"background,omitempty"`
+    Target string `json:"target,omitempty"`
+    TileSize int `json:"tileSize,omitempty"`
+    Tint float64 `json:"tint,omitempty"`
+}
+
+const defaultCellSize = 256
+const defaultTileSize = 16
+
+// Assemble the batch and carry on like with any other task, the assembled image being the task's
+// original: it's stored as such, so previews and diffs of the original show it. The pipeline only
+// runs when the task has one. The pixels a layout takes from workingPixels for its output stay
+// taken until the task is done, error or not.
+func processBatchTask(myTask Task) error {
+    limits, err := loadImageLimits(kVStoreAddress)
+    if err != nil {
+        return err
+    }
+
+    var myImage image.Image
+    var pixels int
+    switch myTask.Batch.Layout {
+    case "collage":
+        myImage, pixels, err = assembleCollage(myTask, limits)
+    case "mosaic":
+        myImage, pixels, err = assembleMosaic(myTask, limits)
+    default:
+        err = taskError{fmt.Errorf("Unknown batch layout %q", myTask.Batch.Layout)}
+    }
+    defer workingPixels.release(pixels)
+    if err != nil {
+        return err
+    }
+
+    buffer := &bytes.Buffer{}
+    err = outputEncoders["png"].Encode(buffer, myImage, OutputOptions{})
+    if err != nil {
+        return err
+    }
+    response, err := http.Post("http://" + storageLocation + "/sendImage?state=working&format=png&id=" + strconv.Itoa(myTask.ID), outputEncoders["png"].ContentType, buffer)
+    if err != nil {
+        return err
+    }
+    if response.StatusCode != http.StatusOK {
+        return fmt.Errorf("Can't send assembled image %d to storage: %s", myTask.ID, response.Status)
+    }
+
+    return finishTask(myTask, stillAnimation(myImage), nil, nil, limits)
+}
+
+// Every image in order, left to right and top to bottom, scaled to fit its cell and centred in it.
+// Without a number of columns the grid is as square as it gets. The canvas is budgeted before
+// it's allocated, the images as they're added.
+func assembleCollage(myTask Task, limits imageLimits) (image.Image, int, error) {
+    options := myTask.Batch
+    count := len(myTask.Inputs)
+    if count == 0 {
+        return nil, 0, taskError{fmt.Errorf("A collage needs at least one image")}
+    }
+    cell := options.CellSize
+    if cell == 0 {
+        cell = defaultCellSize
+    }
+    columns := options.Columns
+    if columns == 0 {
+        columns = int(math.Ceil(math.Sqrt(float64(count))))
+    }
+    columns = min(columns, count)
+    rows := (count + columns - 1) / columns
+    spacing := options.Spacing
+
+    width := columns * cell + (columns + 1) * spacing
+    height := rows * cell + (rows + 1) * spacing
+    err := checkImageSize(width, height, 1, limits)
+    if err != nil {
+        return nil, 0, taskError{err}
+    }
+    background, err := FilterParams{"background": options.Background}.Color("background", color.NRGBA{0xff, 0xff, 0xff, 0xff})
+    if err != nil {
+        return nil, 0, taskError{err}
+    }
+    pixels := width * height
+    workingPixels.acquire(pixels, limits.MaxPixels)
+
+    canvas := newFloatImage(image.Rect(0, 0, width, height))
+    fill := colorFloats(background)
+    for i := 0; i < len(canvas.Pix); i += 4 {
+        copy(canvas.Pix[i:i + 4], fill[:])
+    }
+
+    for i, name := range myTask.Inputs {
+        left := spacing + (i % columns) * (cell + spacing)
+        top := spacing + (i / columns) * (cell + spacing)
+        err := withBatchInput(myTask, name, limits, func(src *floatImage) {
+            scale := math.Min(float64(cell) / float64(src.Rect.Dx()), float64(cell) / float64(src.Rect.Dy()))
+            fitted := resizeFloats(src, int(math.Max(1, math.Round(float64(src.Rect.Dx()) * scale))), int(math.Max(1, math.Round(float64(src.Rect.Dy()) * scale))), "bilinear", resamplers["bilinear"])
+            left += (cell - fitted.Rect.Dx()) / 2
+            top += (cell - fitted.Rect.Dy()) / 2
+            for y := 0; y < fitted.Rect.Dy(); y++ {
+                for x := 0; x < fitted.Rect.Dx(); x++ {
+                    j := 4 * (y * fitted.Rect.Dx() + x)
+                    blendPixel(canvas, left + x, top + y, [4]float32{fitted.Pix[j], fitted.Pix[j + 1], fitted.Pix[j + 2], fitted.Pix[j + 3]}, 1)
+                }
+            }
+        })
+        if err != nil {
+            return nil, pixels, err
+        }
+    }
+
+    return canvas.toImage(&image.NRGBA{}), pixels, nil
+}
+
+// The target split into squares, each replaced by the tile (a square from the middle of one of the
+// other images) whose average colour is closest to the square's. Transparent squares stay that way.
+// The target and the mosaic, which is as big, are budgeted before the target is decoded and held
+// until the mosaic is done; the other images as they're made into tiles.
+func assembleMosaic(myTask Task, limits imageLimits) (image.Image, int, error) {
+    options := myTask.Batch
+    if len(myTask.Inputs) < 2 {
+        return nil, 0, taskError{fmt.Errorf("A mosaic needs a target and at least one image to build it from")}
+    }
+    target := options.Target
+    if len(target) == 0 {
+        target = myTask.Inputs[0]
+    }
+    size := options.TileSize
+    if size == 0 {
+        size = defaultTileSize
+    }
+
+    data, config, err := checkBatchInput(myTask, target, limits)
+    if err != nil {
+        return nil, 0, err
+    }
+    pixels := 2 * config.Width * config.Height
+    workingPixels.acquire(pixels, limits.MaxPixels)
+    targetImage, err := decodeBatchInput(target, data)
+    if err != nil {
+        return nil, pixels, err
+    }
+    targetFloats := floatImageFrom(targetImage)
+
+    // The tiles, their average straight colours, and the average colour (and alpha) of every square
+    var tiles []*floatImage
+    var tileColors [][3]float32
+    for _, name := range myTask.Inputs {
+        if name == target {
+            continue
+        }
+        err := withBatchInput(myTask, name, limits, func(src *floatImage) {
+            tile := resizeFloats(squareFloats(src), size, size, "bilinear", resamplers["bilinear"])
+            average := averageFloats(tile, tile.Rect)
+            tiles = append(tiles, tile)
+            tileColors = append(tileColors, [3]float32{average[0], average[1], average[2]})
+        })
+        if err != nil {
+            return nil, pixels, err
+        }
+    }
+
+    width, height := targetFloats.Rect.Dx(), targetFloats.Rect.Dy()
+    columns, rows := (width + size - 1) / size, (height + size - 1) / size
+    chosen := make([]int, columns * rows)
+    averages := make([][4]float32, columns * rows)
+    parallelTiles(image.Rect(0, 0, columns, rows), func(cells image.Rectangle) {
+        for row := cells.Min.Y; row < cells.Max.Y; row++ {
+            for column := cells.Min.X; column < cells.Max.X; column++ {
+                square := image.Rect(column * size, row * size, (column + 1) * size, (row + 1) * size).Add(targetFloats.Rect.Min).Intersect(targetFloats.Rect)
+                average := averageFloats(targetFloats, square)
+                best, bestDistance := 0, float32(math.Inf(1))
+                for i, tileColor := range tileColors {
+                    dr, dg, db := average[0] - tileColor[0], average[1] - tileColor[1], average[2] - tileColor[2]
+                    distance := 0.3 * dr * dr + 0.59 * dg * dg + 0.11 * db * db
+                    if distance < bestDistance {
+                        best, bestDistance = i, distance
+                    }
+                }
+                chosen[row * columns + column], averages[row * columns + column] = best, average
+            }
+        }
+    })
+
+    dst := newFloatImage(image.Rect(0, 0, width, height))
+    tint := float32(options.Tint)
+    parallelTiles(dst.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                cell := (y / size) * columns + x / size
+                average := averages[cell]
+                if average[3] < 0.5 {
+                    continue
+                }
+                src := tiles[chosen[cell]]
+                i, j := dst.offset(x, y), 4 * ((y % size) * size + x % size)
+                alpha := src.Pix[j + 3]
+                for c := 0; c < 3; c++ {
+                    dst.Pix[i + c] = src.Pix[j + c] * (1 - tint) + average[c] * alpha * tint
+                }
+                dst.Pix[i + 3] = alpha
+            }
+        }
+    })
+
+    return dst.toImage(&image.NRGBA{}), pixels, nil
+}
+
+// Fetch, check and decode one of the task's inputs and hand it to use, its pixels counting against
+// workingPixels until use returns. Batches can have many images, this way only one at a time is
+// held at full size. The layout already holds the budget of its output, so these are taken without
+// waiting.
+func withBatchInput(myTask Task, name string, limits imageLimits, use func(src *floatImage)) error {
+    data, config, err := checkBatchInput(myTask, name, limits)
+    if err != nil {
+        return err
+    }
+    pixels := config.Width * config.Height
+    workingPixels.take(pixels)
+    defer workingPixels.release(pixels)
+
+    myImage, err := decodeBatchInput(name, data)
+    if err != nil {
+        return err
+    }
+    use(floatImageFrom(myImage))
+    return nil
+}
+
+// Fetch one of the task's inputs and check it against the limits without decoding it.
+func checkBatchInput(myTask Task, name string, limits imageLimits) ([]byte, image.Config, error) {
+    data, err := getImageFromStorage(storageLocation, myTask, name)
+    if err != nil {
+        return nil, image.Config{}, err
+    }
+    config, _, err := checkImageData(data, limits)
+    if _, ok := err.(imageTooLargeError); ok {
+        return nil, image.Config{}, taskError{err}
+    }
+    if err != nil {
+        return nil, image.Config{}, taskError{fmt.Errorf("Input %s is not a supported image: %v", name, err)}
+    }
+    return data, config, nil
+}
+
+func decodeBatchInput(name string, data []byte) (image.Image, error) {
+    myImage, err := decodeOriented(data)
+    if err != nil {
+        return nil, taskError{fmt.Errorf("Input %s is not a supported image: %v", name, err)}
+    }
+    if myImage.Bounds().Empty() {
+        return nil, taskError{fmt.Errorf("Input %s is empty", name)}
+    }
+    return myImage, nil
+}
+
+// The largest square from the middle of an image, with its top left corner at (0, 0).
+func squareFloats(src *floatImage) *floatImage {
+    side := min(src.Rect.Dx(), src.Rect.Dy())
+    left := src.Rect.Min.X + (src.Rect.Dx() - side) / 2
+    top := src.Rect.Min.Y + (src.Rect.Dy() - side) / 2
+    dst := newFloatImage(image.Rect(0, 0, side, side))
+    for y := 0; y < side; y++ {
+        copy(dst.Pix[4 * y * side:4 * (y + 1) * side], src.Pix[src.offset(left, top + y):])
+    }
+    return dst
+}
+
+// The average straight colour of a part of the image, weighted by alpha, and its average alpha.
+func averageFloats(src *floatImage, rect image.Rectangle) [4]float32 {
+    var sum [4]float64
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            i := src.offset(x, y)
+            for c := 0; c < 4; c++ {
+                sum[c] += float64(src.Pix[i + c])
+            }
+        }
+    }
+    if sum[3] == 0 {
+        return [4]float32{}
+    }
+    return [4]float32{float32(sum[0] / sum[3]), float32(sum[1] / sum[3]), float32(sum[2] / sum[3]), float32(sum[3] / float64(rect.Dx() * rect.Dy()))}
+}
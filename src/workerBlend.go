@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+func init() {
+    registerFilter("blend", FilterFunc(blend))
+    registerFilter("displace", FilterFunc(displace))
+}
+
+// How the blend modes combine a straight channel of the image with the same channel of the other one
+var blendModes = map[string]func(base float32, top float32) float32{
+    "multiply": func(base float32, top float32) float32 {
+        return base * top
+    },
+    "screen": func(base float32, top float32) float32 {
+        return 1 - (1 - base) * (1 - top)
+    },
+    // Multiply in the shadows and screen in the highlights of the image, which keeps its contrast
+    "overlay": func(base float32, top float32) float32 {
+        if base < 0.5 {
+            return 2 * base * top
+        }
+        return 1 - 2 * (1 - base) * (1 - top)
+    },
+    "difference": func(base float32, top float32) float32 {
+        if base > top {
+            return base - top
+        }
+        return top - base
+    },
+}
+
+// Blend another image uploaded with the task (?with names it) into this one with ?mode=multiply
+// (the default), screen, overlay or difference. ?amount (0 to 1, 1 by default) and the other
+// image's own alpha say how much of the blend shows. The other image is stretched to this one's
+// size, and the result keeps this one's alpha.
+func blend(myImage image.Image, params FilterParams) (image.Image, error) {
+    mode := params.String("mode", "multiply")
+    combine, ok := blendModes[mode]
+    if !ok {
+        return nil, fmt.Errorf("parameter %q: must be multiply, screen, overlay or difference", "mode")
+    }
+    amount, err := params.Float("amount", 1)
+    if err != nil {
+        return nil, err
+    }
+    if amount < 0 || amount > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 1", "amount")
+    }
+
+    dst := floatImageFrom(myImage)
+    top, err := inputFloats(params, "with", dst.Rect)
+    if err != nil {
+        return nil, err
+    }
+
+    width := dst.Rect.Dx()
+    parallelTiles(image.Rect(0, 0, width, dst.Rect.Dy()), func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := 4 * (y * width + x)
+                r, g, b, a := straightFloats(dst, i)
+                topR, topG, topB, topA := straightFloats(top, i)
+                mix := float32(amount) * topA
+                for c, pair := range [3][2]float32{{r, topR}, {g, topG}, {b, topB}} {
+                    base := clampUnit(pair[0])
+                    dst.Pix[i + c] = (base + (combine(base, clampUnit(pair[1])) - base) * mix) * a
+                }
+            }
+        }
+    })
+
+    return dst.toImage(myImage), nil
+}
+
+// Move every pixel by an amount read from another image uploaded with the task (?map names it):
+// its red channel moves pixels left (dark) or right (bright), green up or down, and middle grey
+// leaves them where they are. ?scale is how many pixels full red or green moves them (20 by
+// default). The map is stretched to the image's size and pixels past the edges repeat the edge.
+func displace(myImage image.Image, params FilterParams) (image.Image, error) {
+    scale, err := params.Float("scale", 20)
+    if err != nil {
+        return nil, err
+    }
+    if math.Abs(scale) > maxOutputSide {
+        return nil, fmt.Errorf("parameter %q: must be between %d and %d", "scale", -maxOutputSide, maxOutputSide)
+    }
+
+    src := floatImageFrom(myImage)
+    displacement, err := inputFloats(params, "map", src.Rect)
+    if err != nil {
+        return nil, err
+    }
+
+    dst := newFloatImage(src.Rect)
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    bilinear := resamplers["bilinear"]
+    parallelTiles(image.Rect(0, 0, width, height), func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := 4 * (y * width + x)
+                r, g, _, a := straightFloats(displacement, i)
+                // A transparent part of the map doesn't move anything
+                sourceX := float64(x) + float64((r - 0.5) * 2 * a) * scale
+                sourceY := float64(y) + float64((g - 0.5) * 2 * a) * scale
+                sourceX = math.Max(0, math.Min(float64(width - 1), sourceX))
+                sourceY = math.Max(0, math.Min(float64(height - 1), sourceY))
+                sample := sampleFloats(src, sourceX, sourceY, "bilinear", bilinear, [4]float32{})
+                copy(dst.Pix[i:i + 4], sample[:])
+            }
+        }
+    })
+
+    return dst.toImage(myImage), nil
+}
+
+// The uploaded image a parameter names as floats, stretched to the size of rect if it isn't already.
+func inputFloats(params FilterParams, name string, rect image.Rectangle) (*floatImage, error) {
+    myInput, err := params.Input(name)
+    if err != nil {
+        return nil, err
+    }
+    myFloats := floatImageFrom(myInput)
+    if myFloats.Rect.Empty() {
+        return nil, fmt.Errorf("parameter %q: the image %q is empty", name, params.String(name, ""))
+    }
+    if myFloats.Rect.Dx() != rect.Dx() || myFloats.Rect.Dy() != rect.Dy() {
+        myFloats = resizeFloats(myFloats, rect.Dx(), rect.Dy(), "bilinear", resamplers["bilinear"])
+    }
+    return myFloats, nil
+}
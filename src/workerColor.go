@@ -0,0 +1,317 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+    "strings"
+    "unicode"
+)
+
+func init() {
+    registerFilter("hueRotate", FilterFunc(hueRotate))
+    registerFilter("hueSaturation", FilterFunc(hueSaturation))
+    registerFilter("channelMap", FilterFunc(channelMap))
+    registerFilter("colorMatrix", FilterFunc(colorMatrix))
+    registerFilter("selectiveColor", FilterFunc(selectiveColor))
+    registerFilter("sepia", FilterFunc(sepia))
+    registerFilter("duotone", FilterFunc(duotone))
+    registerFilter("gradientMap", FilterFunc(gradientMap))
+}
+
+// Turn every hue ?angle degrees (180 by default) around the colour wheel, red towards yellow.
+func hueRotate(myImage image.Image, params FilterParams) (image.Image, error) {
+    angle, err := params.Float("angle", 180)
+    if err != nil {
+        return nil, err
+    }
+    return adjustHSL(myImage, "hsl", angle, 1, 1), nil
+}
+
+// Shift the hue by ?hue degrees and scale saturation by ?saturation and lightness by ?lightness
+// (0 to 10, 1 by default). ?space=hsl (the default) or hsv says which lightness: HSL lightness
+// goes to white at 2, HSV value keeps the colour and gets brighter.
+func hueSaturation(myImage image.Image, params FilterParams) (image.Image, error) {
+    hue, err := params.Float("hue", 0)
+    if err != nil {
+        return nil, err
+    }
+    saturation, err := scaleParam(params, "saturation")
+    if err != nil {
+        return nil, err
+    }
+    lightness, err := scaleParam(params, "lightness")
+    if err != nil {
+        return nil, err
+    }
+    space := params.String("space", "hsl")
+    if space != "hsl" && space != "hsv" {
+        return nil, fmt.Errorf("parameter %q: must be hsl or hsv", "space")
+    }
+    return adjustHSL(myImage, space, hue, saturation, lightness), nil
+}
+
+// Rearrange the channels: ?order says where every channel of the result comes from, e.g. bgr
+// swaps red and blue and rrr makes a grey image of the red channel. Three letters leave alpha as
+// it is, four (like bgra) set it too.
+func channelMap(myImage image.Image, params FilterParams) (image.Image, error) {
+    order := params.String("order", "")
+    if len(order) != 3 && len(order) != 4 || strings.Trim(order, "rgba") != "" {
+        return nil, fmt.Errorf("parameter %q: must be three or four of r, g, b and a, e.g. bgr", "order")
+    }
+
+    var sources [4]int
+    for i := range sources {
+        sources[i] = i
+    }
+    for i, channel := range order {
+        sources[i] = strings.IndexRune("rgba", channel)
+    }
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        return [4]float64{pixel[sources[0]], pixel[sources[1]], pixel[sources[2]], pixel[sources[3]]}
+    }), nil
+}
+
+// Multiply every colour by ?matrix: 9 numbers (3x3, row by row) mix red, green and blue, 20 numbers
+// (4x5) mix red, green, blue and alpha with a fifth column added as an offset, like SVG's
+// feColorMatrix. Works on straight colours between 0 and 1.
+func colorMatrix(myImage image.Image, params FilterParams) (image.Image, error) {
+    matrix, err := params.Floats("matrix")
+    if err != nil {
+        return nil, err
+    }
+
+    var rows [4][5]float64
+    switch len(matrix) {
+    case 9:
+        for row := 0; row < 3; row++ {
+            copy(rows[row][:3], matrix[3 * row:3 * row + 3])
+        }
+        rows[3][3] = 1
+    case 20:
+        for row := 0; row < 4; row++ {
+            copy(rows[row][:], matrix[5 * row:5 * row + 5])
+        }
+    default:
+        return nil, fmt.Errorf("parameter %q: must be 9 (3x3) or 20 (4x5) numbers", "matrix")
+    }
+
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        var mixed [4]float64
+        for row := range rows {
+            mixed[row] = rows[row][4]
+            for column := 0; column < 4; column++ {
+                mixed[row] += rows[row][column] * pixel[column]
+            }
+        }
+        return mixed
+    }), nil
+}
+
+// Change only the colours whose hue is between ?hueFrom and ?hueTo degrees (330 to 30, the reds,
+// by default, going round through 0): shift their hue by ?hue degrees and scale their saturation and
+// lightness by ?saturation and ?lightness (0 to 10). The change fades out over ?feather degrees
+// (0 to 180, 15 by default) outside the range. Greys have no hue and are left alone.
+func selectiveColor(myImage image.Image, params FilterParams) (image.Image, error) {
+    from, err := params.Float("hueFrom", 330)
+    if err != nil {
+        return nil, err
+    }
+    to, err := params.Float("hueTo", 30)
+    if err != nil {
+        return nil, err
+    }
+    feather, err := params.Float("feather", 15)
+    if err != nil {
+        return nil, err
+    }
+    if feather < 0 || feather > 180 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 180", "feather")
+    }
+    shift, err := params.Float("hue", 0)
+    if err != nil {
+        return nil, err
+    }
+    saturation, err := scaleParam(params, "saturation")
+    if err != nil {
+        return nil, err
+    }
+    lightness, err := scaleParam(params, "lightness")
+    if err != nil {
+        return nil, err
+    }
+
+    from = wrapDegrees(from)
+    width := wrapDegrees(to - from)
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        hue, s, l := rgbToHSL(pixel[0], pixel[1], pixel[2])
+        if s == 0 {
+            return pixel
+        }
+
+        // How far outside the range the hue is, the shorter way round
+        offset := wrapDegrees(hue * 360 - from)
+        weight := 1.0
+        if outside := math.Min(offset - width, 360 - offset); offset > width {
+            weight = 0
+            if feather > 0 {
+                weight = math.Max(0, 1 - outside / feather)
+            }
+        }
+        if weight == 0 {
+            return pixel
+        }
+
+        hue += shift * weight / 360
+        s *= 1 + (saturation - 1) * weight
+        l *= 1 + (lightness - 1) * weight
+        r, g, b := hslToRGB(hue, math.Min(1, s), math.Min(1, l))
+        return [4]float64{r, g, b, pixel[3]}
+    }), nil
+}
+
+// The classic brown tint of old photographs, ?amount of it (0 to 1, 1 by default).
+func sepia(myImage image.Image, params FilterParams) (image.Image, error) {
+    amount, err := params.Float("amount", 1)
+    if err != nil {
+        return nil, err
+    }
+    if amount < 0 || amount > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 1", "amount")
+    }
+
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        r, g, b := pixel[0], pixel[1], pixel[2]
+        toned := [3]float64{
+            0.393 * r + 0.769 * g + 0.189 * b,
+            0.349 * r + 0.686 * g + 0.168 * b,
+            0.272 * r + 0.534 * g + 0.131 * b,
+        }
+        for c := range toned {
+            pixel[c] += (toned[c] - pixel[c]) * amount
+        }
+        return pixel
+    }), nil
+}
+
+// Two colours only: the darkest parts become ?shadows (#1d1452 by default), the brightest
+// ?highlights (#ffd27f by default), and everything in between a mix of them by brightness.
+func duotone(myImage image.Image, params FilterParams) (image.Image, error) {
+    shadows, err := params.Color("shadows", color.NRGBA{0x1d, 0x14, 0x52, 0xff})
+    if err != nil {
+        return nil, err
+    }
+    highlights, err := params.Color("highlights", color.NRGBA{0xff, 0xd2, 0x7f, 0xff})
+    if err != nil {
+        return nil, err
+    }
+    return mapGradient(myImage, []color.NRGBA{shadows, highlights}), nil
+}
+
+// Replace every colour by its place on a gradient through ?colors (two or more, darkest first,
+// evenly spaced), picked by brightness. Black becomes the first colour and white the last.
+func gradientMap(myImage image.Image, params FilterParams) (image.Image, error) {
+    var names []string
+    switch typed := params["colors"].(type) {
+    case []interface{}:
+        for _, item := range typed {
+            names = append(names, fmt.Sprint(item))
+        }
+    case string:
+        names = strings.FieldsFunc(typed, func(c rune) bool {
+            return c == ',' || c == ';' || unicode.IsSpace(c)
+        })
+    }
+    if len(names) < 2 || len(names) > 256 {
+        return nil, fmt.Errorf("parameter %q: must be between 2 and 256 colours", "colors")
+    }
+
+    stops := make([]color.NRGBA, len(names))
+    for i, name := range names {
+        stop, err := FilterParams{"colors": name}.Color("colors", color.NRGBA{})
+        if err != nil {
+            return nil, err
+        }
+        stops[i] = stop
+    }
+    return mapGradient(myImage, stops), nil
+}
+
+// Run the straight colour (and alpha) of every pixel, with channels between 0 and 1, through
+// change. What comes out is clamped to the same range.
+func mapColors(myImage image.Image, change func(pixel [4]float64) [4]float64) image.Image {
+    myFloats := floatImageFrom(myImage)
+    parallelTiles(myFloats.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := myFloats.offset(x, y)
+                r, g, b, a := straightFloats(myFloats, i)
+                pixel := change([4]float64{float64(clampUnit(r)), float64(clampUnit(g)), float64(clampUnit(b)), float64(a)})
+                alpha := float32(math.Max(0, math.Min(1, pixel[3])))
+                for c := 0; c < 3; c++ {
+                    myFloats.Pix[i + c] = float32(math.Max(0, math.Min(1, pixel[c]))) * alpha
+                }
+                myFloats.Pix[i + 3] = alpha
+            }
+        }
+    })
+    return myFloats.toImage(myImage)
+}
+
+// Shift hues by degrees and scale saturation and lightness, in HSL or HSV.
+func adjustHSL(myImage image.Image, space string, degrees float64, saturation float64, lightness float64) image.Image {
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        var r, g, b float64
+        if space == "hsv" {
+            hue, s, v := rgbToHSV(pixel[0], pixel[1], pixel[2])
+            r, g, b = hsvToRGB(hue + degrees / 360, math.Min(1, s * saturation), math.Min(1, v * lightness))
+        } else {
+            hue, s, l := rgbToHSL(pixel[0], pixel[1], pixel[2])
+            r, g, b = hslToRGB(hue + degrees / 360, math.Min(1, s * saturation), math.Min(1, l * lightness))
+        }
+        return [4]float64{r, g, b, pixel[3]}
+    })
+}
+
+// The colour at the luma of every pixel on the gradient through stops, keeping the pixel's alpha
+// times the stop's.
+func mapGradient(myImage image.Image, stops []color.NRGBA) image.Image {
+    return mapColors(myImage, func(pixel [4]float64) [4]float64 {
+        position := luma(pixel[0], pixel[1], pixel[2]) * float64(len(stops) - 1)
+        below := min(int(position), len(stops) - 2)
+        fraction := position - float64(below)
+        var mixed [4]float64
+        for c, pair := range [4][2]uint8{
+            {stops[below].R, stops[below + 1].R},
+            {stops[below].G, stops[below + 1].G},
+            {stops[below].B, stops[below + 1].B},
+            {stops[below].A, stops[below + 1].A},
+        } {
+            mixed[c] = (float64(pair[0]) * (1 - fraction) + float64(pair[1]) * fraction) / 0xff
+        }
+        mixed[3] *= pixel[3]
+        return mixed
+    })
+}
+
+// A factor between 0 and 10, 1 by default.
+func scaleParam(params FilterParams, name string) (float64, error) {
+    value, err := params.Float(name, 1)
+    if err != nil {
+        return 0, err
+    }
+    if value < 0 || value > 10 {
+        return 0, fmt.Errorf("parameter %q: must be between 0 and 10", name)
+    }
+    return value, nil
+}
+
+// An angle in degrees brought to between 0 and 360.
+func wrapDegrees(degrees float64) float64 {
+    degrees = math.Mod(degrees, 360)
+    if degrees < 0 {
+        degrees += 360
+    }
+    return degrees
+}
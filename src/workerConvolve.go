@@ -0,0 +1,461 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+// How a kernel reads pixels that fall outside the image.
+type edgeMode int
+
+const (
+    edgeClamp edgeMode = iota // repeat the outermost pixel
+    edgeWrap // continue from the opposite side
+    edgeMirror // reflect back into the image
+)
+
+// Kernels bigger than this are almost certainly a mistake and would keep a worker busy for minutes.
+const maxKernelRadius = 100
+
+// A custom kernel can't be split into two passes, every pixel reads every weight. Its weights times
+// the pixels of the image are kept under this, a few seconds of work: a 63x63 kernel on a megapixel
+// image, 9x9 on one at the default pixel limit.
+const maxConvolveTaps = 4000000000
+
+// A kernel is a Width x Height grid of weights in row order, anchored on its middle cell.
+type kernel struct {
+    Width int
+    Height int
+    Weights []float64
+}
+
+func init() {
+    registerFilter("boxBlur", FilterFunc(boxBlur))
+    registerFilter("gaussianBlur", FilterFunc(gaussianBlur))
+    registerFilter("unsharpMask", FilterFunc(unsharpMask))
+    registerFilter("sharpen", FilterFunc(sharpen))
+    registerFilter("sobel", FilterFunc(sobel))
+    registerFilter("laplacian", FilterFunc(laplacian))
+    registerFilter("emboss", FilterFunc(emboss))
+    registerFilter("convolve", FilterFunc(customConvolve))
+}
+
+// ?edge=clamp|wrap|mirror, clamp being the default.
+func edgeModeParam(params FilterParams) (edgeMode, error) {
+    switch params.String("edge", "clamp") {
+    case "clamp":
+        return edgeClamp, nil
+    case "wrap":
+        return edgeWrap, nil
+    case "mirror":
+        return edgeMirror, nil
+    }
+    return edgeClamp, fmt.Errorf("parameter %q: must be clamp, wrap or mirror", "edge")
+}
+
+func radiusParam(params FilterParams, fallback int) (int, error) {
+    radius, err := params.Int("radius", fallback)
+    if err != nil {
+        return 0, err
+    }
+    if radius < 0 || radius > maxKernelRadius {
+        return 0, fmt.Errorf("parameter %q: must be between 0 and %d", "radius", maxKernelRadius)
+    }
+    return radius, nil
+}
+
+// Map a coordinate that may be outside [0, n) back into it.
+func edgeIndex(i int, n int, mode edgeMode) int {
+    if i >= 0 && i < n {
+        return i
+    }
+    switch mode {
+    case edgeWrap:
+        i %= n
+        if i < 0 {
+            i += n
+        }
+        return i
+    case edgeMirror:
+        period := 2 * n
+        i %= period
+        if i < 0 {
+            i += period
+        }
+        if i >= n {
+            i = period - 1 - i
+        }
+        return i
+    }
+    if i < 0 {
+        return 0
+    }
+    return n - 1
+}
+
+// For each kernel tap and each position along an axis of length n, the position actually read.
+func edgeTable(taps int, anchor int, n int, mode edgeMode) []int {
+    table := make([]int, taps * n)
+    for tap := 0; tap < taps; tap++ {
+        for i := 0; i < n; i++ {
+            table[tap * n + i] = edgeIndex(i + tap - anchor, n, mode)
+        }
+    }
+    return table
+}
+
+// Convolve every channel with the kernel. When keepAlpha is set the alpha channel is copied from
+// the source instead, which is what kernels summing to zero (edge detection) need so the result
+// doesn't turn fully transparent. The bias is added to the colour channels, scaled by alpha.
+func convolve(src *floatImage, myKernel kernel, mode edgeMode, bias float64, keepAlpha bool) *floatImage {
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    dst := newFloatImage(src.Rect)
+    if width == 0 || height == 0 {
+        return dst
+    }
+
+    anchorX, anchorY := myKernel.Width / 2, myKernel.Height / 2
+    columns := edgeTable(myKernel.Width, anchorX, width, mode)
+    rows := edgeTable(myKernel.Height, anchorY, height, mode)
+
+    parallelTiles(image.Rect(0, 0, width, height), func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                var sum [4]float64
+                for ky := 0; ky < myKernel.Height; ky++ {
+                    rowOffset := rows[ky * height + y] * width
+                    for kx := 0; kx < myKernel.Width; kx++ {
+                        weight := myKernel.Weights[ky * myKernel.Width + kx]
+                        if weight == 0 {
+                            continue
+                        }
+                        i := 4 * (rowOffset + columns[kx * width + x])
+                        sum[0] += weight * float64(src.Pix[i])
+                        sum[1] += weight * float64(src.Pix[i + 1])
+                        sum[2] += weight * float64(src.Pix[i + 2])
+                        sum[3] += weight * float64(src.Pix[i + 3])
+                    }
+                }
+
+                i := 4 * (y * width + x)
+                alpha := sum[3]
+                if keepAlpha {
+                    alpha = float64(src.Pix[i + 3])
+                }
+                dst.Pix[i] = float32(sum[0] + bias * alpha)
+                dst.Pix[i + 1] = float32(sum[1] + bias * alpha)
+                dst.Pix[i + 2] = float32(sum[2] + bias * alpha)
+                dst.Pix[i + 3] = float32(alpha)
+            }
+        }
+    })
+
+    return dst
+}
+
+// A separable kernel (box, Gaussian) is much cheaper as a horizontal pass followed by a vertical one.
+func convolveSeparable(src *floatImage, weights []float64, mode edgeMode) *floatImage {
+    horizontal := kernel{Width: len(weights), Height: 1, Weights: weights}
+    vertical := kernel{Width: 1, Height: len(weights), Weights: weights}
+    return convolve(convolve(src, horizontal, mode, 0, false), vertical, mode, 0, false)
+}
+
+func boxWeights(radius int) []float64 {
+    weights := make([]float64, 2 * radius + 1)
+    for i := range weights {
+        weights[i] = 1 / float64(len(weights))
+    }
+    return weights
+}
+
+func gaussianWeights(radius int, sigma float64) []float64 {
+    weights := make([]float64, 2 * radius + 1)
+    total := 0.0
+    for i := range weights {
+        distance := float64(i - radius)
+        weights[i] = math.Exp(-distance * distance / (2 * sigma * sigma))
+        total += weights[i]
+    }
+    for i := range weights {
+        weights[i] /= total
+    }
+    return weights
+}
+
+// Radius and sigma of a Gaussian blur. Sigma defaults to a third of the radius so the kernel covers
+// three standard deviations.
+func gaussianParams(params FilterParams) (int, float64, error) {
+    radius, err := radiusParam(params, 2)
+    if err != nil {
+        return 0, 0, err
+    }
+    sigma, err := params.Float("sigma", math.Max(float64(radius) / 3, 0.5))
+    if err != nil {
+        return 0, 0, err
+    }
+    if sigma <= 0 {
+        return 0, 0, fmt.Errorf("parameter %q: must be positive", "sigma")
+    }
+    return radius, sigma, nil
+}
+
+// ?radius=1 averages each pixel with its (2*radius+1)^2 neighbourhood.
+func boxBlur(myImage image.Image, params FilterParams) (image.Image, error) {
+    radius, err := radiusParam(params, 1)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    return convolveSeparable(floatImageFrom(myImage), boxWeights(radius), mode).toImage(myImage), nil
+}
+
+// ?radius=2&sigma=0.67
+func gaussianBlur(myImage image.Image, params FilterParams) (image.Image, error) {
+    radius, sigma, err := gaussianParams(params)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    return convolveSeparable(floatImageFrom(myImage), gaussianWeights(radius, sigma), mode).toImage(myImage), nil
+}
+
+// Sharpen by adding back the difference between the image and a Gaussian blur of it.
+// ?amount=1 scales the difference, ?threshold=0 (0 to 1) leaves differences smaller than it alone
+// so flat areas don't get noisy.
+func unsharpMask(myImage image.Image, params FilterParams) (image.Image, error) {
+    radius, sigma, err := gaussianParams(params)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+    amount, err := params.Float("amount", 1)
+    if err != nil {
+        return nil, err
+    }
+    threshold, err := params.Float("threshold", 0)
+    if err != nil {
+        return nil, err
+    }
+
+    src := floatImageFrom(myImage)
+    blurred := convolveSeparable(src, gaussianWeights(radius, sigma), mode)
+    for i := 0; i < len(src.Pix); i += 4 {
+        for c := 0; c < 3; c++ {
+            difference := float64(src.Pix[i + c] - blurred.Pix[i + c])
+            if math.Abs(difference) < threshold {
+                blurred.Pix[i + c] = src.Pix[i + c]
+                continue
+            }
+            blurred.Pix[i + c] = src.Pix[i + c] + float32(amount * difference)
+        }
+        blurred.Pix[i + 3] = src.Pix[i + 3]
+    }
+
+    return blurred.toImage(myImage), nil
+}
+
+// A plain 3x3 sharpening kernel, ?amount=1 sets its strength.
+func sharpen(myImage image.Image, params FilterParams) (image.Image, error) {
+    amount, err := params.Float("amount", 1)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    myKernel := kernel{Width: 3, Height: 3, Weights: []float64{
+        0, -amount, 0,
+        -amount, 1 + 4 * amount, -amount,
+        0, -amount, 0,
+    }}
+    return convolve(floatImageFrom(myImage), myKernel, mode, 0, true).toImage(myImage), nil
+}
+
+// Sobel edge detection: the gradient magnitude of each channel. With ?grayscale=true (the default)
+// the channels are merged into one brightness so the edges come out white on black.
+func sobel(myImage image.Image, params FilterParams) (image.Image, error) {
+    grayscale, err := params.Bool("grayscale", true)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    src := floatImageFrom(myImage)
+    gradientX := convolve(src, kernel{Width: 3, Height: 3, Weights: []float64{
+        -1, 0, 1,
+        -2, 0, 2,
+        -1, 0, 1,
+    }}, mode, 0, true)
+    gradientY := convolve(src, kernel{Width: 3, Height: 3, Weights: []float64{
+        -1, -2, -1,
+        0, 0, 0,
+        1, 2, 1,
+    }}, mode, 0, true)
+
+    for i := 0; i < len(src.Pix); i += 4 {
+        for c := 0; c < 3; c++ {
+            gx, gy := float64(gradientX.Pix[i + c]), float64(gradientY.Pix[i + c])
+            gradientX.Pix[i + c] = float32(math.Hypot(gx, gy))
+        }
+    }
+    if grayscale {
+        grayscaleFloats(gradientX)
+    }
+
+    return gradientX.toImage(myImage), nil
+}
+
+// Laplacian edge detection, ?diagonals=true also takes the diagonal neighbours into account.
+func laplacian(myImage image.Image, params FilterParams) (image.Image, error) {
+    diagonals, err := params.Bool("diagonals", false)
+    if err != nil {
+        return nil, err
+    }
+    grayscale, err := params.Bool("grayscale", true)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    myKernel := kernel{Width: 3, Height: 3, Weights: []float64{
+        0, 1, 0,
+        1, -4, 1,
+        0, 1, 0,
+    }}
+    if diagonals {
+        myKernel.Weights = []float64{
+            1, 1, 1,
+            1, -8, 1,
+            1, 1, 1,
+        }
+    }
+
+    result := convolve(floatImageFrom(myImage), myKernel, mode, 0, true)
+    for i := 0; i < len(result.Pix); i += 4 {
+        for c := 0; c < 3; c++ {
+            if result.Pix[i + c] < 0 {
+                result.Pix[i + c] = -result.Pix[i + c]
+            }
+        }
+    }
+    if grayscale {
+        grayscaleFloats(result)
+    }
+
+    return result.toImage(myImage), nil
+}
+
+// Emboss lighting from the top left, ?strength=1 scales the relief.
+func emboss(myImage image.Image, params FilterParams) (image.Image, error) {
+    strength, err := params.Float("strength", 1)
+    if err != nil {
+        return nil, err
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    myKernel := kernel{Width: 3, Height: 3, Weights: []float64{
+        -2 * strength, -strength, 0,
+        -strength, 1, strength,
+        0, strength, 2 * strength,
+    }}
+    return convolve(floatImageFrom(myImage), myKernel, mode, 0, true).toImage(myImage), nil
+}
+
+// A user supplied kernel: ?kernel=1,2,1,2,4,2,1,2,1 with ?width=3 (defaults to a square kernel).
+// The weights are divided by ?divisor, which defaults to their sum (or 1 when they sum to zero),
+// and ?bias (-1 to 1) is added afterwards. Bigger images allow smaller kernels, see maxConvolveTaps.
+func customConvolve(myImage image.Image, params FilterParams) (image.Image, error) {
+    weights, err := params.Floats("kernel")
+    if err != nil {
+        return nil, err
+    }
+    if len(weights) == 0 {
+        return nil, fmt.Errorf("parameter %q: is required", "kernel")
+    }
+
+    width, err := params.Int("width", int(math.Sqrt(float64(len(weights)))))
+    if err != nil {
+        return nil, err
+    }
+    if width <= 0 || len(weights) % width != 0 {
+        return nil, fmt.Errorf("parameter %q: %d weights can't be split into rows of %d", "kernel", len(weights), width)
+    }
+    height := len(weights) / width
+    if width > 2 * maxKernelRadius + 1 || height > 2 * maxKernelRadius + 1 {
+        return nil, fmt.Errorf("parameter %q: kernel is too big", "kernel")
+    }
+    pixels := myImage.Bounds().Dx() * myImage.Bounds().Dy()
+    if pixels > 0 && len(weights) > maxConvolveTaps / pixels {
+        return nil, fmt.Errorf("parameter %q: %d weights are too many for a %dx%d image, at most %d", "kernel", len(weights), myImage.Bounds().Dx(), myImage.Bounds().Dy(), maxConvolveTaps / pixels)
+    }
+
+    total := 0.0
+    for _, weight := range weights {
+        total += weight
+    }
+    fallbackDivisor := total
+    if math.Abs(total) < 1e-9 {
+        fallbackDivisor = 1
+    }
+    divisor, err := params.Float("divisor", fallbackDivisor)
+    if err != nil {
+        return nil, err
+    }
+    if divisor == 0 {
+        return nil, fmt.Errorf("parameter %q: can't be zero", "divisor")
+    }
+    bias, err := params.Float("bias", 0)
+    if err != nil {
+        return nil, err
+    }
+    if bias < -1 || bias > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between -1 and 1", "bias")
+    }
+    mode, err := edgeModeParam(params)
+    if err != nil {
+        return nil, err
+    }
+
+    scaled := make([]float64, len(weights))
+    for i, weight := range weights {
+        scaled[i] = weight / divisor
+    }
+    // Kernels that sum to zero respond to edges only, convolving alpha with them would erase the image
+    keepAlpha := math.Abs(total / divisor) < 1e-9
+
+    myKernel := kernel{Width: width, Height: height, Weights: scaled}
+    return convolve(floatImageFrom(myImage), myKernel, mode, bias, keepAlpha).toImage(myImage), nil
+}
+
+// Replace the colour channels with their Rec. 601 luma.
+func grayscaleFloats(myFloats *floatImage) {
+    for i := 0; i < len(myFloats.Pix); i += 4 {
+        luma := 0.299 * myFloats.Pix[i] + 0.587 * myFloats.Pix[i + 1] + 0.114 * myFloats.Pix[i + 2]
+        myFloats.Pix[i] = luma
+        myFloats.Pix[i + 1] = luma
+        myFloats.Pix[i + 2] = luma
+    }
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+    "image"
+    "strings"
+    "testing"
+)
+
+// The bigger the image, the fewer weights a custom kernel may have.
+func TestConvolveTapLimit(t *testing.T) {
+    kernel := func(side int) string {
+        return strings.TrimSuffix(strings.Repeat("1,", side * side), ",")
+    }
+    tests := []struct {
+        width int
+        height int
+        side int
+        ok bool
+    }{
+        {64, 64, 201, true},
+        {1000, 1000, 63, true},
+        {1000, 1000, 65, false},
+        {8000, 5000, 9, true},
+        {8000, 5000, 11, false},
+    }
+    for _, test := range tests {
+        // Only the size of the image matters, and a zero divisor stops the filter right after the
+        // kernel has been checked
+        src := &image.NRGBA{Rect: image.Rect(0, 0, test.width, test.height)}
+        _, err := customConvolve(src, FilterParams{"kernel": kernel(test.side), "divisor": 0.0})
+        if err == nil || strings.Contains(err.Error(), "divisor") != test.ok {
+            t.Errorf("%dx%d kernel on a %dx%d image gives %v", test.side, test.side, test.width, test.height, err)
+        }
+    }
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+func init() {
+    registerFilter("expression", FilterFunc(expressionFilter))
+}
+
+// Run ?expression, a little program (see pixelExpression.go), on every pixel, e.g.
+// r = g; g = r; b = (x ^ y) & 255. ?t (0 by default) is readable in it, for animations. The
+// program is compiled once and every goroutine runs it on its own tiles, reading the original
+// image, so neighbours are never half processed.
+func expressionFilter(myImage image.Image, params FilterParams) (image.Image, error) {
+    myProgram, err := compileExpression(params.String("expression", ""))
+    if err != nil {
+        return nil, fmt.Errorf("parameter %q: %v", "expression", err)
+    }
+    t, err := params.Float("t", 0)
+    if err != nil {
+        return nil, err
+    }
+
+    src := floatImageFrom(myImage)
+    dst := newFloatImage(src.Rect)
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    sample := func(x float64, y float64, channel int) float64 {
+        i := src.offset(src.Rect.Min.X + expressionCoordinate(x, width), src.Rect.Min.Y + expressionCoordinate(y, height))
+        r, g, b, a := straightFloats(src, i)
+        return float64([4]float32{r, g, b, a}[channel]) * 0xff
+    }
+
+    parallelTiles(src.Rect, func(tile image.Rectangle) {
+        state := myProgram.newState(sample)
+        state.Slots[exprSlotWidth] = float64(width)
+        state.Slots[exprSlotHeight] = float64(height)
+        state.Slots[exprSlotTime] = t
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := src.offset(x, y)
+                r, g, b, a := straightFloats(src, i)
+                state.Slots[exprSlotX] = float64(x - src.Rect.Min.X)
+                state.Slots[exprSlotY] = float64(y - src.Rect.Min.Y)
+                state.Slots[exprSlotRed] = float64(r) * 0xff
+                state.Slots[exprSlotGreen] = float64(g) * 0xff
+                state.Slots[exprSlotBlue] = float64(b) * 0xff
+                state.Slots[exprSlotAlpha] = float64(a) * 0xff
+
+                pixel := myProgram.run(state)
+                alpha := expressionChannel(pixel[3])
+                for c := 0; c < 3; c++ {
+                    dst.Pix[i + c] = expressionChannel(pixel[c]) * alpha
+                }
+                dst.Pix[i + 3] = alpha
+            }
+        }
+    })
+    return dst.toImage(myImage), nil
+}
+
+// A channel the program worked out, 0 to 255, as a float between 0 and 1. Whatever isn't a number
+// (0 / 0) is 0.
+func expressionChannel(value float64) float32 {
+    if math.IsNaN(value) {
+        return 0
+    }
+    return float32(math.Max(0, math.Min(0xff, value)) / 0xff)
+}
+
+// A coordinate the program asked for, as the nearest pixel inside the image.
+func expressionCoordinate(value float64, size int) int {
+    if math.IsNaN(value) {
+        return 0
+    }
+    return int(math.Max(0, math.Min(float64(size - 1), math.Floor(value))))
+}
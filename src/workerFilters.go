@@ -0,0 +1,340 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// A Filter takes an image plus the parameters sent along with the task and returns the manipulated image.
+type Filter interface {
+    Apply(myImage image.Image, params FilterParams) (image.Image, error)
+}
+
+// FilterFunc lets us register a plain function as a Filter.
+type FilterFunc func(myImage image.Image, params FilterParams) (image.Image, error)
+
+func (myFilter FilterFunc) Apply(myImage image.Image, params FilterParams) (image.Image, error) {
+    return myFilter(myImage, params)
+}
+
+// FilterParams holds the parameters of a task. Values come in as strings when they were sent in a
+// query string and as numbers or booleans when they were sent as JSON, so the getters accept both.
+type FilterParams map[string]interface{}
+
+// Filters register themselves here from their init functions, before any worker goroutine starts.
+var filterRegistry = map[string]Filter{}
+
+func registerFilter(name string, myFilter Filter) {
+    if _, exists := filterRegistry[name]; exists {
+        panic("filter registered twice: " + name)
+    }
+    filterRegistry[name] = myFilter
+}
+
+func lookupFilter(name string) (Filter, error) {
+    if len(name) == 0 {
+        name = defaultFilter
+    }
+    myFilter, ok := filterRegistry[name]
+    if !ok {
+        return nil, fmt.Errorf("unknown filter %q", name)
+    }
+    return myFilter, nil
+}
+
+func (params FilterParams) String(name string, fallback string) string {
+    value, ok := params[name]
+    if !ok || value == nil {
+        return fallback
+    }
+    switch typed := value.(type) {
+    case string:
+        return typed
+    case float64:
+        return strconv.FormatFloat(typed, 'f', -1, 64)
+    default:
+        return fmt.Sprint(typed)
+    }
+}
+
+func (params FilterParams) Float(name string, fallback float64) (float64, error) {
+    value, ok := params[name]
+    if !ok || value == nil {
+        return fallback, nil
+    }
+    switch typed := value.(type) {
+    case float64:
+        return typed, nil
+    case int:
+        return float64(typed), nil
+    case string:
+        parsed, err := strconv.ParseFloat(typed, 64)
+        if err != nil {
+            return fallback, fmt.Errorf("parameter %q: %q is not a number", name, typed)
+        }
+        return parsed, nil
+    }
+    return fallback, fmt.Errorf("parameter %q: expected a number", name)
+}
+
+func (params FilterParams) Int(name string, fallback int) (int, error) {
+    value, err := params.Float(name, float64(fallback))
+    if err != nil {
+        return fallback, err
+    }
+    if value != float64(int(value)) {
+        return fallback, fmt.Errorf("parameter %q: %v is not a whole number", name, value)
+    }
+    return int(value), nil
+}
+
+func (params FilterParams) Bool(name string, fallback bool) (bool, error) {
+    value, ok := params[name]
+    if !ok || value == nil {
+        return fallback, nil
+    }
+    switch typed := value.(type) {
+    case bool:
+        return typed, nil
+    case string:
+        parsed, err := strconv.ParseBool(typed)
+        if err != nil {
+            return fallback, fmt.Errorf("parameter %q: %q is not a boolean", name, typed)
+        }
+        return parsed, nil
+    }
+    return fallback, fmt.Errorf("parameter %q: expected a boolean", name)
+}
+
+// A list of numbers, given either as a JSON array or as a string separated by commas, semicolons or spaces.
+func (params FilterParams) Floats(name string) ([]float64, error) {
+    value, ok := params[name]
+    if !ok || value == nil {
+        return nil, nil
+    }
+
+    var items []interface{}
+    switch typed := value.(type) {
+    case []interface{}:
+        items = typed
+    case string:
+        for _, field := range strings.FieldsFunc(typed, func(c rune) bool {
+            return c == ',' || c == ';' || unicode.IsSpace(c)
+        }) {
+            items = append(items, field)
+        }
+    default:
+        return nil, fmt.Errorf("parameter %q: expected a list of numbers", name)
+    }
+
+    numbers := make([]float64, len(items))
+    for i, item := range items {
+        number, err := FilterParams{name: item}.Float(name, 0)
+        if err != nil {
+            return nil, err
+        }
+        numbers[i] = number
+    }
+    return numbers, nil
+}
+
+// A colour given as #rgb, #rrggbb or #rrggbbaa (the # is optional).
+func (params FilterParams) Color(name string, fallback color.NRGBA) (color.NRGBA, error) {
+    value := strings.TrimPrefix(params.String(name, ""), "#")
+    if len(value) == 0 {
+        return fallback, nil
+    }
+    if len(value) == 3 {
+        value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+    }
+    if len(value) == 6 {
+        value += "ff"
+    }
+    if len(value) != 8 {
+        return fallback, fmt.Errorf("parameter %q: %q is not a #rrggbb or #rrggbbaa colour", name, params.String(name, ""))
+    }
+    channels, err := strconv.ParseUint(value, 16, 32)
+    if err != nil {
+        return fallback, fmt.Errorf("parameter %q: %q is not a #rrggbb or #rrggbbaa colour", name, params.String(name, ""))
+    }
+    return color.NRGBA{uint8(channels >> 24), uint8(channels >> 16), uint8(channels >> 8), uint8(channels)}, nil
+}
+
+// One step of a task's pipeline: the filter to run and the parameters to run it with.
+type PipelineStep struct {
+    Filter string `json:"filter"`
+    Params FilterParams `json:"params"`
+}
+
+// The other images uploaded with a task, by name. Every step gets them under inputsParam, which
+// replaces anything a client sent under that name, and filters look them up with Input.
+type inputImages map[string]image.Image
+
+const inputsParam = "@inputs"
+
+// The uploaded image the parameter names.
+func (params FilterParams) Input(name string) (image.Image, error) {
+    inputName := params.String(name, "")
+    if len(inputName) == 0 {
+        return nil, fmt.Errorf("parameter %q: the name of an image uploaded with the task is required", name)
+    }
+    inputs, _ := params[inputsParam].(inputImages)
+    myImage, ok := inputs[inputName]
+    if !ok {
+        return nil, fmt.Errorf("parameter %q: no image named %q was uploaded with the task", name, inputName)
+    }
+    return myImage, nil
+}
+
+// The task's image limits are there for every step under limitsParam, like the inputs.
+const limitsParam = "@limits"
+
+// The limits of the task the filter runs for, for filters that make bigger images than they get to
+// check the size before they allocate anything. Outside a task the defaults apply.
+func (params FilterParams) Limits() imageLimits {
+    limits, ok := params[limitsParam].(imageLimits)
+    if !ok {
+        return defaultImageLimits
+    }
+    return limits
+}
+
+// Run every step of the pipeline in order, each one working on the output of the previous one.
+// An empty pipeline runs the default filter once. No step may make an image over the limits.
+func applyPipeline(pipeline []PipelineStep, myImage image.Image, inputs inputImages, limits imageLimits) (image.Image, error) {
+    if len(pipeline) == 0 {
+        pipeline = []PipelineStep{{Filter: defaultFilter}}
+    }
+
+    for i, step := range pipeline {
+        myFilter, err := lookupFilter(step.Filter)
+        if err != nil {
+            return nil, fmt.Errorf("step %d: %v", i, err)
+        }
+        params := FilterParams{inputsParam: inputs, limitsParam: limits}
+        for key, value := range step.Params {
+            if key != inputsParam && key != limitsParam {
+                params[key] = value
+            }
+        }
+        myImage, err = myFilter.Apply(myImage, params)
+        if err != nil {
+            return nil, fmt.Errorf("step %d (%s): %v", i, step.Filter, err)
+        }
+        bounds := myImage.Bounds()
+        err = checkOutputSize(bounds.Dx(), bounds.Dy(), limits)
+        if err != nil {
+            return nil, fmt.Errorf("step %d (%s): %v", i, step.Filter, err)
+        }
+    }
+
+    return myImage, nil
+}
+
+func init() {
+    registerFilter("swapRedGreen", FilterFunc(swapRedGreen))
+    registerFilter("channelShift", FilterFunc(channelShift))
+}
+
+// First we create a canvas for drawing, with the bounds and the colour depth of our image. Later we draw on the canvas swapping the red with the green channel, one tile at a time on every core. Alpha stays as it is: swapping two channels gives the same result whether they're premultiplied or not, so we swap whatever the source stores. The canvas is the new modified image.
+func swapRedGreen(myImage image.Image, params FilterParams) (image.Image, error) {
+    bounds := myImage.Bounds()
+
+    switch typed := myImage.(type) {
+    case *image.NRGBA:
+        myCanvas := image.NewNRGBA(bounds)
+        swapRowsRedGreen(bounds, func(y int, minX int, maxX int) ([]uint8, []uint8) {
+            return myCanvas.Pix[myCanvas.PixOffset(minX, y):myCanvas.PixOffset(maxX, y)], typed.Pix[typed.PixOffset(minX, y):typed.PixOffset(maxX, y)]
+        }, 1)
+        return myCanvas, nil
+    case *image.NRGBA64:
+        myCanvas := image.NewNRGBA64(bounds)
+        swapRowsRedGreen(bounds, func(y int, minX int, maxX int) ([]uint8, []uint8) {
+            return myCanvas.Pix[myCanvas.PixOffset(minX, y):myCanvas.PixOffset(maxX, y)], typed.Pix[typed.PixOffset(minX, y):typed.PixOffset(maxX, y)]
+        }, 2)
+        return myCanvas, nil
+    }
+
+    if deepImage(myImage) {
+        myCanvas := image.NewRGBA64(bounds)
+        parallelTiles(bounds, func(tile image.Rectangle) {
+            for y := tile.Min.Y; y < tile.Max.Y; y++ {
+                for x := tile.Min.X; x < tile.Max.X; x++ {
+                    r, g, b, a := myImage.At(x, y).RGBA()
+                    myCanvas.SetRGBA64(x, y, color.RGBA64{uint16(g), uint16(r), uint16(b), uint16(a)})
+                }
+            }
+        })
+        return myCanvas, nil
+    }
+
+    myCanvas := image.NewRGBA(bounds)
+    parallelTiles(bounds, func(tile image.Rectangle) {
+        row := make([]uint8, 4 * tile.Dx())
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            readRowRGBA(myImage, y, tile.Min.X, tile.Max.X, row)
+            copy(myCanvas.Pix[myCanvas.PixOffset(tile.Min.X, y):], row)
+        }
+    })
+    swapRowsRedGreen(bounds, func(y int, minX int, maxX int) ([]uint8, []uint8) {
+        row := myCanvas.Pix[myCanvas.PixOffset(minX, y):myCanvas.PixOffset(maxX, y)]
+        return row, row
+    }, 1)
+    return myCanvas, nil
+}
+
+// Swap the first two channels of every pixel, reading from the source row and writing to the
+// destination row rows returns (they may be the same). Channels are size bytes wide.
+func swapRowsRedGreen(bounds image.Rectangle, rows func(y int, minX int, maxX int) ([]uint8, []uint8), size int) {
+    parallelTiles(bounds, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            dst, src := rows(y, tile.Min.X, tile.Max.X)
+            for i := 0; i < len(src); i += 4 * size {
+                for k := i; k < i + size; k++ {
+                    dst[k], dst[k + size] = src[k + size], src[k]
+                }
+                copy(dst[i + 2 * size:i + 4 * size], src[i + 2 * size:i + 4 * size])
+            }
+        }
+    })
+}
+
+// Chromatic aberration: the red channel is moved ?offset pixels (10 by default) along ?angle
+// (degrees clockwise from pointing right, 0 by default) and blue the same distance the other way.
+func channelShift(myImage image.Image, params FilterParams) (image.Image, error) {
+    offset, err := params.Float("offset", 10)
+    if err != nil {
+        return nil, err
+    }
+    angle, err := params.Float("angle", 0)
+    if err != nil {
+        return nil, err
+    }
+
+    src := floatImageFrom(myImage)
+    dst := newFloatImage(src.Rect)
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    shiftX := int(math.Round(offset * math.Cos(angle * math.Pi / 180)))
+    shiftY := int(math.Round(offset * math.Sin(angle * math.Pi / 180)))
+
+    parallelTiles(image.Rect(0, 0, width, height), func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := 4 * (y * width + x)
+                red := 4 * (edgeIndex(y - shiftY, height, edgeClamp) * width + edgeIndex(x - shiftX, width, edgeClamp))
+                blue := 4 * (edgeIndex(y + shiftY, height, edgeClamp) * width + edgeIndex(x + shiftX, width, edgeClamp))
+                dst.Pix[i] = src.Pix[red]
+                dst.Pix[i + 1] = src.Pix[i + 1]
+                dst.Pix[i + 2] = src.Pix[blue + 2]
+                dst.Pix[i + 3] = max(src.Pix[i + 3], src.Pix[red + 3], src.Pix[blue + 3])
+            }
+        }
+    })
+
+    return dst.toImage(myImage), nil
+}
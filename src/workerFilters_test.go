@@ -0,0 +1,232 @@
+package main
+
+import (
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// Every registered filter needs a schema and every schema a filter: masterService checks new tasks
+// against filterSchemas.
+func TestFilterSchemasMatchRegistry(t *testing.T) {
+    for name := range filterRegistry {
+        if _, ok := filterSchemas[name]; !ok {
+            t.Errorf("filter %q has no schema", name)
+        }
+    }
+    for name := range filterSchemas {
+        if _, ok := filterRegistry[name]; !ok {
+            t.Errorf("schema %q has no filter", name)
+        }
+    }
+}
+
+// A parameter a filter reads but its schema doesn't have is turned away by masterService before the
+// filter ever sees it, and one in the schema the filter never reads does nothing. FilterParams is a
+// plain map, so instead of running the filters this reads their source: the names given to the
+// getters or used as an index of the params, in the filter and every function it hands the params.
+func TestFiltersReadTheirSchemaParams(t *testing.T) {
+    files, err := filepath.Glob("worker*.go")
+    if err != nil {
+        t.Fatal(err)
+    }
+    myReader := &paramReader{Functions: map[string]*ast.FuncDecl{}, Reads: map[string]map[string]bool{}, NameArgs: map[string][]bool{}}
+    registered := map[string]string{}
+    fileSet := token.NewFileSet()
+    for _, file := range files {
+        if strings.HasSuffix(file, "_test.go") {
+            continue
+        }
+        myFile, err := parser.ParseFile(fileSet, file, nil, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, declaration := range myFile.Decls {
+            if function, ok := declaration.(*ast.FuncDecl); ok && function.Recv == nil {
+                myReader.Functions[function.Name.Name] = function
+            }
+        }
+        // registerFilter("name", FilterFunc(function))
+        ast.Inspect(myFile, func(node ast.Node) bool {
+            call, ok := node.(*ast.CallExpr)
+            if !ok || !isCallTo(call, "registerFilter") || len(call.Args) != 2 {
+                return true
+            }
+            name, isName := stringLiteral(call.Args[0])
+            wrapped, isCall := call.Args[1].(*ast.CallExpr)
+            if isName && isCall && isCallTo(wrapped, "FilterFunc") {
+                if function, ok := wrapped.Args[0].(*ast.Ident); ok {
+                    registered[name] = function.Name
+                }
+            }
+            return true
+        })
+    }
+    if len(registered) != len(filterRegistry) {
+        t.Fatalf("found %d filters in the source, %d are registered", len(registered), len(filterRegistry))
+    }
+
+    for name, function := range registered {
+        read := myReader.read(function)
+        known := map[string]bool{}
+        for _, param := range filterSchemas[name].Params {
+            known[param.Name] = true
+            if !read[param.Name] {
+                t.Errorf("filter %q never reads parameter %q of its schema", name, param.Name)
+            }
+        }
+        for _, param := range sortedNames(read) {
+            if !known[param] {
+                t.Errorf("filter %q reads parameter %q, which its schema doesn't have", name, param)
+            }
+        }
+    }
+}
+
+// The parameter names functions read, directly or through the functions they pass their params
+// to, and which of their arguments are used as parameter names.
+type paramReader struct {
+    Functions map[string]*ast.FuncDecl
+    Reads map[string]map[string]bool
+    NameArgs map[string][]bool
+}
+
+var paramGetters = map[string]bool{"String": true, "Float": true, "Int": true, "Bool": true, "Floats": true, "Color": true, "Input": true}
+
+func (myReader *paramReader) read(name string) map[string]bool {
+    if read, done := myReader.Reads[name]; done {
+        return read
+    }
+    read := map[string]bool{}
+    myReader.Reads[name] = read
+    function := myReader.Functions[name]
+    nameArgs := make([]bool, 0)
+    arguments := map[string]int{}
+    params := map[string]bool{}
+    for _, field := range function.Type.Params.List {
+        for _, ident := range field.Names {
+            if typeName, ok := field.Type.(*ast.Ident); ok && typeName.Name == "FilterParams" {
+                params[ident.Name] = true
+            }
+            arguments[ident.Name] = len(nameArgs)
+            nameArgs = append(nameArgs, false)
+        }
+    }
+    myReader.NameArgs[name] = nameArgs
+
+    // Names ranged over, for _, name := range []string{"red", "green", "blue"}, or in a list of
+    // structs, for _, setting := range []struct{...}{{"inBlack", 0}, ...} and setting.Name
+    ranged := map[string][]string{}
+    rangedFields := map[string][]string{}
+    ast.Inspect(function.Body, func(node ast.Node) bool {
+        loop, ok := node.(*ast.RangeStmt)
+        if !ok {
+            return true
+        }
+        value, isIdent := loop.Value.(*ast.Ident)
+        list, isList := loop.X.(*ast.CompositeLit)
+        if isIdent && isList {
+            for _, element := range list.Elts {
+                if text, ok := stringLiteral(element); ok {
+                    ranged[value.Name] = append(ranged[value.Name], text)
+                }
+                if fields, ok := element.(*ast.CompositeLit); ok {
+                    for _, field := range fields.Elts {
+                        if text, ok := stringLiteral(field); ok {
+                            rangedFields[value.Name] = append(rangedFields[value.Name], text)
+                        }
+                    }
+                }
+            }
+        }
+        return true
+    })
+    addName := func(expression ast.Expr) {
+        if text, ok := stringLiteral(expression); ok {
+            read[text] = true
+            return
+        }
+        if ident, ok := expression.(*ast.Ident); ok {
+            for _, text := range ranged[ident.Name] {
+                read[text] = true
+            }
+            if i, ok := arguments[ident.Name]; ok {
+                nameArgs[i] = true
+            }
+        }
+        if selector, ok := expression.(*ast.SelectorExpr); ok {
+            if ident, ok := selector.X.(*ast.Ident); ok {
+                for _, text := range rangedFields[ident.Name] {
+                    read[text] = true
+                }
+            }
+        }
+    }
+
+    ast.Inspect(function.Body, func(node ast.Node) bool {
+        switch node := node.(type) {
+        case *ast.IndexExpr:
+            if ident, ok := node.X.(*ast.Ident); ok && params[ident.Name] {
+                addName(node.Index)
+            }
+        case *ast.CallExpr:
+            if selector, ok := node.Fun.(*ast.SelectorExpr); ok {
+                if ident, ok := selector.X.(*ast.Ident); ok && params[ident.Name] && paramGetters[selector.Sel.Name] && len(node.Args) > 0 {
+                    addName(node.Args[0])
+                }
+                return true
+            }
+            callee, ok := node.Fun.(*ast.Ident)
+            if !ok || myReader.Functions[callee.Name] == nil || !passesParams(node, params) {
+                return true
+            }
+            for text := range myReader.read(callee.Name) {
+                read[text] = true
+            }
+            for i, isName := range myReader.NameArgs[callee.Name] {
+                if isName && i < len(node.Args) {
+                    addName(node.Args[i])
+                }
+            }
+        }
+        return true
+    })
+    return read
+}
+
+func passesParams(call *ast.CallExpr, params map[string]bool) bool {
+    for _, argument := range call.Args {
+        if ident, ok := argument.(*ast.Ident); ok && params[ident.Name] {
+            return true
+        }
+    }
+    return false
+}
+
+func isCallTo(call *ast.CallExpr, name string) bool {
+    ident, ok := call.Fun.(*ast.Ident)
+    return ok && ident.Name == name
+}
+
+func stringLiteral(expression ast.Expr) (string, bool) {
+    literal, ok := expression.(*ast.BasicLit)
+    if !ok || literal.Kind != token.STRING {
+        return "", false
+    }
+    text, err := strconv.Unquote(literal.Value)
+    return text, err == nil
+}
+
+func sortedNames(names map[string]bool) []string {
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+    return sorted
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+)
+
+// Nothing we produce may be bigger than this on either side, whatever the task asks for.
+const maxOutputSide = 16384
+
+// An interpolation kernel and how far from the sample point it reaches.
+type resampler struct {
+    Support float64
+    Kernel func(float64) float64
+}
+
+var resamplers = map[string]resampler{
+    "nearest": {0.5, func(x float64) float64 {
+        if x >= -0.5 && x < 0.5 {
+            return 1
+        }
+        return 0
+    }},
+    "bilinear": {1, func(x float64) float64 {
+        x = math.Abs(x)
+        if x < 1 {
+            return 1 - x
+        }
+        return 0
+    }},
+    // Catmull-Rom, the usual "bicubic"
+    "bicubic": {2, func(x float64) float64 {
+        x = math.Abs(x)
+        if x < 1 {
+            return 1.5 * x * x * x - 2.5 * x * x + 1
+        }
+        if x < 2 {
+            return -0.5 * x * x * x + 2.5 * x * x - 4 * x + 2
+        }
+        return 0
+    }},
+    "lanczos": {3, func(x float64) float64 {
+        if x == 0 {
+            return 1
+        }
+        if x <= -3 || x >= 3 {
+            return 0
+        }
+        piX := math.Pi * x
+        return 3 * math.Sin(piX) * math.Sin(piX / 3) / (piX * piX)
+    }},
+}
+
+func init() {
+    registerFilter("resize", FilterFunc(resize))
+    registerFilter("rotate", FilterFunc(rotate))
+    registerFilter("flip", FilterFunc(flip))
+    registerFilter("crop", FilterFunc(crop))
+}
+
+// ?interpolation=nearest|bilinear|bicubic|lanczos
+func resamplerParam(params FilterParams, fallback string) (string, resampler, error) {
+    name := params.String("interpolation", fallback)
+    myResampler, ok := resamplers[name]
+    if !ok {
+        return name, myResampler, fmt.Errorf("parameter %q: must be nearest, bilinear, bicubic or lanczos", "interpolation")
+    }
+    return name, myResampler, nil
+}
+
+// ?width=...&height=... in pixels. Leaving one of them out (or 0) keeps the aspect ratio.
+func resize(myImage image.Image, params FilterParams) (image.Image, error) {
+    bounds := myImage.Bounds()
+    width, err := params.Int("width", 0)
+    if err != nil {
+        return nil, err
+    }
+    height, err := params.Int("height", 0)
+    if err != nil {
+        return nil, err
+    }
+    name, myResampler, err := resamplerParam(params, "bilinear")
+    if err != nil {
+        return nil, err
+    }
+
+    if width < 0 || height < 0 || width > maxOutputSide || height > maxOutputSide {
+        return nil, fmt.Errorf("width and height must be between 0 and %d", maxOutputSide)
+    }
+    if width == 0 && height == 0 {
+        return nil, fmt.Errorf("parameter %q or %q: at least one is required", "width", "height")
+    }
+    if bounds.Empty() {
+        return nil, fmt.Errorf("can't resize an empty image")
+    }
+    // Keeping the aspect ratio of a thin strip can make the other side huge
+    if width == 0 {
+        side := math.Max(1, math.Round(float64(bounds.Dx()) * float64(height) / float64(bounds.Dy())))
+        if side > maxOutputSide {
+            return nil, taskError{fmt.Errorf("resized image would be %.0f pixels wide, the limit is %d", side, maxOutputSide)}
+        }
+        width = int(side)
+    }
+    if height == 0 {
+        side := math.Max(1, math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx())))
+        if side > maxOutputSide {
+            return nil, taskError{fmt.Errorf("resized image would be %.0f pixels high, the limit is %d", side, maxOutputSide)}
+        }
+        height = int(side)
+    }
+    err = checkOutputSize(width, height, params.Limits())
+    if err != nil {
+        return nil, err
+    }
+
+    return resizeFloats(floatImageFrom(myImage), width, height, name, myResampler).toImage(myImage), nil
+}
+
+// Resize as a horizontal pass and a vertical one. When shrinking the kernel is stretched by the
+// scale factor so every source pixel contributes, otherwise we'd get aliasing. The pass that leaves
+// the smaller image in between goes first, so stretching a strip into a wide banner doesn't hold
+// banner width times strip height pixels.
+func resizeFloats(src *floatImage, width int, height int, name string, myResampler resampler) *floatImage {
+    srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+    columns := resampleWeights(srcWidth, width, name, myResampler)
+    rows := resampleWeights(srcHeight, height, name, myResampler)
+
+    if width * srcHeight <= srcWidth * height {
+        return resamplePass(resamplePass(src, width, srcHeight, columns, true), width, height, rows, false)
+    }
+    return resamplePass(resamplePass(src, srcWidth, height, rows, false), width, height, columns, true)
+}
+
+// One pass of resizeFloats, along x when horizontal and along y otherwise, into a width x height
+// image.
+func resamplePass(src *floatImage, width int, height int, taps [][]resampleTap, horizontal bool) *floatImage {
+    srcWidth := src.Rect.Dx()
+    dst := newFloatImage(image.Rect(0, 0, width, height))
+    parallelTiles(dst.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                var sum [4]float32
+                position := y
+                if horizontal {
+                    position = x
+                }
+                for _, tap := range taps[position] {
+                    i := 4 * (tap.Index * srcWidth + x)
+                    if horizontal {
+                        i = 4 * (y * srcWidth + tap.Index)
+                    }
+                    for c := 0; c < 4; c++ {
+                        sum[c] += tap.Weight * src.Pix[i + c]
+                    }
+                }
+                copy(dst.Pix[4 * (y * width + x):], sum[:])
+            }
+        }
+    })
+    return dst
+}
+
+type resampleTap struct {
+    Index int
+    Weight float32
+}
+
+// For every destination position along an axis, which source positions it reads and how much of each.
+func resampleWeights(srcSize int, dstSize int, name string, myResampler resampler) [][]resampleTap {
+    scale := float64(srcSize) / float64(dstSize)
+    taps := make([][]resampleTap, dstSize)
+
+    for i := range taps {
+        center := (float64(i) + 0.5) * scale - 0.5
+        if name == "nearest" {
+            index := int((float64(i) + 0.5) * scale)
+            if index >= srcSize {
+                index = srcSize - 1
+            }
+            taps[i] = []resampleTap{{index, 1}}
+            continue
+        }
+
+        filterScale := math.Max(scale, 1)
+        support := myResampler.Support * filterScale
+        total := 0.0
+        for j := int(math.Ceil(center - support)); j <= int(math.Floor(center + support)); j++ {
+            weight := myResampler.Kernel((float64(j) - center) / filterScale)
+            if weight == 0 {
+                continue
+            }
+            taps[i] = append(taps[i], resampleTap{edgeIndex(j, srcSize, edgeClamp), float32(weight)})
+            total += weight
+        }
+        for j := range taps[i] {
+            taps[i][j].Weight /= float32(total)
+        }
+    }
+
+    return taps
+}
+
+// ?angle=... in degrees clockwise. The uncovered corners are filled with ?background (a #rrggbbaa
+// colour, transparent by default). With ?expand=true (the default) the canvas grows to fit the
+// whole rotated image, otherwise it keeps its size and the corners get cut off.
+func rotate(myImage image.Image, params FilterParams) (image.Image, error) {
+    angle, err := params.Float("angle", 0)
+    if err != nil {
+        return nil, err
+    }
+    background, err := params.Color("background", color.NRGBA{})
+    if err != nil {
+        return nil, err
+    }
+    expand, err := params.Bool("expand", true)
+    if err != nil {
+        return nil, err
+    }
+    name, myResampler, err := resamplerParam(params, "bilinear")
+    if err != nil {
+        return nil, err
+    }
+
+    src := floatImageFrom(myImage)
+    angle = math.Mod(angle, 360)
+    if angle < 0 {
+        angle += 360
+    }
+    if math.Mod(angle, 90) == 0 && (expand || angle == 180) {
+        return rotateQuarterTurns(src, int(angle / 90)).toImage(myImage), nil
+    }
+
+    radians := angle * math.Pi / 180
+    sin, cos := math.Sin(radians), math.Cos(radians)
+    srcWidth, srcHeight := float64(src.Rect.Dx()), float64(src.Rect.Dy())
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    if expand {
+        // A tiny tolerance so rounding noise doesn't add a whole row of background
+        width = int(math.Ceil(math.Abs(srcWidth * cos) + math.Abs(srcHeight * sin) - 1e-6))
+        height = int(math.Ceil(math.Abs(srcWidth * sin) + math.Abs(srcHeight * cos) - 1e-6))
+    }
+    if width > maxOutputSide || height > maxOutputSide {
+        return nil, fmt.Errorf("rotated image would be bigger than %d pixels", maxOutputSide)
+    }
+    err = checkOutputSize(width, height, params.Limits())
+    if err != nil {
+        return nil, err
+    }
+
+    fill := colorFloats(background)
+    dst := newFloatImage(image.Rect(0, 0, width, height))
+    parallelTiles(image.Rect(0, 0, width, height), func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                // Map the centre of the output pixel back into the source image
+                dx := float64(x) + 0.5 - float64(width) / 2
+                dy := float64(y) + 0.5 - float64(height) / 2
+                sourceX := dx * cos + dy * sin + srcWidth / 2 - 0.5
+                sourceY := -dx * sin + dy * cos + srcHeight / 2 - 0.5
+
+                sample := sampleFloats(src, sourceX, sourceY, name, myResampler, fill)
+                copy(dst.Pix[4 * (y * width + x):], sample[:])
+            }
+        }
+    })
+
+    return dst.toImage(myImage), nil
+}
+
+// Interpolate the source at a point given in pixel coordinates relative to Rect.Min, where
+// (0, 0) is the centre of the first pixel. Taps falling outside the source read the fill colour.
+func sampleFloats(src *floatImage, x float64, y float64, name string, myResampler resampler, fill [4]float32) [4]float32 {
+    srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+    if name == "nearest" {
+        nearestX, nearestY := int(math.Floor(x + 0.5)), int(math.Floor(y + 0.5))
+        if nearestX < 0 || nearestY < 0 || nearestX >= srcWidth || nearestY >= srcHeight {
+            return fill
+        }
+        var sample [4]float32
+        copy(sample[:], src.Pix[4 * (nearestY * srcWidth + nearestX):])
+        return sample
+    }
+
+    var sum [4]float64
+    total := 0.0
+    support := myResampler.Support
+    for j := int(math.Floor(y - support)) + 1; j <= int(math.Floor(y + support)); j++ {
+        weightY := myResampler.Kernel(float64(j) - y)
+        if weightY == 0 {
+            continue
+        }
+        for i := int(math.Floor(x - support)) + 1; i <= int(math.Floor(x + support)); i++ {
+            weight := weightY * myResampler.Kernel(float64(i) - x)
+            if weight == 0 {
+                continue
+            }
+            total += weight
+            if i < 0 || j < 0 || i >= srcWidth || j >= srcHeight {
+                for c := 0; c < 4; c++ {
+                    sum[c] += weight * float64(fill[c])
+                }
+                continue
+            }
+            offset := 4 * (j * srcWidth + i)
+            for c := 0; c < 4; c++ {
+                sum[c] += weight * float64(src.Pix[offset + c])
+            }
+        }
+    }
+
+    var sample [4]float32
+    if total == 0 {
+        return fill
+    }
+    for c := 0; c < 4; c++ {
+        sample[c] = float32(sum[c] / total)
+    }
+    return sample
+}
+
+// Exact rotation by a multiple of 90 degrees clockwise, no resampling needed.
+func rotateQuarterTurns(src *floatImage, turns int) *floatImage {
+    srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+    width, height := srcWidth, srcHeight
+    if turns % 2 == 1 {
+        width, height = srcHeight, srcWidth
+    }
+
+    dst := newFloatImage(image.Rect(0, 0, width, height))
+    for y := 0; y < srcHeight; y++ {
+        for x := 0; x < srcWidth; x++ {
+            dstX, dstY := x, y
+            switch turns {
+            case 1:
+                dstX, dstY = srcHeight - 1 - y, x
+            case 2:
+                dstX, dstY = srcWidth - 1 - x, srcHeight - 1 - y
+            case 3:
+                dstX, dstY = y, srcWidth - 1 - x
+            }
+            copy(dst.Pix[4 * (dstY * width + dstX):4 * (dstY * width + dstX) + 4], src.Pix[4 * (y * srcWidth + x):])
+        }
+    }
+
+    return dst
+}
+
+// ?direction=horizontal|vertical|both, horizontal (mirror left to right) being the default.
+func flip(myImage image.Image, params FilterParams) (image.Image, error) {
+    direction := params.String("direction", "horizontal")
+    if direction != "horizontal" && direction != "vertical" && direction != "both" {
+        return nil, fmt.Errorf("parameter %q: must be horizontal, vertical or both", "direction")
+    }
+
+    src := floatImageFrom(myImage)
+    dst := newFloatImage(image.Rect(0, 0, src.Rect.Dx(), src.Rect.Dy()))
+
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    parallelTiles(dst.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            srcY := y
+            if direction != "horizontal" {
+                srcY = height - 1 - y
+            }
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                srcX := x
+                if direction != "vertical" {
+                    srcX = width - 1 - x
+                }
+                copy(dst.Pix[4 * (y * width + x):4 * (y * width + x) + 4], src.Pix[4 * (srcY * width + srcX):])
+            }
+        }
+    })
+
+    return dst.toImage(myImage), nil
+}
+
+// ?x=...&y=...&width=...&height=... with x and y measured from the top left corner of the image.
+// The rectangle is clipped to the image, and the result starts at (0, 0).
+func crop(myImage image.Image, params FilterParams) (image.Image, error) {
+    bounds := myImage.Bounds()
+    x, err := params.Int("x", 0)
+    if err != nil {
+        return nil, err
+    }
+    y, err := params.Int("y", 0)
+    if err != nil {
+        return nil, err
+    }
+    width, err := params.Int("width", bounds.Dx() - x)
+    if err != nil {
+        return nil, err
+    }
+    height, err := params.Int("height", bounds.Dy() - y)
+    if err != nil {
+        return nil, err
+    }
+
+    if width <= 0 || height <= 0 {
+        return nil, fmt.Errorf("crop rectangle at %d,%d is empty", x, y)
+    }
+    rect := image.Rect(x, y, x + width, y + height).Add(bounds.Min).Intersect(bounds)
+    if rect.Empty() {
+        return nil, fmt.Errorf("crop rectangle %v doesn't overlap the %dx%d image", image.Rect(x, y, x + width, y + height), bounds.Dx(), bounds.Dy())
+    }
+
+    dst := newCanvas(myImage, image.Rect(0, 0, rect.Dx(), rect.Dy()))
+    draw.Draw(dst, dst.Bounds(), myImage, rect.Min, draw.Src)
+    return dst, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "image"
+    "testing"
+)
+
+// An expanded rotation is checked against the limits before its canvas is allocated.
+func TestRotateLimits(t *testing.T) {
+    src := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+    limits := defaultImageLimits
+    limits.MaxPixels = 12000
+    tests := []struct {
+        params FilterParams
+        ok bool
+    }{
+        // 142x142 pixels once expanded
+        {FilterParams{"angle": 45.0}, false},
+        {FilterParams{"angle": 45.0, "expand": false}, true},
+        {FilterParams{"angle": 5.0}, true},
+        {FilterParams{"angle": 90.0}, true},
+    }
+    for _, test := range tests {
+        test.params[limitsParam] = limits
+        result, err := rotate(src, test.params)
+        if test.ok && err != nil {
+            t.Errorf("%v: %v", test.params, err)
+        }
+        if !test.ok {
+            if _, isTaskError := err.(taskError); !isTaskError {
+                t.Errorf("%v gives %v, want a taskError", test.params, err)
+            }
+        }
+        if err == nil && result.Bounds().Dx() * result.Bounds().Dy() > limits.MaxPixels {
+            t.Errorf("%v gives a %v image, more than %d pixels", test.params, result.Bounds(), limits.MaxPixels)
+        }
+    }
+}
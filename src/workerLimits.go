@@ -0,0 +1,56 @@
+package main
+
+import (
+    "sync"
+)
+
+// Every worker goroutine holding a decoded image at the same time could still add up to more than
+// the machine has, so the pixels being worked on are budgeted: a goroutine waits until the images
+// already in flight leave room for its own. An image alone is always let through, the limits keep
+// it below the budget anyway.
+type pixelBudget struct {
+    mutex sync.Mutex
+    cond *sync.Cond
+    used int
+}
+
+func newPixelBudget() *pixelBudget {
+    myBudget := &pixelBudget{}
+    myBudget.cond = sync.NewCond(&myBudget.mutex)
+    return myBudget
+}
+
+func (myBudget *pixelBudget) acquire(pixels int, limit int) {
+    myBudget.mutex.Lock()
+    for myBudget.used > 0 && myBudget.used + pixels > limit {
+        myBudget.cond.Wait()
+    }
+    myBudget.used += pixels
+    myBudget.mutex.Unlock()
+}
+
+// Like acquire but without waiting, for a goroutine that already holds part of the budget: it
+// could otherwise wait for the room it's taking up itself.
+func (myBudget *pixelBudget) take(pixels int) {
+    myBudget.mutex.Lock()
+    myBudget.used += pixels
+    myBudget.mutex.Unlock()
+}
+
+func (myBudget *pixelBudget) release(pixels int) {
+    myBudget.mutex.Lock()
+    myBudget.used -= pixels
+    myBudget.mutex.Unlock()
+    myBudget.cond.Broadcast()
+}
+
+// Filters that make an image bigger than the one they get check its size with this before they
+// allocate it, so a resize of a thin strip to 16384 pixels wide can't take the worker down. It's a
+// taskError: the same parameters will never give a smaller image.
+func checkOutputSize(width int, height int, limits imageLimits) error {
+    err := checkImageSize(width, height, 1, limits)
+    if err != nil {
+        return taskError{err}
+    }
+    return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "hash/crc32"
+    "image"
+    "sort"
+)
+
+// Decode an image and turn it upright if it's a JPEG whose EXIF orientation says so. The task's
+// own image goes through decodeAnimation instead, its EXIF data is needed again for the output.
+func decodeOriented(data []byte) (image.Image, error) {
+    myImage, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    return orientImage(myImage, imageOrientation(data)), nil
+}
+
+// The EXIF fields of the groups the task keeps, written as the small TIFF file that goes into a
+// JPEG's APP1 segment or a PNG's eXIf chunk. "all" is every group. The orientation is never kept,
+// the result is upright already. nil when nothing is left.
+func encodeEXIF(myEXIF *exifData, groups []string) []byte {
+    if myEXIF == nil || len(groups) == 0 {
+        return nil
+    }
+    wanted := map[[2]int]bool{}
+    keepGPS := false
+    for _, group := range groups {
+        for name, tags := range metadataGroups {
+            if group != name && group != "all" {
+                continue
+            }
+            keepGPS = keepGPS || name == "gps"
+            for _, tag := range tags {
+                wanted[[2]int{tag.IFD, int(tag.Tag)}] = true
+            }
+        }
+    }
+
+    var ifds [3][]exifField
+    for _, field := range myEXIF.Fields {
+        if wanted[[2]int{field.IFD, int(field.Tag)}] || (field.IFD == exifGPSIFD && keepGPS) {
+            ifds[field.IFD] = append(ifds[field.IFD], field)
+        }
+    }
+    if len(ifds[exifImageIFD]) + len(ifds[exifPhotoIFD]) + len(ifds[exifGPSIFD]) == 0 {
+        return nil
+    }
+
+    // IFD0 comes right after the header and points to the other two, which follow it
+    pointerTags := map[int]uint16{exifPhotoIFD: exifTagPhotoIFD, exifGPSIFD: exifTagGPSIFD}
+    for _, ifd := range []int{exifPhotoIFD, exifGPSIFD} {
+        if len(ifds[ifd]) > 0 {
+            ifds[exifImageIFD] = append(ifds[exifImageIFD], exifField{IFD: exifImageIFD, Tag: pointerTags[ifd], Type: 4, Count: 1, Value: make([]byte, 4)})
+        }
+    }
+    offsets := [3]int{}
+    next := 8
+    for ifd := range ifds {
+        if len(ifds[ifd]) > 0 {
+            offsets[ifd] = next
+            next += exifIFDSize(ifds[ifd])
+        }
+    }
+    for i, field := range ifds[exifImageIFD] {
+        for ifd, tag := range pointerTags {
+            if field.Tag == tag {
+                myEXIF.Order.PutUint32(ifds[exifImageIFD][i].Value, uint32(offsets[ifd]))
+            }
+        }
+    }
+
+    header := []byte("II*\x00\x08\x00\x00\x00")
+    if myEXIF.Order == binary.BigEndian {
+        header = []byte("MM\x00*\x00\x00\x00\x08")
+    }
+    data := append([]byte{}, header...)
+    for ifd := range ifds {
+        if len(ifds[ifd]) > 0 {
+            data = writeEXIFIFD(data, ifds[ifd], myEXIF.Order)
+        }
+    }
+    return data
+}
+
+// Entries, the offset of the next directory (none) and the values that don't fit in an entry.
+func exifIFDSize(fields []exifField) int {
+    size := 2 + 12 * len(fields) + 4
+    for _, field := range fields {
+        if len(field.Value) > 4 {
+            size += len(field.Value) + len(field.Value) % 2
+        }
+    }
+    return size
+}
+
+// Append a directory at the end of data, its entries sorted by tag as TIFF wants them.
+func writeEXIFIFD(data []byte, fields []exifField, order binary.ByteOrder) []byte {
+    sort.Slice(fields, func(i, j int) bool {
+        return fields[i].Tag < fields[j].Tag
+    })
+
+    start := len(data)
+    valuesAt := start + 2 + 12 * len(fields) + 4
+    data = append(data, make([]byte, exifIFDSize(fields))...)
+    order.PutUint16(data[start:], uint16(len(fields)))
+    for i, field := range fields {
+        entry := data[start + 2 + 12 * i:]
+        order.PutUint16(entry[0:2], field.Tag)
+        order.PutUint16(entry[2:4], field.Type)
+        order.PutUint32(entry[4:8], field.Count)
+        if len(field.Value) <= 4 {
+            copy(entry[8:12], field.Value)
+            continue
+        }
+        order.PutUint32(entry[8:12], uint32(valuesAt))
+        copy(data[valuesAt:], field.Value)
+        valuesAt += len(field.Value) + len(field.Value) % 2
+    }
+    return data
+}
+
+// Put EXIF data into an encoded image: an APP1 segment right after the start of a JPEG, an eXIf
+// chunk right after the header of a PNG. Other formats have no place for it and stay as they are,
+// so does a JPEG whose EXIF data is too big for one segment.
+func embedEXIF(format string, encoded []byte, tiff []byte) []byte {
+    if len(tiff) == 0 {
+        return encoded
+    }
+    switch format {
+    case "jpeg":
+        if len(encoded) < 2 || 2 + 6 + len(tiff) > 0xFFFF {
+            return encoded
+        }
+        segment := []byte{0xFF, 0xE1, 0, 0}
+        binary.BigEndian.PutUint16(segment[2:], uint16(2 + 6 + len(tiff)))
+        segment = append(append(segment, "Exif\x00\x00"...), tiff...)
+        return append(append(append([]byte{}, encoded[:2]...), segment...), encoded[2:]...)
+    case "png":
+        // Signature (8 bytes) and IHDR (25 bytes), eXIf has to come before the image data
+        const afterHeader = 33
+        if len(encoded) < afterHeader {
+            return encoded
+        }
+        chunk := make([]byte, 4, 12 + len(tiff))
+        binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+        chunk = append(append(chunk, "eXIf"...), tiff...)
+        chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+        return append(append(append([]byte{}, encoded[:afterHeader]...), chunk...), encoded[afterHeader:]...)
+    }
+    return encoded
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+    "image/gif"
+    "image/jpeg"
+    "image/png"
+    "io"
+)
+
+// How the finished image gets encoded, as sent by masterService. Zero values mean "the default".
+type OutputOptions struct {
+    Format string `json:"format"`
+    Quality int `json:"quality,omitempty"`
+    Compression string `json:"compression,omitempty"`
+    PaletteSize int `json:"paletteSize,omitempty"`
+    // Characters per line and the characters to use, for the text formats
+    Width int `json:"width,omitempty"`
+    Ramp string `json:"ramp,omitempty"`
+    // EXIF field groups to carry over from the original (JPEG or PNG output only), none by default
+    Metadata []string `json:"metadata,omitempty"`
+}
+
+// An outputEncoder writes the finished image in one format. The content type is what storageService
+// is told the bytes are. Text formats render still images only, animations are rendered by their
+// first frame.
+type outputEncoder struct {
+    ContentType string
+    Encode func(writer io.Writer, myImage image.Image, options OutputOptions) error
+    Text bool
+}
+
+var outputEncoders = map[string]outputEncoder{
+    "png": {"image/png", encodePNG, false},
+    "jpeg": {"image/jpeg", encodeJPEG, false},
+    "gif": {"image/gif", encodeGIF, false},
+    "text": {"text/plain; charset=utf-8", encodeText, true},
+    "ansi": {"text/plain; charset=utf-8", encodeANSI, true},
+    "html": {"text/html; charset=utf-8", encodeHTML, true},
+}
+
+// The encoder for the task's output, PNG when none was chosen.
+func lookupOutputEncoder(options OutputOptions) (string, outputEncoder, error) {
+    format := options.Format
+    if len(format) == 0 {
+        format = "png"
+    }
+    myEncoder, ok := outputEncoders[format]
+    if !ok {
+        return format, myEncoder, taskError{fmt.Errorf("unknown output format %q", format)}
+    }
+    return format, myEncoder, nil
+}
+
+func encodePNG(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    levels := map[string]png.CompressionLevel{
+        "": png.DefaultCompression,
+        "default": png.DefaultCompression,
+        "none": png.NoCompression,
+        "speed": png.BestSpeed,
+        "best": png.BestCompression,
+    }
+    level, ok := levels[options.Compression]
+    if !ok {
+        return taskError{fmt.Errorf("unknown PNG compression %q", options.Compression)}
+    }
+
+    myEncoder := png.Encoder{CompressionLevel: level}
+    return myEncoder.Encode(writer, myImage)
+}
+
+func encodeJPEG(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    quality := options.Quality
+    if quality == 0 {
+        quality = jpeg.DefaultQuality
+    }
+    if quality < 1 || quality > 100 {
+        return taskError{fmt.Errorf("JPEG quality %d is not between 1 and 100", quality)}
+    }
+    return jpeg.Encode(writer, myImage, &jpeg.Options{Quality: quality})
+}
+
+func encodeGIF(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    paletteSize := options.PaletteSize
+    if paletteSize == 0 {
+        paletteSize = 256
+    }
+    if paletteSize < 2 || paletteSize > 256 {
+        return taskError{fmt.Errorf("GIF palette size %d is not between 2 and 256", paletteSize)}
+    }
+    // The default quantizer just takes the first colours of the Plan 9 palette, ours fits the image.
+    // Paletted images (from the quantize filter) are written with their own palette if it fits.
+    return gif.Encode(writer, myImage, &gif.Options{
+        NumColors: paletteSize,
+        Quantizer: medianCutQuantizer{},
+        Drawer: draw.FloydSteinberg,
+    })
+}
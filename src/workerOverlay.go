@@ -0,0 +1,377 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+func init() {
+    registerFilter("overlay", FilterFunc(overlay))
+}
+
+// Logos are small, anything bigger than this on either side is refused before decoding.
+const maxLogoSide = 2048
+
+// Captions and watermarks: ?text (lines split by \n) drawn with the built-in font, every font pixel
+// ?size image pixels big (2 by default), in ?color (#fff by default) with an optional ?outline
+// colour ?outlineWidth pixels wide (size by default). ?logo is an image as base64 (a data: URL
+// works too), scaled by ?logoScale and drawn above the text. The whole block goes to ?position
+// (topLeft, top, topRight, left, center, right, bottomLeft, bottom or bottomRight, the default)
+// ?margin pixels (8 by default) from the edges, or to ?x and ?y when given. ?opacity (0 to 1) is
+// for the text, ?logoOpacity for the logo (the same as the text by default).
+func overlay(myImage image.Image, params FilterParams) (image.Image, error) {
+    text := params.String("text", "")
+    size, err := params.Int("size", 2)
+    if err != nil {
+        return nil, err
+    }
+    if size < 1 || size > 64 {
+        return nil, fmt.Errorf("parameter %q: must be between 1 and 64", "size")
+    }
+    fill, err := params.Color("color", color.NRGBA{0xff, 0xff, 0xff, 0xff})
+    if err != nil {
+        return nil, err
+    }
+    outline, err := params.Color("outline", color.NRGBA{})
+    if err != nil {
+        return nil, err
+    }
+    outlineWidth, err := params.Int("outlineWidth", size)
+    if err != nil {
+        return nil, err
+    }
+    if outlineWidth < 0 || outlineWidth > 64 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 64", "outlineWidth")
+    }
+    if len(params.String("outline", "")) == 0 {
+        outlineWidth = 0
+    }
+    opacity, err := params.Float("opacity", 1)
+    if err != nil {
+        return nil, err
+    }
+    if opacity < 0 || opacity > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 1", "opacity")
+    }
+    logoOpacity, err := params.Float("logoOpacity", opacity)
+    if err != nil {
+        return nil, err
+    }
+    if logoOpacity < 0 || logoOpacity > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 1", "logoOpacity")
+    }
+    margin, err := params.Int("margin", 8)
+    if err != nil {
+        return nil, err
+    }
+    logo, err := logoParam(params, myImage.Bounds())
+    if err != nil {
+        return nil, err
+    }
+    if len(text) == 0 && logo == nil {
+        return nil, fmt.Errorf("parameter %q or %q: at least one is required", "text", "logo")
+    }
+
+    // The block is the logo stacked on top of the text, both centred in it
+    textMask, textWidth, textHeight, err := renderText(text, size, outlineWidth, params.Limits())
+    if err != nil {
+        return nil, err
+    }
+    blockWidth, blockHeight := textWidth, textHeight
+    if logo != nil {
+        blockWidth = max(blockWidth, logo.Rect.Dx())
+        blockHeight += logo.Rect.Dy()
+        if textHeight > 0 {
+            blockHeight += size
+        }
+    }
+
+    dst := floatImageFrom(myImage)
+    left, top, err := overlayOrigin(params, dst.Rect, blockWidth, blockHeight, margin)
+    if err != nil {
+        return nil, err
+    }
+
+    textTop := top
+    if logo != nil {
+        logoLeft := left + (blockWidth - logo.Rect.Dx()) / 2
+        for y := 0; y < logo.Rect.Dy(); y++ {
+            for x := 0; x < logo.Rect.Dx(); x++ {
+                i := logo.offset(logo.Rect.Min.X + x, logo.Rect.Min.Y + y)
+                blendPixel(dst, logoLeft + x, top + y, [4]float32{logo.Pix[i], logo.Pix[i + 1], logo.Pix[i + 2], logo.Pix[i + 3]}, float32(logoOpacity))
+            }
+        }
+        textTop += logo.Rect.Dy() + size
+    }
+
+    textLeft := left + (blockWidth - textWidth) / 2
+    fillFloats, outlineFloats := colorFloats(fill), colorFloats(outline)
+    for y := 0; y < textHeight; y++ {
+        for x := 0; x < textWidth; x++ {
+            switch textMask[y * textWidth + x] {
+            case textFill:
+                blendPixel(dst, textLeft + x, textTop + y, fillFloats, float32(opacity))
+            case textOutline:
+                blendPixel(dst, textLeft + x, textTop + y, outlineFloats, float32(opacity))
+            }
+        }
+    }
+
+    return dst.toImage(myImage), nil
+}
+
+// What a pixel of rendered text is
+const (
+    textNone = iota
+    textFill
+    textOutline
+)
+
+// Render the lines of text into a mask of textNone, textFill and textOutline pixels, returned with
+// its width and height. Characters are a font pixel apart, lines too, and the outline goes around
+// everything. The mask is checked against the limits like any image before it's allocated, a long
+// enough text at size 64 would be bigger than the machine otherwise.
+func renderText(text string, size int, outlineWidth int, limits imageLimits) ([]uint8, int, int, error) {
+    if len(text) == 0 {
+        return nil, 0, 0, nil
+    }
+    lines := strings.Split(text, "\n")
+    columns := 0
+    for _, line := range lines {
+        columns = max(columns, len([]rune(line)))
+    }
+    width := max(columns * (fontWidth + 1) - 1, 0) * size + 2 * outlineWidth
+    height := (len(lines) * (fontHeight + 1) - 1) * size + 2 * outlineWidth
+    err := checkOutputSize(width, height, limits)
+    if err != nil {
+        return nil, 0, 0, fmt.Errorf("parameter %q: %v", "text", err)
+    }
+    mask := make([]uint8, width * height)
+
+    for row, line := range lines {
+        for column, char := range []rune(line) {
+            glyph := fontGlyph(char)
+            for glyphY := 0; glyphY < fontHeight; glyphY++ {
+                for glyphX := 0; glyphX < fontWidth; glyphX++ {
+                    if glyph[glyphY] & (1 << (fontWidth - 1 - glyphX)) == 0 {
+                        continue
+                    }
+                    // Every font pixel is a size x size square
+                    left := outlineWidth + (column * (fontWidth + 1) + glyphX) * size
+                    top := outlineWidth + (row * (fontHeight + 1) + glyphY) * size
+                    for y := top; y < top + size; y++ {
+                        for x := left; x < left + size; x++ {
+                            mask[y * width + x] = textFill
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    // The outline is every pixel within outlineWidth of the text (a square around every text
+    // pixel) that isn't text itself. A square is a row of pixels stretched into a column, so the
+    // text is widened along the rows first and then along the columns, counting text pixels in a
+    // sliding window.
+    if outlineWidth > 0 {
+        near := make([]bool, width * height)
+        dilate := func(count int, length int, index func(line int, position int) int, filled func(i int) bool) {
+            for line := 0; line < count; line++ {
+                inside := 0
+                for position := 0; position < length + outlineWidth; position++ {
+                    if position < length && filled(index(line, position)) {
+                        inside++
+                    }
+                    if leaving := position - 2 * outlineWidth - 1; leaving >= 0 && filled(index(line, leaving)) {
+                        inside--
+                    }
+                    if center := position - outlineWidth; center >= 0 {
+                        near[index(line, center)] = inside > 0
+                    }
+                }
+            }
+        }
+        dilate(height, width, func(y int, x int) int { return y * width + x }, func(i int) bool { return mask[i] == textFill })
+        across := append([]bool{}, near...)
+        dilate(width, height, func(x int, y int) int { return y * width + x }, func(i int) bool { return across[i] })
+        for i, isNear := range near {
+            if isNear && mask[i] == textNone {
+                mask[i] = textOutline
+            }
+        }
+    }
+
+    return mask, width, height, nil
+}
+
+// The top left corner of a width x height block, from ?x and ?y or from ?position and the margin.
+func overlayOrigin(params FilterParams, bounds image.Rectangle, width int, height int, margin int) (int, int, error) {
+    _, hasX := params["x"]
+    _, hasY := params["y"]
+    if hasX || hasY {
+        x, err := params.Int("x", 0)
+        if err != nil {
+            return 0, 0, err
+        }
+        y, err := params.Int("y", 0)
+        if err != nil {
+            return 0, 0, err
+        }
+        return bounds.Min.X + x, bounds.Min.Y + y, nil
+    }
+
+    position := params.String("position", "bottomRight")
+    horizontal := map[string]int{
+        "topLeft": 0, "left": 0, "bottomLeft": 0,
+        "top": 1, "center": 1, "bottom": 1,
+        "topRight": 2, "right": 2, "bottomRight": 2,
+    }
+    vertical := map[string]int{
+        "topLeft": 0, "top": 0, "topRight": 0,
+        "left": 1, "center": 1, "right": 1,
+        "bottomLeft": 2, "bottom": 2, "bottomRight": 2,
+    }
+    column, ok := horizontal[position]
+    if !ok {
+        return 0, 0, fmt.Errorf("parameter %q: must be topLeft, top, topRight, left, center, right, bottomLeft, bottom or bottomRight", "position")
+    }
+    row := vertical[position]
+
+    place := func(start int, space int, size int, where int) int {
+        switch where {
+        case 0:
+            return start + margin
+        case 1:
+            return start + (space - size) / 2
+        }
+        return start + space - size - margin
+    }
+    return place(bounds.Min.X, bounds.Dx(), width, column), place(bounds.Min.Y, bounds.Dy(), height, row), nil
+}
+
+// Draw a premultiplied colour over the pixel at (x, y), if it's inside the image.
+func blendPixel(dst *floatImage, x int, y int, over [4]float32, opacity float32) {
+    if !(image.Point{x, y}).In(dst.Rect) {
+        return
+    }
+    i := dst.offset(x, y)
+    keep := 1 - over[3] * opacity
+    for c := 0; c < 4; c++ {
+        dst.Pix[i + c] = over[c] * opacity + dst.Pix[i + c] * keep
+    }
+}
+
+// Decode ?logo and scale it by ?logoScale, nil when there's no logo. Scaling up stops where the
+// logo would no longer fit the image it goes on, no bigger than it was if it didn't to start with.
+func logoParam(params FilterParams, bounds image.Rectangle) (*floatImage, error) {
+    encoded := params.String("logo", "")
+    if len(encoded) == 0 {
+        return nil, nil
+    }
+    // A data URL has the base64 after the comma
+    if strings.HasPrefix(encoded, "data:") {
+        encoded = encoded[strings.Index(encoded, ",") + 1:]
+    }
+    data, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, fmt.Errorf("parameter %q: not base64: %v", "logo", err)
+    }
+    config, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("parameter %q: not a supported image: %v", "logo", err)
+    }
+    if config.Width > maxLogoSide || config.Height > maxLogoSide {
+        return nil, fmt.Errorf("parameter %q: can't be bigger than %d pixels on either side", "logo", maxLogoSide)
+    }
+    myLogo, err := decodeOriented(data)
+    if err != nil {
+        return nil, fmt.Errorf("parameter %q: not a supported image: %v", "logo", err)
+    }
+
+    scale, err := params.Float("logoScale", 1)
+    if err != nil {
+        return nil, err
+    }
+    if scale <= 0 || scale > 16 {
+        return nil, fmt.Errorf("parameter %q: must be more than 0 and at most 16", "logoScale")
+    }
+    logo := floatImageFrom(myLogo)
+    if scale > 1 && !logo.Rect.Empty() {
+        fit := math.Min(float64(bounds.Dx()) / float64(logo.Rect.Dx()), float64(bounds.Dy()) / float64(logo.Rect.Dy()))
+        scale = math.Min(scale, math.Max(1, fit))
+    }
+    if scale != 1 && !logo.Rect.Empty() {
+        width := int(math.Max(1, math.Round(float64(logo.Rect.Dx()) * scale)))
+        height := int(math.Max(1, math.Round(float64(logo.Rect.Dy()) * scale)))
+        logo = resizeFloats(logo, width, height, "bilinear", resamplers["bilinear"])
+    }
+    return logo, nil
+}
+
+// The watermark last read from the key-value store and what it turned into, so it's only checked
+// (and a bad one only complained about) once for every value the operator sets.
+var watermarkCache struct {
+    mutex sync.Mutex
+    value string
+    step *PipelineStep
+}
+
+// The cluster wide watermark: when the key-value store has a "watermark" (the parameters of an
+// overlay step, as JSON), every task gets that step added to the end of its pipeline, so nothing
+// leaves the cluster without it. A watermark that isn't valid is the operator's mistake, not the
+// client's: it's reported once and tasks go on without it until it's fixed.
+func watermarkStep(kVStoreAddress string) (*PipelineStep, error) {
+    response, err := http.Get("http://" + kVStoreAddress + "/get?key=watermark")
+    if err != nil {
+        return nil, err
+    }
+    data, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return nil, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Can't get watermark: %s", data)
+    }
+    if len(data) == 0 {
+        return nil, nil
+    }
+
+    watermarkCache.mutex.Lock()
+    defer watermarkCache.mutex.Unlock()
+    if watermarkCache.value != string(data) {
+        step, err := parseWatermark(data)
+        if err != nil {
+            fmt.Println("Error 🚫: Ignoring the watermark:", err)
+        }
+        watermarkCache.value, watermarkCache.step = string(data), step
+    }
+    return watermarkCache.step, nil
+}
+
+// Check the watermark against the overlay schema and draw it once on a single pixel, which catches
+// what the schema can't say, like a logo that isn't an image.
+func parseWatermark(data []byte) (*PipelineStep, error) {
+    step := &PipelineStep{Filter: "overlay"}
+    err := json.Unmarshal(data, &step.Params)
+    if err != nil {
+        return nil, fmt.Errorf("not a JSON object of overlay parameters: %v", err)
+    }
+    problems := checkStepParams(filterSchemas, 0, step.Filter, step.Params, nil)
+    if len(problems) > 0 {
+        return nil, problems[0]
+    }
+    _, err = overlay(image.NewNRGBA(image.Rect(0, 0, 1, 1)), step.Params)
+    if err != nil {
+        return nil, err
+    }
+    return step, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "math"
+    "sort"
+)
+
+// Palettes are built from at most this many pixels, picked evenly over the image.
+const maxPaletteSamples = 1 << 16
+
+// medianCutQuantizer is a draw.Quantizer (what image/gif wants for its palette) using median cut.
+type medianCutQuantizer struct{}
+
+func (myQuantizer medianCutQuantizer) Quantize(myPalette color.Palette, myImage image.Image) color.Palette {
+    return append(myPalette, medianCut(myImage, cap(myPalette) - len(myPalette))...)
+}
+
+// A box of colours for median cut, the colours being straight RGB.
+type colorBox []color.NRGBA
+
+// Spread of the box along its widest channel, and which channel that is.
+func (myBox colorBox) widest() (int, int) {
+    var low, high [3]uint8
+    for i, myColor := range myBox {
+        channels := [3]uint8{myColor.R, myColor.G, myColor.B}
+        for c := 0; c < 3; c++ {
+            if i == 0 || channels[c] < low[c] {
+                low[c] = channels[c]
+            }
+            if i == 0 || channels[c] > high[c] {
+                high[c] = channels[c]
+            }
+        }
+    }
+    channel := 0
+    for c := 1; c < 3; c++ {
+        if high[c] - low[c] > high[channel] - low[channel] {
+            channel = c
+        }
+    }
+    return int(high[channel] - low[channel]), channel
+}
+
+func (myBox colorBox) average() color.NRGBA {
+    var r, g, b int
+    for _, myColor := range myBox {
+        r += int(myColor.R)
+        g += int(myColor.G)
+        b += int(myColor.B)
+    }
+    n := len(myBox)
+    return color.NRGBA{uint8((r + n / 2) / n), uint8((g + n / 2) / n), uint8((b + n / 2) / n), 0xff}
+}
+
+// Sample the colours of an image, at most maxPaletteSamples of them. Mostly transparent pixels are
+// left out and only counted.
+func samplePalette(myImage image.Image) (colorBox, int) {
+    bounds := myImage.Bounds()
+    step := 1
+    for bounds.Dx() * bounds.Dy() / (step * step) > maxPaletteSamples {
+        step++
+    }
+
+    samples := colorBox{}
+    transparent := 0
+    for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+        for x := bounds.Min.X; x < bounds.Max.X; x += step {
+            myColor := color.NRGBAModel.Convert(myImage.At(x, y)).(color.NRGBA)
+            if myColor.A < 0x80 {
+                transparent++
+                continue
+            }
+            samples = append(samples, myColor)
+        }
+    }
+    return samples, transparent
+}
+
+// Build a palette of at most size colours by splitting the box with the widest spread of colours
+// at its median until there are enough boxes, then taking the average of every box. When the image
+// has transparent parts one entry is kept for fully transparent.
+func medianCut(myImage image.Image, size int) color.Palette {
+    samples, transparent := samplePalette(myImage)
+    myPalette := color.Palette{}
+    if transparent > 0 && size > 0 {
+        myPalette = append(myPalette, color.NRGBA{})
+        size--
+    }
+    if len(samples) == 0 || size <= 0 {
+        return myPalette
+    }
+
+    boxes := []colorBox{samples}
+    for len(boxes) < size {
+        chosen, chosenSpread, chosenChannel := -1, 0, 0
+        for i, myBox := range boxes {
+            spread, channel := myBox.widest()
+            if len(myBox) > 1 && spread > chosenSpread {
+                chosen, chosenSpread, chosenChannel = i, spread, channel
+            }
+        }
+        if chosen == -1 {
+            break
+        }
+
+        myBox := boxes[chosen]
+        sort.Slice(myBox, func(i int, j int) bool {
+            return channelOf(myBox[i], chosenChannel) < channelOf(myBox[j], chosenChannel)
+        })
+        median := len(myBox) / 2
+        boxes[chosen] = myBox[:median]
+        boxes = append(boxes, myBox[median:])
+    }
+
+    for _, myBox := range boxes {
+        myPalette = append(myPalette, myBox.average())
+    }
+    return myPalette
+}
+
+func channelOf(myColor color.NRGBA, channel int) uint8 {
+    switch channel {
+    case 0:
+        return myColor.R
+    case 1:
+        return myColor.G
+    }
+    return myColor.B
+}
+
+// k-means needs a few rounds to settle, more rarely changes anything visible.
+const kMeansRounds = 8
+
+// Build a palette of at most size colours by k-means: starting from the median cut palette, every
+// sampled colour is assigned to its nearest palette entry and every entry moved to the average of
+// its colours, a few times over. Slower than median cut, but the colours fit the image better.
+func kMeans(myImage image.Image, size int) color.Palette {
+    samples, transparent := samplePalette(myImage)
+    myPalette := medianCut(myImage, size)
+    first := 0
+    if transparent > 0 && len(myPalette) > 0 {
+        // The transparent entry stays as it is
+        first = 1
+    }
+    centres := make([][3]float64, len(myPalette) - first)
+    for i := range centres {
+        myColor := myPalette[first + i].(color.NRGBA)
+        centres[i] = [3]float64{float64(myColor.R), float64(myColor.G), float64(myColor.B)}
+    }
+    if len(centres) == 0 {
+        return myPalette
+    }
+
+    for round := 0; round < kMeansRounds; round++ {
+        sums := make([][3]float64, len(centres))
+        counts := make([]int, len(centres))
+        for _, myColor := range samples {
+            sample := [3]float64{float64(myColor.R), float64(myColor.G), float64(myColor.B)}
+            nearest, nearestDistance := 0, math.Inf(1)
+            for i, centre := range centres {
+                distance := (sample[0] - centre[0]) * (sample[0] - centre[0]) + (sample[1] - centre[1]) * (sample[1] - centre[1]) + (sample[2] - centre[2]) * (sample[2] - centre[2])
+                if distance < nearestDistance {
+                    nearest, nearestDistance = i, distance
+                }
+            }
+            for c := 0; c < 3; c++ {
+                sums[nearest][c] += sample[c]
+            }
+            counts[nearest]++
+        }
+
+        moved := false
+        for i := range centres {
+            // An entry nobody picked keeps its colour
+            if counts[i] == 0 {
+                continue
+            }
+            for c := 0; c < 3; c++ {
+                average := sums[i][c] / float64(counts[i])
+                moved = moved || math.Abs(average - centres[i][c]) > 0.5
+                centres[i][c] = average
+            }
+        }
+        if !moved {
+            break
+        }
+    }
+
+    for i, centre := range centres {
+        myPalette[first + i] = color.NRGBA{uint8(centre[0] + 0.5), uint8(centre[1] + 0.5), uint8(centre[2] + 0.5), 0xff}
+    }
+    return myPalette
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+    "math"
+    "math/rand"
+    "sort"
+)
+
+func init() {
+    registerFilter("pixelSort", FilterFunc(pixelSort))
+}
+
+// The value of a pixel that pixel sorting orders by (and decides runs with), between 0 and 1.
+type pixelKey func(r float64, g float64, b float64) float64
+
+var pixelKeys = map[string]pixelKey{
+    "brightness": luma,
+    "hue": func(r float64, g float64, b float64) float64 {
+        hue, _, _ := rgbToHSV(r, g, b)
+        return hue
+    },
+    "saturation": func(r float64, g float64, b float64) float64 {
+        _, saturation, _ := rgbToHSV(r, g, b)
+        return saturation
+    },
+}
+
+func pixelKeyParam(params FilterParams, name string, fallback string) (pixelKey, error) {
+    myKey, ok := pixelKeys[params.String(name, fallback)]
+    if !ok {
+        return nil, fmt.Errorf("parameter %q: must be brightness, hue or saturation", name)
+    }
+    return myKey, nil
+}
+
+// Pixel sorting: the image is cut into lines (?direction=rows|columns|angle, with ?angle in degrees
+// clockwise for the last one). Along every line, runs of pixels whose ?thresholdBy value lies
+// between ?lower and ?upper get sorted by ?sortBy (brightness, hue or saturation), ?reverse flips
+// the order. ?randomness (0 to 1) is the chance of cutting a run short at any pixel, which gives
+// the ragged look, and ?seed makes that reproducible.
+func pixelSort(myImage image.Image, params FilterParams) (image.Image, error) {
+    angle := 0.0
+    switch direction := params.String("direction", "rows"); direction {
+    case "rows":
+    case "columns":
+        angle = 90
+    case "angle":
+        var err error
+        angle, err = params.Float("angle", 0)
+        if err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("parameter %q: must be rows, columns or angle", "direction")
+    }
+
+    sortKey, err := pixelKeyParam(params, "sortBy", "brightness")
+    if err != nil {
+        return nil, err
+    }
+    thresholdKey, err := pixelKeyParam(params, "thresholdBy", params.String("sortBy", "brightness"))
+    if err != nil {
+        return nil, err
+    }
+    lower, err := params.Float("lower", 0.25)
+    if err != nil {
+        return nil, err
+    }
+    upper, err := params.Float("upper", 0.8)
+    if err != nil {
+        return nil, err
+    }
+    reverse, err := params.Bool("reverse", false)
+    if err != nil {
+        return nil, err
+    }
+    randomness, err := params.Float("randomness", 0)
+    if err != nil {
+        return nil, err
+    }
+    if randomness < 0 || randomness > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 1", "randomness")
+    }
+    seed, err := params.Int("seed", 0)
+    if err != nil {
+        return nil, err
+    }
+
+    // Pixels are moved around as they are stored, straight and with 8 or 16 bits per channel
+    bounds := myImage.Bounds()
+    myCanvas := newCanvas(myImage, image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+    draw.Draw(myCanvas, myCanvas.Bounds(), myImage, bounds.Min, draw.Src)
+    pixels := sortPixels{Size: 1}
+    switch typed := myCanvas.(type) {
+    case *image.NRGBA:
+        pixels.Pix = typed.Pix
+    case *image.NRGBA64:
+        pixels.Pix, pixels.Size = typed.Pix, 2
+    }
+
+    for lineIndex, line := range sortLines(bounds.Dx(), bounds.Dy(), angle) {
+        // Every line gets its own generator so the result doesn't depend on the order lines are handled in
+        random := rand.New(rand.NewSource(int64(seed) * 1000003 + int64(lineIndex)))
+        sortLine(pixels, line, sortKey, thresholdKey, lower, upper, reverse, randomness, random)
+    }
+
+    return myCanvas, nil
+}
+
+// The pixel buffer of an NRGBA (Size 1) or NRGBA64 (Size 2, big endian) canvas, Size being the
+// bytes per channel.
+type sortPixels struct {
+    Pix []uint8
+    Size int
+}
+
+func (pixels sortPixels) at(offset int) []uint8 {
+    return pixels.Pix[4 * pixels.Size * offset:4 * pixels.Size * (offset + 1)]
+}
+
+// Channel c of a pixel as returned by at, between 0 and 1.
+func (pixels sortPixels) channel(myPixel []uint8, c int) float64 {
+    if pixels.Size == 2 {
+        return float64(uint16(myPixel[2 * c]) << 8 | uint16(myPixel[2 * c + 1])) / 0xffff
+    }
+    return float64(myPixel[c]) / 0xff
+}
+
+// Cut a width x height grid into parallel lines at the angle (degrees clockwise from horizontal),
+// every pixel ending up in exactly one line. Each line lists pixel offsets (y * width + x) in
+// order along its direction.
+func sortLines(width int, height int, angle float64) [][]int {
+    radians := angle * math.Pi / 180
+    alongX, alongY := math.Cos(radians), math.Sin(radians)
+
+    // Which line a pixel centre falls on is its distance across the lines, rounded down
+    across := func(x int, y int) int {
+        return int(math.Floor(-(float64(x) + 0.5) * alongY + (float64(y) + 0.5) * alongX))
+    }
+    minLine, maxLine := 0, 0
+    for i, corner := range [][2]int{{0, 0}, {width - 1, 0}, {0, height - 1}, {width - 1, height - 1}} {
+        line := across(corner[0], corner[1])
+        if i == 0 || line < minLine {
+            minLine = line
+        }
+        if i == 0 || line > maxLine {
+            maxLine = line
+        }
+    }
+
+    lines := make([][]int, maxLine - minLine + 1)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            line := across(x, y) - minLine
+            lines[line] = append(lines[line], y * width + x)
+        }
+    }
+
+    // Raster order is already right for rows, anything else needs sorting by position along the line
+    if alongY != 0 || alongX < 0 {
+        for _, line := range lines {
+            sort.SliceStable(line, func(i int, j int) bool {
+                xi, yi := line[i] % width, line[i] / width
+                xj, yj := line[j] % width, line[j] / width
+                return float64(xi) * alongX + float64(yi) * alongY < float64(xj) * alongX + float64(yj) * alongY
+            })
+        }
+    }
+
+    return lines
+}
+
+func sortLine(pixels sortPixels, line []int, sortKey pixelKey, thresholdKey pixelKey, lower float64, upper float64, reverse bool, randomness float64, random *rand.Rand) {
+    type sortedPixel struct {
+        Key float64
+        Color [8]uint8
+    }
+    run := []sortedPixel{}
+    runStart := 0
+
+    flush := func(end int) {
+        if len(run) > 1 {
+            sort.SliceStable(run, func(i int, j int) bool {
+                if reverse {
+                    return run[i].Key > run[j].Key
+                }
+                return run[i].Key < run[j].Key
+            })
+            for i, myPixel := range run {
+                copy(pixels.at(line[runStart + i]), myPixel.Color[:])
+            }
+        }
+        run = run[:0]
+        runStart = end
+    }
+
+    for i, offset := range line {
+        myPixel := pixels.at(offset)
+        r, g, b := pixels.channel(myPixel, 0), pixels.channel(myPixel, 1), pixels.channel(myPixel, 2)
+        value := thresholdKey(r, g, b)
+        if value < lower || value > upper {
+            flush(i + 1)
+            continue
+        }
+        if len(run) > 0 && randomness > 0 && random.Float64() < randomness {
+            flush(i)
+        }
+        sorted := sortedPixel{Key: sortKey(r, g, b)}
+        copy(sorted.Color[:], myPixel)
+        run = append(run, sorted)
+    }
+    flush(len(line))
+}
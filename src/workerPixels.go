@@ -0,0 +1,333 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "runtime"
+    "sync"
+)
+
+// Work is split into tiles of this many pixels square, handed out to one goroutine per core.
+const tileSize = 128
+
+// Call work for every tile of rect, several tiles at a time. Tiles never overlap, so work may write
+// to its own tile of a shared buffer without locking.
+func parallelTiles(rect image.Rectangle, work func(tile image.Rectangle)) {
+    tiles := make(chan image.Rectangle)
+    myWG := sync.WaitGroup{}
+    for i := 0; i < runtime.NumCPU(); i++ {
+        myWG.Add(1)
+        go func() {
+            defer myWG.Done()
+            for tile := range tiles {
+                work(tile)
+            }
+        }()
+    }
+    for y := rect.Min.Y; y < rect.Max.Y; y += tileSize {
+        for x := rect.Min.X; x < rect.Max.X; x += tileSize {
+            tiles <- image.Rect(x, y, min(x + tileSize, rect.Max.X), min(y + tileSize, rect.Max.Y))
+        }
+    }
+    close(tiles)
+    myWG.Wait()
+}
+
+// Read pixels minX to maxX of row y as premultiplied 8 bit RGBA into row (four bytes per pixel).
+// The common decoder outputs are read straight from their pixel buffers, anything else goes
+// through At.
+func readRowRGBA(myImage image.Image, y int, minX int, maxX int, row []uint8) {
+    switch typed := myImage.(type) {
+    case *image.RGBA:
+        start := typed.PixOffset(minX, y)
+        copy(row, typed.Pix[start:start + 4 * (maxX - minX)])
+        return
+    case *image.NRGBA:
+        pixels := typed.Pix[typed.PixOffset(minX, y):]
+        for i := 0; i < 4 * (maxX - minX); i += 4 {
+            a := uint32(pixels[i + 3])
+            row[i] = uint8((uint32(pixels[i]) * a + 127) / 255)
+            row[i + 1] = uint8((uint32(pixels[i + 1]) * a + 127) / 255)
+            row[i + 2] = uint8((uint32(pixels[i + 2]) * a + 127) / 255)
+            row[i + 3] = uint8(a)
+        }
+        return
+    case *image.YCbCr:
+        for x := minX; x < maxX; x++ {
+            yIndex, cIndex := typed.YOffset(x, y), typed.COffset(x, y)
+            r, g, b := color.YCbCrToRGB(typed.Y[yIndex], typed.Cb[cIndex], typed.Cr[cIndex])
+            i := 4 * (x - minX)
+            row[i], row[i + 1], row[i + 2], row[i + 3] = r, g, b, 0xff
+        }
+        return
+    case *image.Gray:
+        pixels := typed.Pix[typed.PixOffset(minX, y):]
+        for x := 0; x < maxX - minX; x++ {
+            row[4 * x], row[4 * x + 1], row[4 * x + 2], row[4 * x + 3] = pixels[x], pixels[x], pixels[x], 0xff
+        }
+        return
+    case *image.Paletted:
+        // Look every palette entry up once rather than converting it for every pixel
+        var lookup [256][4]uint8
+        for i, entry := range typed.Palette {
+            r, g, b, a := entry.RGBA()
+            lookup[i] = [4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+        }
+        pixels := typed.Pix[typed.PixOffset(minX, y):]
+        for x := 0; x < maxX - minX; x++ {
+            copy(row[4 * x:4 * x + 4], lookup[pixels[x]][:])
+        }
+        return
+    }
+
+    for x := minX; x < maxX; x++ {
+        r, g, b, a := myImage.At(x, y).RGBA()
+        i := 4 * (x - minX)
+        row[i], row[i + 1], row[i + 2], row[i + 3] = uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)
+    }
+}
+
+// A floatImage keeps premultiplied RGBA values between 0 and 1 for every pixel, four floats per
+// pixel in row order. Neighbourhood filters read and write this instead of going through At/Set
+// for every tap of their kernels.
+type floatImage struct {
+    Rect image.Rectangle
+    Pix []float32
+}
+
+func newFloatImage(rect image.Rectangle) *floatImage {
+    return &floatImage{
+        Rect: rect,
+        Pix: make([]float32, 4 * rect.Dx() * rect.Dy()),
+    }
+}
+
+// Copy any image into a floatImage with the same bounds.
+func floatImageFrom(myImage image.Image) *floatImage {
+    bounds := myImage.Bounds()
+    myFloats := newFloatImage(bounds)
+
+    parallelTiles(bounds, func(tile image.Rectangle) {
+        row := make([]uint8, 4 * tile.Dx())
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            dst := myFloats.Pix[myFloats.offset(tile.Min.X, y):myFloats.offset(tile.Min.X, y) + 4 * tile.Dx()]
+            switch typed := myImage.(type) {
+            case *image.RGBA, *image.YCbCr, *image.Gray:
+                // Already premultiplied 8 bit values, nothing is lost going through bytes
+                readRowRGBA(myImage, y, tile.Min.X, tile.Max.X, row)
+                for i, value := range row {
+                    dst[i] = float32(value) / 0xff
+                }
+            case *image.NRGBA:
+                // Premultiplied as floats, rounding to 8 bits first would lose the darker shades of
+                // half transparent pixels
+                pixels := typed.Pix[typed.PixOffset(tile.Min.X, y):]
+                for i := range dst {
+                    dst[i] = float32(pixels[i]) / 0xff
+                    if i % 4 == 3 {
+                        dst[i - 3] *= dst[i]
+                        dst[i - 2] *= dst[i]
+                        dst[i - 1] *= dst[i]
+                    }
+                }
+            case *image.NRGBA64:
+                pixels := typed.Pix[typed.PixOffset(tile.Min.X, y):]
+                for i := range dst {
+                    dst[i] = float32(uint16(pixels[2 * i]) << 8 | uint16(pixels[2 * i + 1])) / 0xffff
+                    if i % 4 == 3 {
+                        dst[i - 3] *= dst[i]
+                        dst[i - 2] *= dst[i]
+                        dst[i - 1] *= dst[i]
+                    }
+                }
+            default:
+                // Other 16 bit images keep their precision this way
+                for x := tile.Min.X; x < tile.Max.X; x++ {
+                    r, g, b, a := myImage.At(x, y).RGBA()
+                    i := 4 * (x - tile.Min.X)
+                    dst[i] = float32(r) / 0xffff
+                    dst[i + 1] = float32(g) / 0xffff
+                    dst[i + 2] = float32(b) / 0xffff
+                    dst[i + 3] = float32(a) / 0xffff
+                }
+            }
+        }
+    })
+
+    return myFloats
+}
+
+// Index of the first of the four values of the pixel at (x, y), which must be inside Rect.
+func (myFloats *floatImage) offset(x, y int) int {
+    return 4 * ((y - myFloats.Rect.Min.Y) * myFloats.Rect.Dx() + (x - myFloats.Rect.Min.X))
+}
+
+// Turn the floats back into an image with the same depth as like: NRGBA64 when like has 16 bits
+// per channel, NRGBA otherwise. Values are clamped to [0, alpha] so overshooting kernels
+// (sharpening, edges) can't give colours brighter than their alpha allows, and are then divided by
+// alpha, so half transparent pixels keep the precision of their colour instead of having it
+// rounded away at 8 bits of premultiplied value.
+func (myFloats *floatImage) toImage(like image.Image) image.Image {
+    var shallow *image.NRGBA
+    var deep *image.NRGBA64
+    var myCanvas image.Image
+    if deepImage(like) {
+        deep = image.NewNRGBA64(myFloats.Rect)
+        myCanvas = deep
+    } else {
+        shallow = image.NewNRGBA(myFloats.Rect)
+        myCanvas = shallow
+    }
+
+    parallelTiles(myFloats.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            src := myFloats.Pix[myFloats.offset(tile.Min.X, y):myFloats.offset(tile.Min.X, y) + 4 * tile.Dx()]
+            for i := 0; i < len(src); i += 4 {
+                var straight [4]float32
+                if a := clampUnit(src[i + 3]); a > 0 {
+                    straight = [4]float32{clampTo(src[i], a) / a, clampTo(src[i + 1], a) / a, clampTo(src[i + 2], a) / a, a}
+                }
+
+                x := tile.Min.X + i / 4
+                if deep != nil {
+                    pixels := deep.Pix[deep.PixOffset(x, y):]
+                    for c, value := range straight {
+                        channel := uint16(value * 0xffff + 0.5)
+                        pixels[2 * c], pixels[2 * c + 1] = uint8(channel >> 8), uint8(channel)
+                    }
+                    continue
+                }
+                pixels := shallow.Pix[shallow.PixOffset(x, y):]
+                for c, value := range straight {
+                    pixels[c] = uint8(value * 0xff + 0.5)
+                }
+            }
+        }
+    })
+
+    return myCanvas
+}
+
+// Whether an image has more than 8 bits per channel, which filters keep in their results.
+func deepImage(myImage image.Image) bool {
+    switch myImage.ColorModel() {
+    case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+        return true
+    }
+    return false
+}
+
+// A blank canvas for the result of a filter on myImage, with straight alpha and 16 bits per channel
+// when myImage has them.
+func newCanvas(myImage image.Image, rect image.Rectangle) draw.Image {
+    if deepImage(myImage) {
+        return image.NewNRGBA64(rect)
+    }
+    return image.NewNRGBA(rect)
+}
+
+// The premultiplied floats of a single colour, in the same layout as floatImage.Pix.
+func colorFloats(myColor color.Color) [4]float32 {
+    r, g, b, a := myColor.RGBA()
+    return [4]float32{float32(r) / 0xffff, float32(g) / 0xffff, float32(b) / 0xffff, float32(a) / 0xffff}
+}
+
+func clampUnit(value float32) float32 {
+    return clampTo(value, 1)
+}
+
+func clampTo(value float32, limit float32) float32 {
+    if value < 0 {
+        return 0
+    }
+    if value > limit {
+        return limit
+    }
+    return value
+}
+
+// Hue (0 to 1, red at 0), saturation and value of a straight (not premultiplied) colour with
+// channels between 0 and 1.
+func rgbToHSV(r float64, g float64, b float64) (float64, float64, float64) {
+    maxChannel := math.Max(r, math.Max(g, b))
+    minChannel := math.Min(r, math.Min(g, b))
+    delta := maxChannel - minChannel
+
+    hue := 0.0
+    switch {
+    case delta == 0:
+        hue = 0
+    case maxChannel == r:
+        hue = math.Mod((g - b) / delta, 6)
+    case maxChannel == g:
+        hue = (b - r) / delta + 2
+    default:
+        hue = (r - g) / delta + 4
+    }
+    hue /= 6
+    if hue < 0 {
+        hue += 1
+    }
+
+    saturation := 0.0
+    if maxChannel > 0 {
+        saturation = delta / maxChannel
+    }
+    return hue, saturation, maxChannel
+}
+
+// The straight colour of a hue (0 to 1), saturation and value.
+func hsvToRGB(hue float64, saturation float64, value float64) (float64, float64, float64) {
+    chroma := value * saturation
+    r, g, b := hueChroma(hue, chroma)
+    return r + value - chroma, g + value - chroma, b + value - chroma
+}
+
+// Hue (0 to 1, the same as rgbToHSV's), saturation and lightness of a straight colour.
+func rgbToHSL(r float64, g float64, b float64) (float64, float64, float64) {
+    hue, _, maxChannel := rgbToHSV(r, g, b)
+    minChannel := math.Min(r, math.Min(g, b))
+    lightness := (maxChannel + minChannel) / 2
+
+    saturation := 0.0
+    if delta := maxChannel - minChannel; delta > 0 {
+        saturation = delta / (1 - math.Abs(2 * lightness - 1))
+    }
+    return hue, saturation, lightness
+}
+
+// The straight colour of a hue (0 to 1), saturation and lightness.
+func hslToRGB(hue float64, saturation float64, lightness float64) (float64, float64, float64) {
+    chroma := (1 - math.Abs(2 * lightness - 1)) * saturation
+    r, g, b := hueChroma(hue, chroma)
+    return r + lightness - chroma / 2, g + lightness - chroma / 2, b + lightness - chroma / 2
+}
+
+// The fully saturated colour of a hue (0 to 1) scaled to chroma, before lifting by the minimum channel.
+func hueChroma(hue float64, chroma float64) (float64, float64, float64) {
+    sector := math.Mod(hue, 1) * 6
+    if sector < 0 {
+        sector += 6
+    }
+    second := chroma * (1 - math.Abs(math.Mod(sector, 2) - 1))
+    switch int(sector) {
+    case 0:
+        return chroma, second, 0
+    case 1:
+        return second, chroma, 0
+    case 2:
+        return 0, chroma, second
+    case 3:
+        return 0, second, chroma
+    case 4:
+        return second, 0, chroma
+    }
+    return chroma, 0, second
+}
+
+// Rec. 601 luma of a colour with channels between 0 and 1.
+func luma(r float64, g float64, b float64) float64 {
+    return 0.299 * r + 0.587 * g + 0.114 * b
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "image/png"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Where workers look for plugins when the command line doesn't say
+const defaultPluginDirectory = "plugins"
+
+// Limits of a plugin run, unless its declaration sets its own
+const defaultPluginTimeout = 30
+const maxPluginTimeout = 600
+const defaultPluginMemory = 1024
+
+// More output than this is not an image we'd accept anyway
+const maxPluginOutput = 512 << 20
+
+// How much of what a plugin writes to stderr ends up in the task's error
+const maxPluginErrorOutput = 4096
+
+// A filter that runs another program, declared by a JSON file in the plugin directory:
+//
+//     {"name": "oilPaint", "description": "...", "command": ["./oil-paint", "--fast"],
+//      "params": [{"name": "radius", "type": "integer", "min": 1, "max": 20, "default": 4}],
+//      "timeout": 30, "maxMemory": 1024}
+//
+// The command runs in the plugin directory, so relative paths work. Every time the filter runs it
+// gets one line of JSON with the parameters (with their types and defaults from the declaration)
+// and then the image as PNG on stdin, and has to write the result in any format we can decode to
+// stdout. A non-zero exit fails the step, with what it wrote to stderr as the message; stderr is
+// free for warnings otherwise. It's killed after timeout seconds
+// (30 by default, at most 600), and can use at most maxMemory MB (1024 by default) of memory and
+// timeout seconds of CPU time.
+type pluginConfig struct {
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Command []string `json:"command"`
+    Params []paramSchema `json:"params"`
+    Timeout int `json:"timeout"`
+    MaxMemory int `json:"maxMemory"`
+}
+
+type pluginFilter struct {
+    config pluginConfig
+    directory string
+}
+
+// Register every plugin declared in the directory (*.json, in name order) as a filter with its
+// schema. A missing directory just means there are no plugins. The schemas come back so they can
+// be published for masterService.
+func loadPlugins(directory string) ([]filterSchema, error) {
+    paths, err := filepath.Glob(filepath.Join(directory, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(paths)
+
+    schemas := []filterSchema{}
+    for _, path := range paths {
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        config := pluginConfig{}
+        err = json.Unmarshal(data, &config)
+        if err != nil {
+            return nil, fmt.Errorf("plugin %s: %v", path, err)
+        }
+        err = checkPluginConfig(&config)
+        if err != nil {
+            return nil, fmt.Errorf("plugin %s: %v", path, err)
+        }
+
+        absolute, err := filepath.Abs(directory)
+        if err != nil {
+            return nil, err
+        }
+        schema := filterSchema{Name: config.Name, Description: config.Description, Params: config.Params}
+        registerFilter(config.Name, pluginFilter{config, absolute})
+        filterSchemas[config.Name] = schema
+        schemas = append(schemas, schema)
+    }
+    return schemas, nil
+}
+
+// Fill in the default limits and make sure the declaration makes sense before anything runs it.
+func checkPluginConfig(config *pluginConfig) error {
+    if !validName(config.Name) {
+        return fmt.Errorf("name %q must be letters and digits", config.Name)
+    }
+    if _, exists := filterRegistry[config.Name]; exists {
+        return fmt.Errorf("there already is a filter named %q", config.Name)
+    }
+    if len(config.Command) == 0 {
+        return fmt.Errorf("command is required")
+    }
+    if config.Timeout == 0 {
+        config.Timeout = defaultPluginTimeout
+    }
+    if config.Timeout < 1 || config.Timeout > maxPluginTimeout {
+        return fmt.Errorf("timeout must be between 1 and %d seconds", maxPluginTimeout)
+    }
+    if config.MaxMemory == 0 {
+        config.MaxMemory = defaultPluginMemory
+    }
+    if config.MaxMemory < 16 {
+        return fmt.Errorf("maxMemory must be at least 16 MB")
+    }
+
+    if config.Params == nil {
+        config.Params = []paramSchema{}
+    }
+    names := map[string]bool{}
+    for _, param := range config.Params {
+        switch param.Type {
+        case "number", "integer", "boolean", "text", "color", "numbers", "colors", "image":
+        default:
+            return fmt.Errorf("parameter %q: type must be number, integer, boolean, text, color, numbers, colors or image", param.Name)
+        }
+        if len(param.Name) == 0 || names[param.Name] || param.Name == inputsParam {
+            return fmt.Errorf("parameter %q: needs a name of its own", param.Name)
+        }
+        names[param.Name] = true
+    }
+    return nil
+}
+
+// Tell masterService (through the key-value store) which plugins workers have, so it can list them
+// and check their parameters. All workers are expected to have the same plugin directory.
+func publishPlugins(kVStoreAddress string, schemas []filterSchema) error {
+    for _, schema := range schemas {
+        data, err := json.Marshal(schema)
+        if err != nil {
+            return err
+        }
+        response, err := http.Post("http://" + kVStoreAddress + "/set?key=" + url.QueryEscape(pluginSchemaPrefix + schema.Name) + "&value=" + url.QueryEscape(string(data)), "", nil)
+        if err != nil {
+            return err
+        }
+        response.Body.Close()
+        if response.StatusCode != http.StatusOK {
+            return fmt.Errorf("Can't publish plugin %s: %s", schema.Name, response.Status)
+        }
+    }
+    return nil
+}
+
+func (myPlugin pluginFilter) Apply(myImage image.Image, params FilterParams) (image.Image, error) {
+    values, err := pluginParams(myPlugin.config.Params, params)
+    if err != nil {
+        return nil, err
+    }
+    line, err := json.Marshal(values)
+    if err != nil {
+        return nil, err
+    }
+    input := bytes.NewBuffer(append(line, '\n'))
+    myEncoder := png.Encoder{CompressionLevel: png.BestSpeed}
+    err = myEncoder.Encode(input, myImage)
+    if err != nil {
+        return nil, err
+    }
+
+    // The shell sets the limits and then becomes the plugin, so the limits are the plugin's own
+    timeout := time.Duration(myPlugin.config.Timeout) * time.Second
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    limits := fmt.Sprintf("ulimit -v %d && ulimit -t %d && exec \"$@\"", myPlugin.config.MaxMemory * 1024, myPlugin.config.Timeout)
+    command := append([]string{"-c", limits, myPlugin.config.Name}, myPlugin.config.Command...)
+    if strings.Contains(command[3], "/") && !filepath.IsAbs(command[3]) {
+        command[3] = filepath.Join(myPlugin.directory, command[3])
+    }
+    cmd := exec.CommandContext(ctx, "/bin/sh", command...)
+    cmd.Dir = myPlugin.directory
+    cmd.Env = os.Environ()
+    cmd.Stdin = input
+    stdout := &cappedBuffer{Limit: maxPluginOutput}
+    stderr := &cappedBuffer{Limit: maxPluginErrorOutput, Truncate: true}
+    cmd.Stdout, cmd.Stderr = stdout, stderr
+    // Whatever the plugin started itself doesn't get to keep us waiting
+    cmd.WaitDelay = time.Second
+
+    err = cmd.Run()
+    if ctx.Err() == context.DeadlineExceeded {
+        return nil, fmt.Errorf("plugin %s took longer than %v", myPlugin.config.Name, timeout)
+    }
+    if stdout.Overflow {
+        return nil, fmt.Errorf("plugin %s wrote more than %d MB", myPlugin.config.Name, maxPluginOutput >> 20)
+    }
+    if err != nil {
+        message := strings.TrimSpace(stderr.String())
+        if len(message) == 0 {
+            message = err.Error()
+        }
+        return nil, fmt.Errorf("plugin %s failed: %s", myPlugin.config.Name, message)
+    }
+
+    limitsOfImages, err := loadImageLimits(kVStoreAddress)
+    if err != nil {
+        return nil, err
+    }
+    _, _, err = checkImageData(stdout.Bytes(), limitsOfImages)
+    if err != nil {
+        return nil, fmt.Errorf("plugin %s: %v", myPlugin.config.Name, err)
+    }
+    result, _, err := image.Decode(bytes.NewReader(stdout.Bytes()))
+    if err != nil {
+        return nil, fmt.Errorf("plugin %s didn't write an image: %v", myPlugin.config.Name, err)
+    }
+    return result, nil
+}
+
+// The parameters as the plugin gets them: every declared one, typed like the declaration says and
+// with its default when it wasn't given. Lists are JSON arrays.
+func pluginParams(schemas []paramSchema, params FilterParams) (map[string]interface{}, error) {
+    values := map[string]interface{}{}
+    for _, schema := range schemas {
+        value, given := params[schema.Name]
+        if !given || value == nil {
+            if schema.Required {
+                return nil, fmt.Errorf("parameter %q: is required", schema.Name)
+            }
+            if schema.Default != nil {
+                values[schema.Name] = schema.Default
+            }
+            continue
+        }
+
+        var err error
+        switch schema.Type {
+        case "number":
+            values[schema.Name], err = params.Float(schema.Name, 0)
+        case "integer":
+            values[schema.Name], err = params.Int(schema.Name, 0)
+        case "boolean":
+            values[schema.Name], err = params.Bool(schema.Name, false)
+        case "numbers":
+            values[schema.Name], err = params.Floats(schema.Name)
+        case "colors":
+            items, _ := paramList(value)
+            colors := []string{}
+            for _, item := range items {
+                colors = append(colors, fmt.Sprint(item))
+            }
+            values[schema.Name] = colors
+        default:
+            values[schema.Name] = params.String(schema.Name, "")
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return values, nil
+}
+
+var errOutputTooLong = errors.New("output too long")
+
+// Collects at most Limit bytes. Past that it either keeps what it has and drops the rest
+// (Truncate) or fails the write, which stops the plugin from flooding us.
+type cappedBuffer struct {
+    bytes.Buffer
+    Limit int
+    Truncate bool
+    Overflow bool
+}
+
+func (myBuffer *cappedBuffer) Write(data []byte) (int, error) {
+    room := myBuffer.Limit - myBuffer.Len()
+    if len(data) <= room {
+        return myBuffer.Buffer.Write(data)
+    }
+    myBuffer.Overflow = true
+    if !myBuffer.Truncate {
+        return 0, errOutputTooLong
+    }
+    if room > 0 {
+        myBuffer.Buffer.Write(data[:room])
+    }
+    return len(data), nil
+}
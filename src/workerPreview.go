@@ -0,0 +1,57 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "math"
+    "net/http"
+    "strconv"
+)
+
+// The longest side of the preview renditions made of every finished task, for galleries that don't
+// want to download full size images just to show a grid.
+var previewSizes = []int{128, 512}
+
+// Store a preview of the original and of the result in every size. Animations are previewed by
+// their first frame. Opaque previews are JPEGs, which are much smaller, the rest PNGs.
+func sendPreviewsToStorage(storageAddress string, myTask Task, original *animation, result *animation) error {
+    for of, myAnimation := range map[string]*animation{"original": original, "result": result} {
+        for _, size := range previewSizes {
+            myPreview := previewImage(myAnimation.Frames[0], size)
+            format := "png"
+            if opaque(myPreview) {
+                format = "jpeg"
+            }
+
+            buffer := &bytes.Buffer{}
+            err := outputEncoders[format].Encode(buffer, myPreview, OutputOptions{Quality: 85})
+            if err != nil {
+                return err
+            }
+            response, err := http.Post("http://" + storageAddress + "/sendImage?state=previews&of=" + of + "&size=" + strconv.Itoa(size) + "&format=" + format + "&id=" + strconv.Itoa(myTask.ID), outputEncoders[format].ContentType, buffer)
+            if err != nil {
+                return err
+            }
+            if response.StatusCode != http.StatusOK {
+                return fmt.Errorf("Can't send %d px preview of the %s of image %d to storage: %s", size, of, myTask.ID, response.Status)
+            }
+        }
+    }
+
+    return nil
+}
+
+// Shrink the image so its longest side is size pixels. Smaller images are left as they are.
+func previewImage(myImage image.Image, size int) image.Image {
+    bounds := myImage.Bounds()
+    longest := max(bounds.Dx(), bounds.Dy())
+    if longest <= size {
+        return myImage
+    }
+
+    scale := float64(size) / float64(longest)
+    width := int(math.Max(1, math.Round(float64(bounds.Dx()) * scale)))
+    height := int(math.Max(1, math.Round(float64(bounds.Dy()) * scale)))
+    return resizeFloats(floatImageFrom(myImage), width, height, "bilinear", resamplers["bilinear"]).toImage(myImage)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/color/palette"
+    "math"
+)
+
+func init() {
+    registerFilter("quantize", FilterFunc(quantize))
+}
+
+// Palettes of old hardware, for ?palette=gameBoy|cga|webSafe
+var fixedPalettes = map[string]color.Palette{
+    // The four greens of the original Game Boy screen
+    "gameBoy": {
+        color.NRGBA{0x0f, 0x38, 0x0f, 0xff},
+        color.NRGBA{0x30, 0x62, 0x30, 0xff},
+        color.NRGBA{0x8b, 0xac, 0x0f, 0xff},
+        color.NRGBA{0x9b, 0xbc, 0x0f, 0xff},
+    },
+    // All 16 colours of CGA text mode
+    "cga": {
+        color.NRGBA{0x00, 0x00, 0x00, 0xff}, color.NRGBA{0x00, 0x00, 0xaa, 0xff},
+        color.NRGBA{0x00, 0xaa, 0x00, 0xff}, color.NRGBA{0x00, 0xaa, 0xaa, 0xff},
+        color.NRGBA{0xaa, 0x00, 0x00, 0xff}, color.NRGBA{0xaa, 0x00, 0xaa, 0xff},
+        color.NRGBA{0xaa, 0x55, 0x00, 0xff}, color.NRGBA{0xaa, 0xaa, 0xaa, 0xff},
+        color.NRGBA{0x55, 0x55, 0x55, 0xff}, color.NRGBA{0x55, 0x55, 0xff, 0xff},
+        color.NRGBA{0x55, 0xff, 0x55, 0xff}, color.NRGBA{0x55, 0xff, 0xff, 0xff},
+        color.NRGBA{0xff, 0x55, 0x55, 0xff}, color.NRGBA{0xff, 0x55, 0xff, 0xff},
+        color.NRGBA{0xff, 0xff, 0x55, 0xff}, color.NRGBA{0xff, 0xff, 0xff, 0xff},
+    },
+    "webSafe": palette.WebSafe,
+}
+
+// Where error diffusion pushes the error of a pixel, relative to it, and which share goes there.
+type ditherTap struct {
+    X int
+    Y int
+    Weight float32
+}
+
+var ditherKernels = map[string][]ditherTap{
+    "floydSteinberg": {{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16}},
+    // Atkinson only passes on three quarters of the error, which keeps highlights and shadows clean
+    "atkinson": {{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8}},
+}
+
+// Reduce the image to a palette: ?palette=medianCut|kMeans (?colors of them, 16 by default, built
+// from the image) or one of the fixed palettes gameBoy, cga or webSafe. ?dither=none|bayer|
+// floydSteinberg|atkinson decides how the colours in between are faked, ?bayerSize=2|4|8 being
+// the size of the Bayer matrix. The result is a paletted image, so PNG and GIF output keep exactly
+// this palette. Mostly transparent pixels become fully transparent.
+func quantize(myImage image.Image, params FilterParams) (image.Image, error) {
+    colors, err := params.Int("colors", 16)
+    if err != nil {
+        return nil, err
+    }
+    if colors < 2 || colors > 256 {
+        return nil, fmt.Errorf("parameter %q: must be between 2 and 256", "colors")
+    }
+    dither := params.String("dither", "floydSteinberg")
+    if _, ok := ditherKernels[dither]; !ok && dither != "none" && dither != "bayer" {
+        return nil, fmt.Errorf("parameter %q: must be none, bayer, floydSteinberg or atkinson", "dither")
+    }
+    bayerSize, err := params.Int("bayerSize", 4)
+    if err != nil {
+        return nil, err
+    }
+    if bayerSize != 2 && bayerSize != 4 && bayerSize != 8 {
+        return nil, fmt.Errorf("parameter %q: must be 2, 4 or 8", "bayerSize")
+    }
+
+    var myPalette color.Palette
+    switch name := params.String("palette", "medianCut"); name {
+    case "medianCut":
+        myPalette = medianCut(myImage, colors)
+    case "kMeans":
+        myPalette = kMeans(myImage, colors)
+    default:
+        fixed, ok := fixedPalettes[name]
+        if !ok {
+            return nil, fmt.Errorf("parameter %q: must be medianCut, kMeans, gameBoy, cga or webSafe", "palette")
+        }
+        myPalette = color.Palette{}
+        if _, transparent := samplePalette(myImage); transparent > 0 {
+            myPalette = append(myPalette, color.NRGBA{})
+        }
+        myPalette = append(myPalette, fixed...)
+    }
+    if len(myPalette) == 0 {
+        // Nothing but transparent pixels, or an empty image
+        myPalette = color.Palette{color.NRGBA{}}
+    }
+
+    src := floatImageFrom(myImage)
+    dst := image.NewPaletted(src.Rect, myPalette)
+    switch dither {
+    case "none":
+        quantizeOrdered(src, dst, nil, 0)
+    case "bayer":
+        quantizeOrdered(src, dst, bayerMatrix(bayerSize), paletteSpacing(myPalette))
+    default:
+        quantizeDiffused(src, dst, ditherKernels[dither])
+    }
+    return dst, nil
+}
+
+// Finds the nearest opaque palette entry of a straight colour, remembering the answers since
+// images tend to repeat their colours a lot. The transparent entry, if any, is never picked here.
+type paletteMatcher struct {
+    Entries [][3]float32
+    Indices []uint8
+    Transparent int
+    cache map[uint32]uint8
+}
+
+func newPaletteMatcher(myPalette color.Palette) *paletteMatcher {
+    myMatcher := &paletteMatcher{Transparent: -1, cache: map[uint32]uint8{}}
+    for i, entry := range myPalette {
+        myColor := color.NRGBAModel.Convert(entry).(color.NRGBA)
+        if myColor.A < 0x80 {
+            if myMatcher.Transparent == -1 {
+                myMatcher.Transparent = i
+            }
+            continue
+        }
+        myMatcher.Entries = append(myMatcher.Entries, [3]float32{float32(myColor.R) / 0xff, float32(myColor.G) / 0xff, float32(myColor.B) / 0xff})
+        myMatcher.Indices = append(myMatcher.Indices, uint8(i))
+    }
+    return myMatcher
+}
+
+// The palette index for a straight colour, and the colour at that index. Channels are clamped
+// between 0 and 1 first: dithering pushes them past either end, and the cache only tells apart
+// colours within.
+func (myMatcher *paletteMatcher) nearest(r float32, g float32, b float32) (uint8, [3]float32) {
+    r, g, b = clampUnit(r), clampUnit(g), clampUnit(b)
+    if len(myMatcher.Entries) == 0 {
+        return uint8(max(myMatcher.Transparent, 0)), [3]float32{r, g, b}
+    }
+    key := uint32(r * 255 + 0.5) << 16 | uint32(g * 255 + 0.5) << 8 | uint32(b * 255 + 0.5)
+    if found, ok := myMatcher.cache[key]; ok {
+        return myMatcher.Indices[found], myMatcher.Entries[found]
+    }
+
+    chosen, chosenDistance := 0, float32(math.Inf(1))
+    for i, entry := range myMatcher.Entries {
+        dr, dg, db := r - entry[0], g - entry[1], b - entry[2]
+        // Weighted like the eye cares about the channels
+        distance := 0.3 * dr * dr + 0.59 * dg * dg + 0.11 * db * db
+        if distance < chosenDistance {
+            chosen, chosenDistance = i, distance
+        }
+    }
+    myMatcher.cache[key] = uint8(chosen)
+    return myMatcher.Indices[chosen], myMatcher.Entries[chosen]
+}
+
+// The straight colour and alpha of a pixel of a floatImage.
+func straightFloats(src *floatImage, i int) (float32, float32, float32, float32) {
+    a := clampUnit(src.Pix[i + 3])
+    if a == 0 {
+        return 0, 0, 0, 0
+    }
+    return src.Pix[i] / a, src.Pix[i + 1] / a, src.Pix[i + 2] / a, a
+}
+
+// Without a matrix every pixel simply takes the nearest palette colour. With one, a threshold from
+// the matrix (scaled by spread) is added first, which gives the cross-hatched look of ordered
+// dithering. Pixels don't depend on each other, so tiles run in parallel.
+func quantizeOrdered(src *floatImage, dst *image.Paletted, matrix [][]float32, spread float32) {
+    parallelTiles(src.Rect, func(tile image.Rectangle) {
+        myMatcher := newPaletteMatcher(dst.Palette)
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                r, g, b, a := straightFloats(src, src.offset(x, y))
+                if a < 0.5 && myMatcher.Transparent >= 0 {
+                    dst.SetColorIndex(x, y, uint8(myMatcher.Transparent))
+                    continue
+                }
+                if matrix != nil {
+                    threshold := matrix[(y - src.Rect.Min.Y) % len(matrix)][(x - src.Rect.Min.X) % len(matrix)] * spread
+                    r, g, b = r + threshold, g + threshold, b + threshold
+                }
+                index, _ := myMatcher.nearest(r, g, b)
+                dst.SetColorIndex(x, y, index)
+            }
+        }
+    })
+}
+
+// Error diffusion: the difference between a pixel and the palette colour it got is passed on to the
+// pixels not done yet, as the kernel says. This has to go through the image in order. The kernels
+// only reach a couple of rows down, so only those rows are kept with the error they've received,
+// reused for the next row down as each one is done.
+func quantizeDiffused(src *floatImage, dst *image.Paletted, taps []ditherTap) {
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    myMatcher := newPaletteMatcher(dst.Palette)
+    rows := 1
+    for _, tap := range taps {
+        rows = max(rows, tap.Y + 1)
+    }
+    // The straight colours and alpha of a row, with the error received so far
+    work := make([][4]float32, rows * width)
+    loadRow := func(y int) {
+        row := work[(y % rows) * width:(y % rows + 1) * width]
+        for x := range row {
+            r, g, b, a := straightFloats(src, src.offset(src.Rect.Min.X + x, src.Rect.Min.Y + y))
+            row[x] = [4]float32{r, g, b, a}
+        }
+    }
+    for y := 0; y < min(rows, height); y++ {
+        loadRow(y)
+    }
+
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            value := work[(y % rows) * width + x]
+            if value[3] < 0.5 && myMatcher.Transparent >= 0 {
+                dst.Pix[dst.PixOffset(src.Rect.Min.X + x, src.Rect.Min.Y + y)] = uint8(myMatcher.Transparent)
+                continue
+            }
+            index, chosen := myMatcher.nearest(value[0], value[1], value[2])
+            dst.Pix[dst.PixOffset(src.Rect.Min.X + x, src.Rect.Min.Y + y)] = index
+
+            for _, tap := range taps {
+                tx, ty := x + tap.X, y + tap.Y
+                if tx < 0 || tx >= width || ty >= height {
+                    continue
+                }
+                for c := 0; c < 3; c++ {
+                    work[(ty % rows) * width + tx][c] += (clampUnit(value[c]) - chosen[c]) * tap.Weight
+                }
+            }
+        }
+        if y + rows < height {
+            loadRow(y + rows)
+        }
+    }
+}
+
+// The size x size Bayer matrix, as thresholds between -0.5 and 0.5.
+func bayerMatrix(size int) [][]float32 {
+    indices := [][]int{{0}}
+    for len(indices) < size {
+        n := len(indices)
+        grown := make([][]int, 2 * n)
+        for y := range grown {
+            grown[y] = make([]int, 2 * n)
+            for x := range grown[y] {
+                // Each quadrant is the smaller matrix, offset 0, 2, 3 and 1 in the usual order
+                offset := [2][2]int{{0, 2}, {3, 1}}[y / n][x / n]
+                grown[y][x] = 4 * indices[y % n][x % n] + offset
+            }
+        }
+        indices = grown
+    }
+
+    matrix := make([][]float32, size)
+    for y := range matrix {
+        matrix[y] = make([]float32, size)
+        for x := range matrix[y] {
+            matrix[y][x] = (float32(indices[y][x]) + 0.5) / float32(size * size) - 0.5
+        }
+    }
+    return matrix
+}
+
+// How far apart the opaque colours of the palette are on average (each to its nearest neighbour),
+// which is how strong ordered dithering needs to be to reach the next colour. Never more than 1.
+func paletteSpacing(myPalette color.Palette) float32 {
+    entries := newPaletteMatcher(myPalette).Entries
+    if len(entries) < 2 {
+        return 1
+    }
+
+    total := 0.0
+    for i, entry := range entries {
+        nearest := math.Inf(1)
+        for j, other := range entries {
+            if i == j {
+                continue
+            }
+            dr, dg, db := float64(entry[0] - other[0]), float64(entry[1] - other[1]), float64(entry[2] - other[2])
+            nearest = math.Min(nearest, math.Sqrt(dr * dr + dg * dg + db * db))
+        }
+        total += nearest
+    }
+    return float32(math.Min(1, total / float64(len(entries))))
+}
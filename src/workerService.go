@@ -7,23 +7,42 @@ import (
     "encoding/json"
     "time"
     "strconv"
-    "image"
-    "image/png"
-    "image/color"
     "bytes"
     "sync"
     "io/ioutil"
+    "strings"
+    "net/url"
 )
 
 type Task struct {
     ID int `json:"id"`
     State int `json:"state"`
+    Pipeline []PipelineStep `json:"pipeline"`
+    Format string `json:"format"`
+    Output OutputOptions `json:"output"`
+    Animate AnimateOptions `json:"animate"`
+    // Names of the other images uploaded with the task, for the filters that combine images
+    Inputs []string `json:"inputs,omitempty"`
+    Batch BatchOptions `json:"batch"`
+}
+
+// A taskError means the task itself can never succeed (the upload isn't an image we can read, the
+// parameters are wrong), so instead of retrying it we report it as failed.
+type taskError struct {
+    err error
+}
+
+func (myError taskError) Error() string {
+    return myError.err.Error()
 }
 
 var masterLocation string
 var storageLocation string
 var kVStoreAddress string
 
+// The pixels of the images all worker goroutines are processing, kept under maxImagePixels
+var workingPixels = newPixelBudget()
+
 func main()  {
     if len(os.Args) < 3 {
         fmt.Println("Error 🚫: Too few arguments.")
@@ -73,6 +92,25 @@ func main()  {
         return
     }
 
+    // Optional CL arg for the directory with the plugin filters
+    pluginDirectory := defaultPluginDirectory
+    if len(os.Args) > 3 {
+        pluginDirectory = os.Args[3]
+    }
+    plugins, err := loadPlugins(pluginDirectory)
+    if err != nil {
+        fmt.Println("Error 🚫:", err)
+        return
+    }
+    err = publishPlugins(kVStoreAddress, plugins)
+    if err != nil {
+        fmt.Println("Error 🚫:", err)
+        return
+    }
+    if len(plugins) > 0 {
+        fmt.Println("Loaded", len(plugins), "plugin filters from", pluginDirectory)
+    }
+
     fmt.Println("workerService is up! 🔨")
 
     // Waiting for goroutines, as to don't terminate execution
@@ -89,21 +127,9 @@ func main()  {
                     continue
                 }
 
-                myImage, err := getImageFromStorage(storageLocation, myTask)
-                if err != nil {
-                    fmt.Println(err)
-                    fmt.Println("Waiting 2 second timeout...")
-                    time.Sleep(time.Second * 2)
-                    continue
-                }
-
-                myImage = doWorkOnImage(myImage)
-
-                err = sendImageToStorage(storageLocation, myTask, myImage)
+                err = processTask(myTask)
                 if err != nil {
-                    fmt.Println(err)
-                    fmt.Println("Waiting 2 second timeout...")
-                    time.Sleep(time.Second * 2)
+                    handleTaskError(myTask, err)
                     continue
                 }
 
@@ -117,75 +143,216 @@ func main()  {
             }
         }()
     }
+    myWG.Wait()
 }
 
 // We make the request to the master and check if it was successful. We read the response body to
 // memory and finally Unmarshal the response body to our Task structure. Finally we return it.
 func getNewTask(masterAddress string) (Task, error) {
     response, err := http.Post("http://" + masterAddress + "/getNewTask", "text/plain", nil)
-    if err != nil || response.StatusCode != http.StatusOK {
-        return Task{-1, -1}, err
+    if err != nil {
+        return Task{ID: -1, State: -1}, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return Task{ID: -1, State: -1}, fmt.Errorf("No task to work on.")
     }
     data, err := ioutil.ReadAll(response.Body)
     if err != nil {
-        return Task{-1, -1}, err
+        return Task{ID: -1, State: -1}, err
     }
 
     myTask := Task{}
     err = json.Unmarshal(data, &myTask)
     if err != nil {
-        return Task{-1, -1}, err
+        return Task{ID: -1, State: -1}, err
     }
 
     return myTask, nil
 }
 
-// We get the response whose body is the raw image, so we just Decode it and return it if we succeed.
-func getImageFromStorage(storageAddress string, myTask Task) (image.Image, error) {
-    response, err := http.Get("http://" + storageAddress + "/getImage?state=working&id=" + strconv.Itoa(myTask.ID))
-    if err != nil || response.StatusCode != http.StatusOK {
-        return nil, err
+// Fetch the image, check its header against the limits, and only then decode it, run the pipeline
+// and store the result along with its previews. The other images uploaded with the task go through
+// the same checks. While that happens all their pixels count against workingPixels, every frame of
+// an animation, or of the animation a sweep turns a still into.
+func processTask(myTask Task) error {
+    if len(myTask.Batch.Layout) > 0 {
+        return processBatchTask(myTask)
     }
 
-    myImage, err := png.Decode(response.Body)
+    data, err := getImageFromStorage(storageLocation, myTask, "")
     if err != nil {
-        return nil, err
+        return err
+    }
+
+    limits, err := loadImageLimits(kVStoreAddress)
+    if err != nil {
+        return err
+    }
+    config, format, err := checkImageData(data, limits)
+    if _, ok := err.(imageTooLargeError); ok {
+        return taskError{err}
+    }
+    if err != nil {
+        return taskError{fmt.Errorf("Not a supported image: %v", err)}
+    }
+    if format != myTask.Format {
+        fmt.Println("Task", myTask.ID, "was submitted as", myTask.Format, "but decoded as", format)
+    }
+    frames := imageFrames(data, format)
+    if frames == 1 && len(myTask.Animate.Param) > 0 {
+        frames = sweepFrames(myTask.Animate)
+        err = checkImageSize(config.Width, config.Height, frames, limits)
+        if err != nil {
+            return taskError{err}
+        }
+    }
+    pixels := frames * config.Width * config.Height
+
+    inputData := map[string][]byte{}
+    for _, name := range myTask.Inputs {
+        inputData[name], err = getImageFromStorage(storageLocation, myTask, name)
+        if err != nil {
+            return err
+        }
+        config, _, err := checkImageData(inputData[name], limits)
+        if _, ok := err.(imageTooLargeError); ok {
+            return taskError{err}
+        }
+        if err != nil {
+            return taskError{fmt.Errorf("Input %s is not a supported image: %v", name, err)}
+        }
+        pixels += config.Width * config.Height
     }
+    workingPixels.acquire(pixels, limits.MaxPixels)
+    defer workingPixels.release(pixels)
 
-    return myImage, nil
+    myAnimation, _, err := decodeAnimation(data)
+    if err != nil {
+        return taskError{fmt.Errorf("Not a supported image: %v", err)}
+    }
+    // Photos are turned upright, and their EXIF data is kept around for the fields the task wants
+    // in its result. Broken EXIF data just means there's none.
+    myEXIF, err := readJPEGEXIF(data)
+    if err != nil {
+        fmt.Println("Task", myTask.ID, "has broken EXIF data:", err)
+    }
+    if myEXIF != nil {
+        myAnimation.Frames[0] = orientImage(myAnimation.Frames[0], myEXIF.Orientation)
+    }
+    // Inputs are stills, an animated one is used by its first frame
+    inputs := inputImages{}
+    for name, data := range inputData {
+        inputs[name], err = decodeOriented(data)
+        if err != nil {
+            return taskError{fmt.Errorf("Input %s is not a supported image: %v", name, err)}
+        }
+    }
+
+    return finishTask(myTask, myAnimation, inputs, myEXIF, limits)
 }
 
-// First we create a RGBA. That’s something like a canvas for drawing, and we create it with the size of our image. Later we draw on the canvas swapping the red with the green channel. Later we use the RGBA to return a new modified image, created from our canvas with the size of our original image.
-func doWorkOnImage(myImage image.Image) image.Image {
-    myCanvas := image.NewRGBA(myImage.Bounds())
-
-    for i := 0; i < myCanvas.Rect.Max.X; i++ {
-        for j := 0; j < myCanvas.Rect.Max.Y; j++ {
-            r, g, b, _ := myImage.At(i, j).RGBA()
-            myColor := new(color.RGBA)
-            myColor.R = uint8(g)
-            myColor.G = uint8(r)
-            myColor.B = uint8(b)
-            myColor.A = uint8(255)
-            myCanvas.Set(i, j, myColor)
+// Run the pipeline, with the watermark last whatever the task asked for, and store the result along
+// with the previews. A batch task without a pipeline only gets the watermark, if there is one. The
+// EXIF data of the original, if any, is where the metadata the task keeps comes from. No step may
+// make an image over the limits.
+func finishTask(myTask Task, myAnimation *animation, inputs inputImages, myEXIF *exifData, limits imageLimits) error {
+    pipeline := myTask.Pipeline
+    if len(pipeline) == 0 && len(myTask.Batch.Layout) == 0 {
+        pipeline = []PipelineStep{{Filter: defaultFilter}}
+    }
+    watermark, err := watermarkStep(kVStoreAddress)
+    if err != nil {
+        return err
+    }
+    if watermark != nil {
+        pipeline = append(append([]PipelineStep{}, pipeline...), *watermark)
+    }
+
+    result := myAnimation
+    if len(pipeline) > 0 {
+        result, err = applyPipelineToAnimation(pipeline, myTask.Animate, myAnimation, inputs, limits)
+        if err != nil {
+            return taskError{err}
         }
     }
 
-    return myCanvas.SubImage(myImage.Bounds())
+    err = sendImageToStorage(storageLocation, myTask, result, myEXIF)
+    if err != nil {
+        return err
+    }
+    return sendPreviewsToStorage(storageLocation, myTask, myAnimation, result)
+}
+
+// We get the response whose body is the raw image and return its bytes. Without a name that's the
+// task's image, with one the other upload of that name.
+func getImageFromStorage(storageAddress string, myTask Task, name string) ([]byte, error) {
+    response, err := http.Get("http://" + storageAddress + "/getImage?state=working&id=" + strconv.Itoa(myTask.ID) + "&name=" + url.QueryEscape(name))
+    if err != nil {
+        return nil, err
+    }
+    if response.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Can't get image %d %s from storage: %s", myTask.ID, name, response.Status)
+    }
+
+    return ioutil.ReadAll(response.Body)
 }
 
-// We create a data byte slice, and from that a data buffer which allows us to use it as a readwriter interface. We then use this interface to encode our image to png into, and finally send it using a POST to the server. If everything works out, then we just return.
-func sendImageToStorage(storageAddress string, myTask Task, myImage image.Image) error {
+// We create a data byte slice, and from that a data buffer which allows us to use it as a readwriter interface. We then use this interface to encode our image into, in the output format the task asked for (animations are GIFs, the only animated format we write, unless they're rendered as text), and finally send it using a POST to the server, with the EXIF fields the task keeps put back in. If everything works out, then we just return.
+func sendImageToStorage(storageAddress string, myTask Task, myAnimation *animation, myEXIF *exifData) error {
+    format, myEncoder, err := lookupOutputEncoder(myTask.Output)
+    if err != nil {
+        return err
+    }
+
     data := []byte{}
     buffer := bytes.NewBuffer(data)
-    err := png.Encode(buffer, myImage)
+    if myAnimation.animated() && !myEncoder.Text {
+        format, myEncoder = "gif", outputEncoders["gif"]
+        err = encodeAnimation(buffer, myAnimation, myTask.Output)
+    } else {
+        err = myEncoder.Encode(buffer, myAnimation.Frames[0], myTask.Output)
+    }
     if err != nil {
         return err
     }
-    response, err := http.Post("http://" + storageAddress + "/sendImage?state=finished&id=" + strconv.Itoa(myTask.ID), "image/png", buffer)
-    if err != nil || response.StatusCode != http.StatusOK {
+    data = embedEXIF(format, buffer.Bytes(), encodeEXIF(myEXIF, myTask.Output.Metadata))
+    response, err := http.Post("http://" + storageAddress + "/sendImage?state=finished&format=" + format + "&id=" + strconv.Itoa(myTask.ID), myEncoder.ContentType, bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+    if response.StatusCode != http.StatusOK {
+        return fmt.Errorf("Can't send image %d to storage: %s", myTask.ID, response.Status)
+    }
+
+    return nil
+}
+
+// Tasks that can never succeed are reported to the master so they aren't handed out again, anything
+// else (storage or master unreachable) is retried after a short wait.
+func handleTaskError(myTask Task, err error) {
+    fmt.Println("Error 🚫: Task", myTask.ID, err)
+    if permanent, ok := err.(taskError); ok {
+        _, rejected := permanent.err.(imageTooLargeError)
+        err = registerFailedTask(masterLocation, myTask, err.Error(), rejected)
+        if err == nil {
+            return
+        }
+        fmt.Println(err)
+    }
+    fmt.Println("Waiting 2 second timeout...")
+    time.Sleep(time.Second * 2)
+}
+
+// We can't process the image, the reason goes along in the body. Images over the size limits are
+// reported as rejected.
+func registerFailedTask(masterAddress string, myTask Task, reason string, rejected bool) error {
+    response, err := http.Post("http://" + masterAddress + "/registerTaskFailed?id=" + strconv.Itoa(myTask.ID) + "&rejected=" + strconv.FormatBool(rejected), "text/plain", strings.NewReader(reason))
+    if err != nil {
         return err
     }
+    if response.StatusCode != http.StatusOK {
+        return fmt.Errorf("Can't register task %d as failed: %s", myTask.ID, response.Status)
+    }
 
     return nil
 }
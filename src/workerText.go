@@ -0,0 +1,143 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "html"
+    "image"
+    "io"
+    "math"
+)
+
+// The character ramps for ?outputRamp, darkest first. Anything else given there is used as the ramp
+// itself.
+var textRamps = map[string]string{
+    "ascii": " .:-=+*#%@",
+    "blocks": " ░▒▓█",
+}
+
+const defaultTextWidth = 80
+
+// A character is about twice as high as it is wide, so every character covers two pixel rows worth
+// of the image for every pixel column.
+const textCellAspect = 2
+
+// A tall thin image at a wide width would otherwise be millions of lines, and coloured output takes
+// a few dozen bytes for every character.
+const maxTextCells = 1000000
+
+// One character of the rendering, with the straight colour of its part of the image.
+type textCell struct {
+    Char rune
+    R, G, B uint8
+}
+
+// Shrink (or stretch) the image to one pixel per character and pick a character from the ramp by
+// how bright every pixel is. Transparent parts count as dark, i.e. the start of the ramp.
+func textCells(myImage image.Image, options OutputOptions) ([][]textCell, error) {
+    width := options.Width
+    if width == 0 {
+        width = defaultTextWidth
+    }
+    ramp, ok := textRamps[options.Ramp]
+    if len(options.Ramp) == 0 {
+        ramp = textRamps["ascii"]
+    } else if !ok {
+        ramp = options.Ramp
+    }
+    chars := []rune(ramp)
+    if width < 1 || len(chars) < 2 {
+        return nil, taskError{fmt.Errorf("text output needs a width of at least 1 and at least two characters")}
+    }
+
+    bounds := myImage.Bounds()
+    if bounds.Empty() {
+        return nil, nil
+    }
+    height := int(math.Max(1, math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx() * textCellAspect))))
+    if width * height > maxTextCells {
+        return nil, taskError{fmt.Errorf("text output would be %d lines of %d characters, more than %d characters", height, width, maxTextCells)}
+    }
+    small := resizeFloats(floatImageFrom(myImage), width, height, "bilinear", resamplers["bilinear"])
+
+    cells := make([][]textCell, height)
+    for y := range cells {
+        cells[y] = make([]textCell, width)
+        for x := range cells[y] {
+            r, g, b, a := straightFloats(small, small.offset(x, y))
+            brightness := luma(float64(clampUnit(r)), float64(clampUnit(g)), float64(clampUnit(b))) * float64(a)
+            index := int(brightness * float64(len(chars)))
+            cells[y][x] = textCell{
+                Char: chars[min(index, len(chars) - 1)],
+                R: uint8(clampUnit(r) * 255 + 0.5),
+                G: uint8(clampUnit(g) * 255 + 0.5),
+                B: uint8(clampUnit(b) * 255 + 0.5),
+            }
+        }
+    }
+    return cells, nil
+}
+
+// Plain text, one line per row of characters.
+func encodeText(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    cells, err := textCells(myImage, options)
+    if err != nil {
+        return err
+    }
+    buffered := bufio.NewWriter(writer)
+    for _, row := range cells {
+        for _, cell := range row {
+            buffered.WriteRune(cell.Char)
+        }
+        buffered.WriteByte('\n')
+    }
+    return buffered.Flush()
+}
+
+// Text for terminals, every character in the colour of its part of the image (24 bit ANSI escape
+// codes, only written when the colour changes).
+func encodeANSI(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    cells, err := textCells(myImage, options)
+    if err != nil {
+        return err
+    }
+    buffered := bufio.NewWriter(writer)
+    for _, row := range cells {
+        for x, cell := range row {
+            if x == 0 || cell.R != row[x - 1].R || cell.G != row[x - 1].G || cell.B != row[x - 1].B {
+                fmt.Fprintf(buffered, "\x1b[38;2;%d;%d;%dm", cell.R, cell.G, cell.B)
+            }
+            buffered.WriteRune(cell.Char)
+        }
+        buffered.WriteString("\x1b[0m\n")
+    }
+    return buffered.Flush()
+}
+
+// An HTML snippet to paste into a page: a <pre> on a black background with runs of characters of
+// the same colour in a <span> each.
+func encodeHTML(writer io.Writer, myImage image.Image, options OutputOptions) error {
+    cells, err := textCells(myImage, options)
+    if err != nil {
+        return err
+    }
+    buffered := bufio.NewWriter(writer)
+    buffered.WriteString("<pre style=\"font-family: monospace; line-height: 1; background: #000; color: #fff\">\n")
+    for _, row := range cells {
+        for x := 0; x < len(row); {
+            end := x + 1
+            for end < len(row) && row[end].R == row[x].R && row[end].G == row[x].G && row[end].B == row[x].B {
+                end++
+            }
+            run := []rune{}
+            for _, cell := range row[x:end] {
+                run = append(run, cell.Char)
+            }
+            fmt.Fprintf(buffered, "<span style=\"color: #%02x%02x%02x\">%s</span>", row[x].R, row[x].G, row[x].B, html.EscapeString(string(run)))
+            x = end
+        }
+        buffered.WriteByte('\n')
+    }
+    buffered.WriteString("</pre>\n")
+    return buffered.Flush()
+}
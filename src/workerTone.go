@@ -0,0 +1,468 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+    "sort"
+    "strings"
+)
+
+func init() {
+    registerFilter("brightnessContrast", FilterFunc(brightnessContrast))
+    registerFilter("gamma", FilterFunc(gamma))
+    registerFilter("levels", FilterFunc(levels))
+    registerFilter("curves", FilterFunc(curves))
+    registerFilter("equalize", FilterFunc(equalize))
+    registerFilter("clahe", FilterFunc(clahe))
+}
+
+// Tone curves are sampled into tables this long, which is finer than 8 bits and, with interpolation
+// between entries, as good as exact for 16 bit images.
+const toneTableSize = 4096
+
+// The histograms of equalization are kept at this many levels.
+const histogramBins = 256
+
+// A tone curve maps a straight channel value between 0 and 1 to a new one
+type toneCurve func(value float64) float64
+
+// ?brightness (-1 to 1, 0 by default) is added to every channel, after ?contrast (0 to 10, 1 by
+// default) has stretched them away from middle grey (or squashed them towards it, below 1).
+func brightnessContrast(myImage image.Image, params FilterParams) (image.Image, error) {
+    brightness, err := params.Float("brightness", 0)
+    if err != nil {
+        return nil, err
+    }
+    if brightness < -1 || brightness > 1 {
+        return nil, fmt.Errorf("parameter %q: must be between -1 and 1", "brightness")
+    }
+    contrast, err := params.Float("contrast", 1)
+    if err != nil {
+        return nil, err
+    }
+    if contrast < 0 || contrast > 10 {
+        return nil, fmt.Errorf("parameter %q: must be between 0 and 10", "contrast")
+    }
+
+    curve := func(value float64) float64 {
+        return (value - 0.5) * contrast + 0.5 + brightness
+    }
+    return applyToneCurves(myImage, [3]toneCurve{curve, curve, curve}), nil
+}
+
+// Every channel to the power of 1 / ?gamma (0.01 to 10, 1 by default), so above 1 brightens the
+// midtones and below 1 darkens them. ?channels picks which of r, g and b change (all by default).
+func gamma(myImage image.Image, params FilterParams) (image.Image, error) {
+    value, err := gammaParam(params, "gamma")
+    if err != nil {
+        return nil, err
+    }
+    curve := func(channel float64) float64 {
+        return math.Pow(channel, 1 / value)
+    }
+    return channelCurves(myImage, params, curve)
+}
+
+// Input and output levels like in a photo editor: ?inBlack and ?inWhite (0 to 1) become black and
+// white, with everything in between stretched and everything outside clipped, midtones get
+// ?gamma, and the result is squeezed between ?outBlack and ?outWhite. ?channels picks which of r, g
+// and b change (all by default).
+func levels(myImage image.Image, params FilterParams) (image.Image, error) {
+    var bounds [4]float64
+    for i, setting := range []struct {
+        Name string
+        Fallback float64
+    }{{"inBlack", 0}, {"inWhite", 1}, {"outBlack", 0}, {"outWhite", 1}} {
+        value, err := params.Float(setting.Name, setting.Fallback)
+        if err != nil {
+            return nil, err
+        }
+        if value < 0 || value > 1 {
+            return nil, fmt.Errorf("parameter %q: must be between 0 and 1", setting.Name)
+        }
+        bounds[i] = value
+    }
+    inBlack, inWhite, outBlack, outWhite := bounds[0], bounds[1], bounds[2], bounds[3]
+    if inBlack >= inWhite {
+        return nil, fmt.Errorf("parameter %q: must be less than %q", "inBlack", "inWhite")
+    }
+    midtones, err := gammaParam(params, "gamma")
+    if err != nil {
+        return nil, err
+    }
+
+    curve := func(value float64) float64 {
+        value = math.Max(0, math.Min(1, (value - inBlack) / (inWhite - inBlack)))
+        return outBlack + math.Pow(value, 1 / midtones) * (outWhite - outBlack)
+    }
+    return channelCurves(myImage, params, curve)
+}
+
+// Curves through control points: ?points=x0,y0,x1,y1,... (between 0 and 1, x increasing) for
+// every channel, or ?red, ?green and ?blue for one channel each, which take precedence. The curve
+// is a smooth monotone spline, so it never overshoots between points, and flat beyond the first
+// and last point.
+func curves(myImage image.Image, params FilterParams) (image.Image, error) {
+    shared, err := curvePointsParam(params, "points")
+    if err != nil {
+        return nil, err
+    }
+
+    given := shared != nil
+    var myCurves [3]toneCurve
+    for c, name := range []string{"red", "green", "blue"} {
+        own, err := curvePointsParam(params, name)
+        if err != nil {
+            return nil, err
+        }
+        switch {
+        case own != nil:
+            myCurves[c], given = own, true
+        case shared != nil:
+            myCurves[c] = shared
+        default:
+            myCurves[c] = func(value float64) float64 {
+                return value
+            }
+        }
+    }
+    if !given {
+        return nil, fmt.Errorf("parameter %q: control points are required (or %q, %q and %q)", "points", "red", "green", "blue")
+    }
+    return applyToneCurves(myImage, myCurves), nil
+}
+
+// Histogram equalization spreads the tones evenly over the whole range. ?mode=luma (the default)
+// equalizes brightness and keeps the colours, ?mode=rgb equalizes every channel on its own, which
+// also balances a colour cast (or creates one).
+func equalize(myImage image.Image, params FilterParams) (image.Image, error) {
+    mode := params.String("mode", "luma")
+    if mode != "luma" && mode != "rgb" {
+        return nil, fmt.Errorf("parameter %q: must be luma or rgb", "mode")
+    }
+
+    src := floatImageFrom(myImage)
+    if mode == "rgb" {
+        var myCurves [3]toneCurve
+        for c := 0; c < 3; c++ {
+            var histogram [histogramBins]float64
+            for i := 0; i < len(src.Pix); i += 4 {
+                if value, alpha, ok := straightChannel(src, i, c); ok {
+                    histogram[bin(value)] += alpha
+                }
+            }
+            myCurves[c] = histogramCurve(equalizeHistogram(histogram[:]))
+        }
+        return applyToneCurves(myImage, myCurves), nil
+    }
+
+    var histogram [histogramBins]float64
+    for i := 0; i < len(src.Pix); i += 4 {
+        if value, alpha, ok := straightLuma(src, i); ok {
+            histogram[bin(value)] += alpha
+        }
+    }
+    mapping := histogramCurve(equalizeHistogram(histogram[:]))
+    shiftLuma(src, func(x int, y int, value float64) float64 {
+        return mapping(value)
+    })
+    return src.toImage(myImage), nil
+}
+
+// Contrast limited adaptive histogram equalization: the image is split into ?tiles x ?tiles
+// regions (2 to 64, 8 by default) that are equalized on their own, blending smoothly from one to
+// the next, so detail comes out in both the shadows and the highlights. ?clipLimit (1 to 100, 2
+// by default) caps how much any one tone can be stretched, which keeps noise in flat areas down.
+// Works on brightness and keeps the colours.
+func clahe(myImage image.Image, params FilterParams) (image.Image, error) {
+    tiles, err := params.Int("tiles", 8)
+    if err != nil {
+        return nil, err
+    }
+    if tiles < 2 || tiles > 64 {
+        return nil, fmt.Errorf("parameter %q: must be between 2 and 64", "tiles")
+    }
+    clipLimit, err := params.Float("clipLimit", 2)
+    if err != nil {
+        return nil, err
+    }
+    if clipLimit < 1 || clipLimit > 100 {
+        return nil, fmt.Errorf("parameter %q: must be between 1 and 100", "clipLimit")
+    }
+
+    src := floatImageFrom(myImage)
+    width, height := src.Rect.Dx(), src.Rect.Dy()
+    if width == 0 || height == 0 {
+        return myImage, nil
+    }
+    columns, rows := min(tiles, width), min(tiles, height)
+    tileWidth, tileHeight := float64(width) / float64(columns), float64(height) / float64(rows)
+
+    // A mapping for every tile, from its own clipped histogram
+    mappings := make([][]float64, columns * rows)
+    parallelTiles(image.Rect(0, 0, columns, rows), func(cells image.Rectangle) {
+        for row := cells.Min.Y; row < cells.Max.Y; row++ {
+            for column := cells.Min.X; column < cells.Max.X; column++ {
+                var histogram [histogramBins]float64
+                for y := int(float64(row) * tileHeight); y < int(float64(row + 1) * tileHeight); y++ {
+                    for x := int(float64(column) * tileWidth); x < int(float64(column + 1) * tileWidth); x++ {
+                        if value, alpha, ok := straightLuma(src, 4 * (y * width + x)); ok {
+                            histogram[bin(value)] += alpha
+                        }
+                    }
+                }
+                clipHistogram(histogram[:], clipLimit)
+                mappings[row * columns + column] = equalizeHistogram(histogram[:])
+            }
+        }
+    })
+
+    // Every pixel is mapped by the four tiles whose centres surround it, weighted by how close it is
+    shiftLuma(src, func(x int, y int, value float64) float64 {
+        tileX := math.Max(0, math.Min(float64(columns - 1), (float64(x) + 0.5) / tileWidth - 0.5))
+        tileY := math.Max(0, math.Min(float64(rows - 1), (float64(y) + 0.5) / tileHeight - 0.5))
+        left, top := int(tileX), int(tileY)
+        right, bottom := min(left + 1, columns - 1), min(top + 1, rows - 1)
+        fractionX, fractionY := tileX - float64(left), tileY - float64(top)
+        level := bin(value)
+
+        upper := mappings[top * columns + left][level] * (1 - fractionX) + mappings[top * columns + right][level] * fractionX
+        lower := mappings[bottom * columns + left][level] * (1 - fractionX) + mappings[bottom * columns + right][level] * fractionX
+        return upper * (1 - fractionY) + lower * fractionY
+    })
+    return src.toImage(myImage), nil
+}
+
+// A gamma between 0.01 and 10, 1 by default.
+func gammaParam(params FilterParams, name string) (float64, error) {
+    value, err := params.Float(name, 1)
+    if err != nil {
+        return 0, err
+    }
+    if value < 0.01 || value > 10 {
+        return 0, fmt.Errorf("parameter %q: must be between 0.01 and 10", name)
+    }
+    return value, nil
+}
+
+// Apply one curve to the channels ?channels names (any of r, g and b, all by default).
+func channelCurves(myImage image.Image, params FilterParams, curve toneCurve) (image.Image, error) {
+    channels := params.String("channels", "rgb")
+    if len(channels) == 0 || strings.Trim(channels, "rgb") != "" {
+        return nil, fmt.Errorf("parameter %q: must be made of r, g and b", "channels")
+    }
+
+    var myCurves [3]toneCurve
+    for c, name := range "rgb" {
+        myCurves[c] = func(value float64) float64 {
+            return value
+        }
+        if strings.ContainsRune(channels, name) {
+            myCurves[c] = curve
+        }
+    }
+    return applyToneCurves(myImage, myCurves), nil
+}
+
+// Run the straight colour channels of every pixel through their curves. Alpha stays as it is.
+func applyToneCurves(myImage image.Image, myCurves [3]toneCurve) image.Image {
+    var tables [3][]float32
+    for c, curve := range myCurves {
+        tables[c] = make([]float32, toneTableSize)
+        for i := range tables[c] {
+            tables[c][i] = float32(math.Max(0, math.Min(1, curve(float64(i) / (toneTableSize - 1)))))
+        }
+    }
+
+    myFloats := floatImageFrom(myImage)
+    parallelTiles(myFloats.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := myFloats.offset(x, y)
+                r, g, b, a := straightFloats(myFloats, i)
+                for c, value := range [3]float32{r, g, b} {
+                    myFloats.Pix[i + c] = lookupTone(tables[c], value) * a
+                }
+            }
+        }
+    })
+    return myFloats.toImage(myImage)
+}
+
+// Read a tone table, interpolating between its entries.
+func lookupTone(table []float32, value float32) float32 {
+    position := clampUnit(value) * float32(len(table) - 1)
+    below := int(position)
+    if below >= len(table) - 1 {
+        return table[len(table) - 1]
+    }
+    fraction := position - float32(below)
+    return table[below] * (1 - fraction) + table[below + 1] * fraction
+}
+
+// The histogram bin of a value between 0 and 1.
+func bin(value float64) int {
+    return max(0, min(histogramBins - 1, int(value * histogramBins)))
+}
+
+// Straight channel c of a pixel and its alpha, not ok for fully transparent pixels which have no colour.
+func straightChannel(src *floatImage, i int, c int) (float64, float64, bool) {
+    alpha := float64(clampUnit(src.Pix[i + 3]))
+    if alpha == 0 {
+        return 0, 0, false
+    }
+    return float64(src.Pix[i + c]) / alpha, alpha, true
+}
+
+// The luma of a pixel's straight colour and its alpha, not ok for fully transparent pixels.
+func straightLuma(src *floatImage, i int) (float64, float64, bool) {
+    r, g, b, a := straightFloats(src, i)
+    if a == 0 {
+        return 0, 0, false
+    }
+    return luma(float64(r), float64(g), float64(b)), float64(a), true
+}
+
+// Change the luma of every pixel to what newLuma says, by adding the same amount to all three
+// channels, which leaves the colour differences (and so the hue) as they were.
+func shiftLuma(src *floatImage, newLuma func(x int, y int, value float64) float64) {
+    parallelTiles(src.Rect, func(tile image.Rectangle) {
+        for y := tile.Min.Y; y < tile.Max.Y; y++ {
+            for x := tile.Min.X; x < tile.Max.X; x++ {
+                i := src.offset(x, y)
+                value, alpha, ok := straightLuma(src, i)
+                if !ok {
+                    continue
+                }
+                delta := float32((newLuma(x - src.Rect.Min.X, y - src.Rect.Min.Y, value) - value) * alpha)
+                for c := 0; c < 3; c++ {
+                    src.Pix[i + c] = clampTo(src.Pix[i + c] + delta, src.Pix[i + 3])
+                }
+            }
+        }
+    })
+}
+
+// The mapping that equalizes a histogram: every bin goes to the middle of the share of pixels at or
+// below it. Empty histograms map everything to itself.
+func equalizeHistogram(histogram []float64) []float64 {
+    total := 0.0
+    for _, count := range histogram {
+        total += count
+    }
+    mapping := make([]float64, len(histogram))
+    below := 0.0
+    for i, count := range histogram {
+        if total == 0 {
+            mapping[i] = (float64(i) + 0.5) / float64(len(histogram))
+            continue
+        }
+        mapping[i] = (below + count / 2) / total
+        below += count
+    }
+    return mapping
+}
+
+// Cap every bin at clipLimit times the average and hand what was cut off back to all bins equally,
+// repeating until nothing sticks out any more.
+func clipHistogram(histogram []float64, clipLimit float64) {
+    total := 0.0
+    for _, count := range histogram {
+        total += count
+    }
+    limit := clipLimit * total / float64(len(histogram))
+    for round := 0; round < 8; round++ {
+        excess := 0.0
+        for i, count := range histogram {
+            if count > limit {
+                excess += count - limit
+                histogram[i] = limit
+            }
+        }
+        if excess < 1e-9 {
+            return
+        }
+        for i := range histogram {
+            histogram[i] += excess / float64(len(histogram))
+        }
+    }
+}
+
+// A tone curve from a per bin mapping, interpolating between the centres of the bins.
+func histogramCurve(mapping []float64) toneCurve {
+    return func(value float64) float64 {
+        position := math.Max(0, math.Min(float64(len(mapping) - 1), value * float64(len(mapping)) - 0.5))
+        below := int(position)
+        if below >= len(mapping) - 1 {
+            return mapping[len(mapping) - 1]
+        }
+        fraction := position - float64(below)
+        return mapping[below] * (1 - fraction) + mapping[below + 1] * fraction
+    }
+}
+
+// Control points x0,y0,x1,y1,... as a monotone cubic spline (Fritsch-Carlson), nil when the
+// parameter isn't given.
+func curvePointsParam(params FilterParams, name string) (toneCurve, error) {
+    numbers, err := params.Floats(name)
+    if err != nil {
+        return nil, err
+    }
+    if numbers == nil {
+        return nil, nil
+    }
+    if len(numbers) < 4 || len(numbers) % 2 != 0 || len(numbers) > 64 {
+        return nil, fmt.Errorf("parameter %q: must be between 2 and 32 pairs of x and y", name)
+    }
+
+    count := len(numbers) / 2
+    xs, ys := make([]float64, count), make([]float64, count)
+    for i := 0; i < count; i++ {
+        xs[i], ys[i] = numbers[2 * i], numbers[2 * i + 1]
+        if xs[i] < 0 || xs[i] > 1 || ys[i] < 0 || ys[i] > 1 {
+            return nil, fmt.Errorf("parameter %q: points must be between 0 and 1", name)
+        }
+        if i > 0 && xs[i] <= xs[i - 1] {
+            return nil, fmt.Errorf("parameter %q: x must increase from point to point", name)
+        }
+    }
+
+    // Secant slopes, then tangents at the points limited so no segment overshoots
+    secants := make([]float64, count - 1)
+    for i := range secants {
+        secants[i] = (ys[i + 1] - ys[i]) / (xs[i + 1] - xs[i])
+    }
+    tangents := make([]float64, count)
+    tangents[0], tangents[count - 1] = secants[0], secants[count - 2]
+    for i := 1; i < count - 1; i++ {
+        if secants[i - 1] * secants[i] <= 0 {
+            continue
+        }
+        tangents[i] = (secants[i - 1] + secants[i]) / 2
+    }
+    for i, secant := range secants {
+        if secant == 0 {
+            tangents[i], tangents[i + 1] = 0, 0
+            continue
+        }
+        alpha, beta := tangents[i] / secant, tangents[i + 1] / secant
+        if length := math.Hypot(alpha, beta); length > 3 {
+            tangents[i], tangents[i + 1] = 3 * alpha / length * secant, 3 * beta / length * secant
+        }
+    }
+
+    return func(value float64) float64 {
+        if value <= xs[0] {
+            return ys[0]
+        }
+        if value >= xs[count - 1] {
+            return ys[count - 1]
+        }
+        i := sort.SearchFloat64s(xs, value) - 1
+        step := xs[i + 1] - xs[i]
+        t := (value - xs[i]) / step
+        t2, t3 := t * t, t * t * t
+        return (2 * t3 - 3 * t2 + 1) * ys[i] + (t3 - 2 * t2 + t) * step * tangents[i] + (-2 * t3 + 3 * t2) * ys[i + 1] + (t3 - t2) * step * tangents[i + 1]
+    }, nil
+}